@@ -0,0 +1,89 @@
+package watcher
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AddArchive watches the entries inside the zip archive at path. The
+// archive's entry list is read again in every watching cycle, so entries
+// that are added, updated or removed are reported as Create, Write and
+// Remove events. An entry's event path is the archive's path joined with
+// the entry's name, such as "/tmp/out.zip/docs/readme.txt".
+//
+// While the archive can't be read, such as while it's still being written,
+// its last known entries are kept and a warning is sent on the Error
+// channel. Archives are always read from the local filesystem, even if a
+// backend was set with SetBackend.
+func (w *Watcher) AddArchive(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	list, err := listArchive(path)
+	if err != nil {
+		return err
+	}
+
+	if err := w.addFiles("", list); err != nil {
+		return err
+	}
+	w.archives[path] = false
+
+	return nil
+}
+
+// listArchives lists the entries of every archive added with AddArchive and
+// adds them to fileList, passing any errors to report. The caller must hold
+// w.mu.
+func (w *Watcher) listArchives(fileList map[string]os.FileInfo, report func(error)) {
+	for archive, failed := range w.archives {
+		list, err := listArchive(archive)
+		if err == nil || os.IsNotExist(err) {
+			// The entries of a deleted archive are reported as removed.
+			for k, v := range list {
+				fileList[k] = v
+			}
+			w.archives[archive] = false
+			continue
+		}
+
+		prefix := archive + string(filepath.Separator)
+		for path, info := range w.files {
+			if strings.HasPrefix(path, prefix) {
+				fileList[path] = info
+			}
+		}
+		if !failed {
+			report(&WatcherError{Warning, archive, err})
+		}
+		w.archives[archive] = true
+	}
+}
+
+// listArchive returns the entries of the zip archive at path, keyed by the
+// archive's path joined with the entry's name.
+func listArchive(path string) (map[string]os.FileInfo, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	fileList := make(map[string]os.FileInfo)
+	for _, f := range r.File {
+		name := filepath.Join(path, filepath.FromSlash(f.Name))
+		// Skip entries that would escape the archive, such as "../x".
+		if !strings.HasPrefix(name, path+string(filepath.Separator)) {
+			continue
+		}
+		fileList[name] = f.FileInfo()
+	}
+	return fileList, nil
+}
@@ -0,0 +1,144 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Backend is the filesystem that a Watcher lists files from. By default,
+// files are listed from the local filesystem.
+//
+// The sftpbackend package implements Backend with an SFTP client from
+// github.com/pkg/sftp, to watch a directory on a remote host.
+type Backend interface {
+	// Stat returns the FileInfo for path, following symlinks.
+	Stat(path string) (os.FileInfo, error)
+
+	// Lstat returns the FileInfo for path without following symlinks.
+	Lstat(path string) (os.FileInfo, error)
+
+	// ReadDir returns the FileInfo for each of the entries in the
+	// directory path, without following symlinks.
+	ReadDir(path string) ([]os.FileInfo, error)
+}
+
+// osBackend is the Backend for the local filesystem.
+type osBackend struct{}
+
+func (osBackend) Stat(path string) (os.FileInfo, error)      { return os.Stat(path) }
+func (osBackend) Lstat(path string) (os.FileInfo, error)     { return os.Lstat(path) }
+func (osBackend) ReadDir(path string) ([]os.FileInfo, error) { return ioutil.ReadDir(path) }
+
+// SetBackend sets the filesystem that the watcher lists files from, such as
+// the one from the sftpbackend package for watching a directory on a remote
+// host. Relative paths passed to Add, AddRecursive, Remove and the other
+// methods that take paths are joined to root, which should be an absolute
+// path on the backend. A nil backend sets the watcher back to the local
+// filesystem.
+//
+// SetBackend should be called before any files are added.
+func (w *Watcher) SetBackend(backend Backend, root string) {
+	if backend == nil {
+		backend, root = osBackend{}, ""
+	}
+
+	w.mu.Lock()
+	w.backend = backend
+	w.backendRoot = root
+	w.mu.Unlock()
+}
+
+// SetDirFDCaching sets whether scans of the local filesystem open each
+// directory once and stat the directory's entries relative to its fd, like
+// fstatat, instead of resolving every file's full path again. This saves
+// re-walking the path components of deeply nested files, and a scan that
+// is under way keeps listing a directory even if one of its parents is
+// renamed part way through. Only a small number of the most recently used
+// fds are kept open, and they are all closed at the end of every scan.
+//
+// Directory fds are only cached on Linux and with the default backend. On
+// other platforms, or after SetBackend, SetDirFDCaching has no effect.
+func (w *Watcher) SetDirFDCaching(enabled bool) {
+	w.mu.Lock()
+	w.dirFDCaching = enabled
+	w.mu.Unlock()
+}
+
+// isLocal reports whether backend lists files from the local filesystem.
+func isLocal(backend Backend) bool {
+	if scan, ok := backend.(*timeoutBackend); ok {
+		backend = scan.Backend
+	}
+	if fast, ok := backend.(*modTimeBackend); ok {
+		backend = fast.Backend
+	}
+	switch backend.(type) {
+	case osBackend, presenceBackend, *dirFDBackend:
+		return true
+	}
+	return false
+}
+
+// abs returns an absolute representation of name on the watcher's backend.
+// The caller must hold w.mu.
+func (w *Watcher) abs(name string) (string, error) {
+	if w.backendRoot == "" {
+		return filepath.Abs(name)
+	}
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name), nil
+	}
+	return filepath.Join(w.backendRoot, name), nil
+}
+
+// walkBackend walks the file tree rooted at root on backend, calling walkFn
+// for each file or directory in the tree, including root, in the same way
+// as filepath.Walk.
+func walkBackend(backend Backend, root string, walkFn filepath.WalkFunc) error {
+	info, err := backend.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = walkBackendDir(backend, root, info, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkBackendDir(backend Backend, path string, info os.FileInfo,
+	walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(path, info, nil)
+	}
+
+	infos, err := backend.ReadDir(path)
+	err1 := walkFn(path, info, err)
+	// If err != nil, walk can't walk into this directory.
+	// err1 != nil means walkFn wants walk to skip this directory or stop.
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	// Walk the entries in lexical order like filepath.Walk.
+	sort.Sort(byName(infos))
+
+	for _, fileInfo := range infos {
+		filename := filepath.Join(path, fileInfo.Name())
+		err = walkBackendDir(backend, filename, fileInfo, walkFn)
+		if err != nil && (!fileInfo.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// byName sorts a slice of FileInfo by name.
+type byName []os.FileInfo
+
+func (f byName) Len() int           { return len(f) }
+func (f byName) Less(i, j int) bool { return f[i].Name() < f[j].Name() }
+func (f byName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
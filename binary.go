@@ -0,0 +1,103 @@
+package watcher
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// binarySniffLen is the number of bytes read from the start of a file to
+// detect whether it's binary.
+const binarySniffLen = 8000
+
+// binaryCheck is the cached result of checking whether a file is binary.
+type binaryCheck struct {
+	size    int64
+	modTime time.Time
+	binary  bool
+	scan    uint64 // the scan the file was last listed in.
+}
+
+// IgnoreBinary sets the watcher to ignore binary files, such as images and
+// compiled artifacts. A regular file is binary if the start of it contains
+// a null byte or isn't valid UTF-8. Files are only read again once their
+// size or modification time changes, and a file that can't be read isn't
+// ignored. Binary files are only detected on the local filesystem, so
+// IgnoreBinary has no effect with a backend set with SetBackend.
+func (w *Watcher) IgnoreBinary() {
+	w.mu.Lock()
+	w.ignoreBinary = true
+	w.mu.Unlock()
+}
+
+// isBinaryFiltered reports whether info is a binary file that's filtered
+// out by IgnoreBinary. The caller must hold w.mu.
+func (w *Watcher) isBinaryFiltered(path string, info os.FileInfo) bool {
+	if !w.ignoreBinary || !info.Mode().IsRegular() {
+		return false
+	}
+	if !isLocal(w.backend) {
+		return false
+	}
+
+	check, found := w.binaryChecks[path]
+	if !found || check.size != info.Size() || !check.modTime.Equal(info.ModTime()) {
+		binary, err := isBinaryFile(path)
+		if err != nil {
+			return false
+		}
+		check = &binaryCheck{size: info.Size(), modTime: info.ModTime(), binary: binary}
+		w.binaryChecks[path] = check
+	}
+	check.scan = w.binaryScan
+	return check.binary
+}
+
+// pruneBinaryChecks forgets the files that weren't listed in the last
+// scan. The caller must hold w.mu.
+func (w *Watcher) pruneBinaryChecks() {
+	for path, check := range w.binaryChecks {
+		if check.scan != w.binaryScan {
+			delete(w.binaryChecks, path)
+		}
+	}
+	w.binaryScan++
+}
+
+// isBinaryFile reports whether the start of the file at path looks binary.
+func isBinaryFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return isBinary(buf[:n], n == len(buf)), nil
+}
+
+// isBinary reports whether data contains a null byte or isn't valid UTF-8.
+// If data was truncated, a multibyte character cut off at the end is
+// ignored.
+func isBinary(data []byte, truncated bool) bool {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	if truncated {
+		for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+			if utf8.RuneStart(data[len(data)-i]) {
+				if !utf8.FullRune(data[len(data)-i:]) {
+					data = data[:len(data)-i]
+				}
+				break
+			}
+		}
+	}
+	return !utf8.Valid(data)
+}
@@ -0,0 +1,137 @@
+package watcher
+
+import (
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	bloomBitsPerPath = 10 // gives a false positive rate of about 1%.
+	bloomHashes      = 7  // the optimal number of hashes for 10 bits.
+)
+
+// pathSet is a set of paths for IgnoreManyPaths, which is checked with a
+// bloom filter first so that most paths that aren't in it are rejected
+// without a search. Paths that the filter matches are then searched for in
+// a sorted slice, so there are no false positives. The slice has less
+// overhead per path than a map, and the filter adds about 10 bits per path.
+type pathSet struct {
+	bits  []uint64
+	paths []string // sorted.
+}
+
+// newPathSet returns a pathSet with paths, which must be sorted and
+// without duplicates.
+func newPathSet(paths []string) *pathSet {
+	n := uint64(len(paths)) * bloomBitsPerPath
+	if n < 64 {
+		n = 64
+	}
+	s := &pathSet{
+		bits:  make([]uint64, (n+63)/64),
+		paths: paths,
+	}
+	for _, path := range paths {
+		h1, h2 := bloomHash(path)
+		for i := uint64(0); i < bloomHashes; i++ {
+			bit := (h1 + i*h2) % s.size()
+			s.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	return s
+}
+
+// size returns the number of bits in s's bloom filter.
+func (s *pathSet) size() uint64 {
+	return uint64(len(s.bits)) * 64
+}
+
+// mayContain reports whether path might be in s, according to the bloom
+// filter alone.
+func (s *pathSet) mayContain(path string) bool {
+	h1, h2 := bloomHash(path)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % s.size()
+		if s.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// contains reports whether path is in s.
+func (s *pathSet) contains(path string) bool {
+	if !s.mayContain(path) {
+		return false
+	}
+	i := sort.SearchStrings(s.paths, path)
+	return i < len(s.paths) && s.paths[i] == path
+}
+
+// bloomHash returns the two hashes of path that the bloom filter's hashes
+// are derived from.
+func bloomHash(path string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	sum := h.Sum64()
+	// Make sure the second hash is odd so that it never repeats the first.
+	return sum, (sum>>32 | sum<<32) | 1
+}
+
+// IgnoreManyPaths adds paths that should be ignored like Ignore, but keeps
+// them in a compact set that's meant for ignoring a very large number of
+// paths at once, such as tens of thousands from a generated exclude list.
+// Lookups are checked against a bloom filter first and then confirmed
+// against the exact paths, so a path is never wrongly ignored.
+func (w *Watcher) IgnoreManyPaths(paths []string) error {
+	// Merge paths with the current set under a single lock, so that none
+	// of the paths of concurrent calls are lost.
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var all []string
+	if w.ignoredMany != nil {
+		all = append(all, w.ignoredMany.paths...)
+	}
+	var roots []string
+	for _, path := range paths {
+		path, err := w.abs(path)
+		if err != nil {
+			return err
+		}
+		all = append(all, path)
+		if _, found := w.names[path]; found {
+			roots = append(roots, path)
+		}
+	}
+
+	sort.Strings(all)
+	unique := all[:0]
+	for i, path := range all {
+		if i == 0 || path != all[i-1] {
+			unique = append(unique, path)
+		}
+	}
+	set := newPathSet(unique)
+	w.ignoredMany = set
+
+	// Remove any of the roots that were already added.
+	for _, root := range roots {
+		w.removeRecursive(root)
+	}
+
+	// Remove any of the files that were already added.
+	for path := range w.files {
+		for dir := path; ; dir = filepath.Dir(dir) {
+			if set.contains(dir) {
+				w.deleteFile(path)
+				break
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+	return nil
+}
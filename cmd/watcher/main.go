@@ -24,6 +24,7 @@ func main() {
 	stdinPipe := flag.Bool("pipe", false, "pipe event's info to command's stdin")
 	keepalive := flag.Bool("keepalive", false, "keep alive when a cmd returns code != 0")
 	ignore := flag.String("ignore", "", "comma separated list of paths to ignore")
+	listFile := flag.String("list-file", "", "file containing a newline separated list of paths to watch non-recursively")
 
 	flag.Parse()
 
@@ -31,7 +32,7 @@ func main() {
 	files := flag.Args()
 
 	// If no files/folders were specified, watch the current directory.
-	if len(files) == 0 {
+	if len(files) == 0 && *listFile == "" {
 		curDir, err := os.Getwd()
 		if err != nil {
 			log.Fatalln(err)
@@ -97,7 +98,7 @@ func main() {
 					}
 				}
 			case err := <-w.Error:
-				if err == watcher.ErrWatchedFileDeleted {
+				if watcher.Is(err, watcher.ErrWatchedFileDeleted) {
 					fmt.Println(err)
 					continue
 				}
@@ -121,6 +122,19 @@ func main() {
 		}
 	}
 
+	// Add the files and folders from the list file.
+	if *listFile != "" {
+		f, err := os.Open(*listFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = w.AddFromReader(f)
+		f.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	// Print a list of all of the files and folders being watched.
 	if *listFiles {
 		for path, f := range w.WatchedFiles() {
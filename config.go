@@ -0,0 +1,522 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// WatcherConfig describes a Watcher's options and watched files so that they
+// can be saved, such as with MarshalConfig, and restored with LoadConfig.
+//
+// Filter hooks, event filters, path rewrite hooks, callbacks, root contexts,
+// the backend, the trigger channel, recordings and the webhook's HTTP client
+// can't be serialized, so they aren't part of the config. Neither are the
+// processes added with AddProcessFiles, whose pids don't outlive them.
+type WatcherConfig struct {
+	Roots        []RootConfig `json:"roots"`
+	GlobSet      []string     `json:"glob_set,omitempty"`
+	Archives     []string     `json:"archives,omitempty"`
+	Ignored      []string     `json:"ignored,omitempty"`
+	IgnoredMany  []string     `json:"ignored_many,omitempty"`
+	IgnoredGlobs []string     `json:"ignored_globs,omitempty"`
+	IgnoreGlobs  []string     `json:"ignore_globs,omitempty"`
+	IgnoreFiles  []string     `json:"ignore_files,omitempty"`
+	IgnoreHidden bool         `json:"ignore_hidden"`
+	IgnoreBinary bool         `json:"ignore_binary"`
+	PresenceOnly bool         `json:"presence_only"`
+	OwnerUID     int          `json:"owner_uid"`
+	OwnerGID     int          `json:"owner_gid"`
+	Ops          []string     `json:"ops,omitempty"`
+	MaxEvents    int          `json:"max_events"`
+	MemoryBudget int64        `json:"memory_budget,omitempty"`
+	EventBuffer  int          `json:"event_buffer,omitempty"`
+
+	// RootOps are the ops of the roots added with AddWithOps, by root.
+	RootOps map[string][]string `json:"root_ops,omitempty"`
+
+	// Suspended is true if Suspend was called without a Resume, and
+	// SuspendedRoots are the roots suspended with SuspendRoot.
+	Suspended      bool     `json:"suspended"`
+	SuspendedRoots []string `json:"suspended_roots,omitempty"`
+
+	// Interval and Schedule are the arguments that were passed to Start
+	// or StartSchedule, if the watcher was started.
+	Interval    time.Duration `json:"interval,omitempty"`
+	Schedule    string        `json:"schedule,omitempty"`
+	ManualTicks bool          `json:"manual_ticks"`
+	QuietStart  bool          `json:"quiet_start"`
+	AdaptiveMin time.Duration `json:"adaptive_min,omitempty"`
+	AdaptiveMax time.Duration `json:"adaptive_max,omitempty"`
+
+	SummaryEvents           bool                `json:"summary_events"`
+	BrokenSymlinkPolicy     BrokenSymlinkPolicy `json:"broken_symlink_policy"`
+	FollowSymlinks          bool                `json:"follow_symlinks"`
+	OverlayAwareness        bool                `json:"overlay_awareness"`
+	HierarchicalOrdering    bool                `json:"hierarchical_ordering"`
+	MirrorSafeOrdering      bool                `json:"mirror_safe_ordering"`
+	NoRootSelfEvents        bool                `json:"no_root_self_events"`
+	NoDirModTimeEvents      bool                `json:"no_dir_mod_time_events"`
+	UniqueOps               bool                `json:"unique_ops"`
+	InitialEvents           bool                `json:"initial_events"`
+	LinkCountEvents         bool                `json:"link_count_events"`
+	EventFingerprints       bool                `json:"event_fingerprints"`
+	InodeInfo               bool                `json:"inode_info"`
+	RenameChainWindow       time.Duration       `json:"rename_chain_window,omitempty"`
+	DirDebounce             time.Duration       `json:"dir_debounce,omitempty"`
+	Debounce                time.Duration       `json:"debounce,omitempty"`
+	EdgeMode                EdgeMode            `json:"edge_mode"`
+	SuppressEphemeral       time.Duration       `json:"suppress_ephemeral,omitempty"`
+	ArrivalCycles           int                 `json:"arrival_cycles,omitempty"`
+	StatFailureThreshold    int                 `json:"stat_failure_threshold,omitempty"`
+	FlapCount               int                 `json:"flap_count,omitempty"`
+	FlapWindow              time.Duration       `json:"flap_window,omitempty"`
+	FlapCooldown            time.Duration       `json:"flap_cooldown,omitempty"`
+	ScanTimeout             time.Duration       `json:"scan_timeout,omitempty"`
+	DirFDCaching            bool                `json:"dir_fd_caching"`
+	ReadDirPlus             bool                `json:"read_dir_plus"`
+	LockMonitoring          bool                `json:"lock_monitoring"`
+	WarningsChannel         bool                `json:"warnings_channel"`
+	PauseWhileExists        string              `json:"pause_while_exists,omitempty"`
+	InodeThreshold          uint64              `json:"inode_threshold,omitempty"`
+	ChildCounts             map[string]int      `json:"child_counts,omitempty"`
+	TotalSizes              map[string]int64    `json:"total_sizes,omitempty"`
+	Emptiness               []string            `json:"emptiness,omitempty"`
+	Priorities              map[string]int      `json:"priorities,omitempty"`
+	Groups                  map[string]string   `json:"groups,omitempty"`
+	WatchSetChangeThreshold float64             `json:"watch_set_change_threshold,omitempty"`
+	DirModTimeScanning      bool                `json:"dir_mod_time_scanning"`
+	ForcedFullScanEvery     int                 `json:"forced_full_scan_every,omitempty"`
+	YieldEvery              int                 `json:"yield_every"`
+	SignificantFields       FieldMask           `json:"significant_fields"`
+	WebhookURL              string              `json:"webhook_url,omitempty"`
+	JournalDir              string              `json:"journal_dir,omitempty"`
+	JournalMaxSize          int64               `json:"journal_max_size,omitempty"`
+	JournalMaxFiles         int                 `json:"journal_max_files,omitempty"`
+	TriggerName             string              `json:"trigger_name"`
+	TriggerMode             os.FileMode         `json:"trigger_mode"`
+}
+
+// RootConfig describes a file or directory that was added to a Watcher.
+type RootConfig struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+
+	// Lenient is true for directories added with AddRecursiveLenient.
+	Lenient bool `json:"lenient,omitempty"`
+}
+
+// Config returns the watcher's current configuration.
+func (w *Watcher) Config() WatcherConfig {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cfg := WatcherConfig{
+		IgnoreHidden:            w.ignoreHidden,
+		IgnoreBinary:            w.ignoreBinary,
+		PresenceOnly:            isPresenceOnly(w.backend),
+		OwnerUID:                w.ownerUID,
+		OwnerGID:                w.ownerGID,
+		MaxEvents:               w.maxEvents,
+		MemoryBudget:            w.memoryBudget,
+		EventBuffer:             cap(w.Event),
+		Interval:                w.interval,
+		Schedule:                w.schedule,
+		ManualTicks:             w.manualTicks,
+		QuietStart:              w.quietStart,
+		AdaptiveMin:             w.pollMin,
+		AdaptiveMax:             w.pollMax,
+		SummaryEvents:           w.summary,
+		BrokenSymlinkPolicy:     w.symlinks,
+		FollowSymlinks:          w.follow,
+		OverlayAwareness:        w.overlay,
+		HierarchicalOrdering:    w.hierarchical,
+		MirrorSafeOrdering:      w.mirrorSafe,
+		NoRootSelfEvents:        w.noRootSelf,
+		NoDirModTimeEvents:      w.noDirWrites,
+		InitialEvents:           w.initial,
+		LinkCountEvents:         w.linkCounts,
+		EventFingerprints:       w.fingerprintEvents,
+		InodeInfo:               w.inodeInfo,
+		RenameChainWindow:       w.renameWindow,
+		DirDebounce:             w.dirDebounce,
+		Debounce:                w.debounce,
+		EdgeMode:                w.edgeMode,
+		SuppressEphemeral:       w.ephemeralLifetime,
+		ArrivalCycles:           w.arrivalCycles,
+		StatFailureThreshold:    w.statThreshold,
+		ScanTimeout:             w.scanTimeout,
+		DirFDCaching:            w.dirFDCaching,
+		ReadDirPlus:             w.readDirPlus,
+		LockMonitoring:          w.locks != nil,
+		WarningsChannel:         w.warningsOn,
+		PauseWhileExists:        w.sentinel,
+		InodeThreshold:          w.inodeThreshold,
+		WatchSetChangeThreshold: w.watchSetThreshold,
+		DirModTimeScanning:      w.dirModTimeScan,
+		ForcedFullScanEvery:     w.fullScanEvery,
+		YieldEvery:              w.yieldEvery,
+		SignificantFields:       w.significant,
+		Suspended:               w.suspended,
+		WebhookURL:              w.webhookURL,
+		TriggerName:             w.triggerName,
+		TriggerMode:             w.triggerMode,
+	}
+
+	w.uniqueMu.Lock()
+	cfg.UniqueOps = w.uniqueOps
+	w.uniqueMu.Unlock()
+
+	w.flapMu.Lock()
+	cfg.FlapCount, cfg.FlapWindow, cfg.FlapCooldown = w.flapCount, w.flapWindow, w.flapCooldown
+	w.flapMu.Unlock()
+
+	w.journalMu.Lock()
+	if j := w.journal; j != nil {
+		cfg.JournalDir, cfg.JournalMaxSize, cfg.JournalMaxFiles = j.dir, j.maxSize, j.maxFiles
+	}
+	w.journalMu.Unlock()
+
+	for name, recursive := range w.names {
+		_, lenient := w.lenient[name]
+		cfg.Roots = append(cfg.Roots, RootConfig{
+			Path:      name,
+			Recursive: recursive,
+			Lenient:   lenient,
+		})
+	}
+	sort.Sort(byRootPath(cfg.Roots))
+
+	for path := range w.ignored {
+		cfg.Ignored = append(cfg.Ignored, path)
+	}
+	sort.Strings(cfg.Ignored)
+	if w.ignoredMany != nil {
+		cfg.IgnoredMany = append(cfg.IgnoredMany, w.ignoredMany.paths...)
+	}
+
+	cfg.GlobSet = append(cfg.GlobSet, w.globs...)
+	for archive := range w.archives {
+		cfg.Archives = append(cfg.Archives, archive)
+	}
+	sort.Strings(cfg.Archives)
+	cfg.IgnoredGlobs = append(cfg.IgnoredGlobs, w.ignoredGlobs...)
+	cfg.IgnoreGlobs = append(cfg.IgnoreGlobs, w.ignoreGlobs...)
+	for _, f := range w.ignoreFiles {
+		cfg.IgnoreFiles = append(cfg.IgnoreFiles, f.path)
+	}
+
+	if len(w.ops) > 0 {
+		cfg.Ops = opStrings(w.ops)
+	}
+	if len(w.rootOps) > 0 {
+		cfg.RootOps = make(map[string][]string)
+		for root, ops := range w.rootOps {
+			cfg.RootOps[root] = opStrings(ops)
+		}
+	}
+
+	for root := range w.suspendedRoots {
+		cfg.SuspendedRoots = append(cfg.SuspendedRoots, root)
+	}
+	sort.Strings(cfg.SuspendedRoots)
+
+	for path, c := range w.childCounts {
+		if c.emptiness {
+			cfg.Emptiness = append(cfg.Emptiness, path)
+			continue
+		}
+		if cfg.ChildCounts == nil {
+			cfg.ChildCounts = make(map[string]int)
+		}
+		cfg.ChildCounts[path] = c.threshold
+	}
+	sort.Strings(cfg.Emptiness)
+
+	if len(w.totalSizes) > 0 {
+		cfg.TotalSizes = make(map[string]int64)
+		for root, ts := range w.totalSizes {
+			cfg.TotalSizes[root] = ts.threshold
+		}
+	}
+
+	if len(w.priorities) > 0 {
+		cfg.Priorities = make(map[string]int)
+		for root, priority := range w.priorities {
+			cfg.Priorities[root] = priority
+		}
+	}
+
+	if len(w.groups) > 0 {
+		cfg.Groups = make(map[string]string)
+		for root, group := range w.groups {
+			cfg.Groups[root] = group
+		}
+	}
+
+	return cfg
+}
+
+// MarshalConfig returns the watcher's current configuration encoded as JSON.
+func (w *Watcher) MarshalConfig() ([]byte, error) {
+	return json.Marshal(w.Config())
+}
+
+// LoadConfig creates a new Watcher from a configuration encoded as JSON by
+// MarshalConfig. Options missing from data keep their defaults, so that a
+// partial config or one saved by an older version can be loaded. The
+// watcher isn't started, so the caller should pass the config's Interval or
+// Schedule to Start or StartSchedule.
+func LoadConfig(data []byte) (*Watcher, error) {
+	w := New()
+
+	cfg := w.Config()
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	if err := w.loadConfig(cfg); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// ExportState returns the watcher's watched files and directories, ignore
+// rules and options encoded as JSON, so that they can be restored with
+// ImportState after a restart. It's the same encoding as MarshalConfig.
+func (w *Watcher) ExportState() ([]byte, error) {
+	return w.MarshalConfig()
+}
+
+// ImportState restores the watched files and directories, ignore rules and
+// options encoded by ExportState or MarshalConfig, listing the restored
+// roots' files again. Roots are added to any that w is already watching and
+// the options replace w's current ones, with any missing from data set to
+// their defaults. ImportState returns ErrWatcherRunning if w has already
+// been started.
+func (w *Watcher) ImportState(data []byte) error {
+	cfg := New().Config()
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	running := w.running
+	w.mu.Unlock()
+	if running {
+		return ErrWatcherRunning
+	}
+
+	return w.loadConfig(cfg)
+}
+
+// loadConfig applies cfg's options and adds its roots to w.
+func (w *Watcher) loadConfig(cfg WatcherConfig) error {
+	// Set up everything that affects which files are listed before adding
+	// the roots.
+	w.IgnoreHiddenFiles(cfg.IgnoreHidden)
+	if cfg.IgnoreBinary {
+		w.IgnoreBinary()
+	}
+	if err := w.Ignore(cfg.Ignored...); err != nil {
+		return err
+	}
+	if len(cfg.IgnoredMany) > 0 {
+		if err := w.IgnoreManyPaths(cfg.IgnoredMany); err != nil {
+			return err
+		}
+	}
+	if err := w.IgnoreDoubleStar(cfg.IgnoredGlobs...); err != nil {
+		return err
+	}
+	if err := w.IgnoreGlob(cfg.IgnoreGlobs...); err != nil {
+		return err
+	}
+	for _, path := range cfg.IgnoreFiles {
+		if err := w.AddIgnoreFile(path); err != nil {
+			return err
+		}
+	}
+	w.SetBrokenSymlinkPolicy(cfg.BrokenSymlinkPolicy)
+	w.SetFollowSymlinks(cfg.FollowSymlinks)
+	w.SetPresenceOnly(cfg.PresenceOnly)
+	w.FilterOwner(cfg.OwnerUID, cfg.OwnerGID)
+
+	for _, root := range cfg.Roots {
+		var err error
+		names, withOps := cfg.RootOps[root.Path]
+		switch {
+		case withOps:
+			var ops []Op
+			if ops, err = opsFromStrings(names); err == nil {
+				err = w.AddWithOps(root.Path, ops...)
+			}
+		case root.Lenient:
+			// Paths that can't be listed are skipped, like when they
+			// were first added.
+			w.AddRecursiveLenient(root.Path)
+		case root.Recursive:
+			err = w.AddRecursive(root.Path)
+		default:
+			err = w.Add(root.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := w.AddGlobSet(cfg.GlobSet...); err != nil {
+		return err
+	}
+	for _, archive := range cfg.Archives {
+		if err := w.AddArchive(archive); err != nil {
+			return err
+		}
+	}
+
+	filterOps, err := opsFromStrings(cfg.Ops)
+	if err != nil {
+		return err
+	}
+	if len(filterOps) > 0 {
+		w.FilterOps(filterOps...)
+	}
+	for _, root := range cfg.SuspendedRoots {
+		if err := w.SuspendRoot(root); err != nil {
+			return err
+		}
+	}
+	if cfg.Suspended {
+		w.Suspend()
+	}
+
+	for path, threshold := range cfg.ChildCounts {
+		if err := w.WatchChildCount(path, threshold); err != nil {
+			return err
+		}
+	}
+	for _, path := range cfg.Emptiness {
+		if err := w.WatchEmptiness(path); err != nil {
+			return err
+		}
+	}
+	for root, threshold := range cfg.TotalSizes {
+		if err := w.WatchTotalSize(root, threshold); err != nil {
+			return err
+		}
+	}
+	for root, priority := range cfg.Priorities {
+		if err := w.SetPriority(root, priority); err != nil {
+			return err
+		}
+	}
+	for root, group := range cfg.Groups {
+		if err := w.setGroup(root, group); err != nil {
+			return err
+		}
+	}
+	if err := w.PauseWhileExists(cfg.PauseWhileExists); err != nil {
+		return err
+	}
+
+	w.SetMaxEvents(cfg.MaxEvents)
+	w.SetMemoryBudget(cfg.MemoryBudget)
+	if err := w.SetEventBufferSize(cfg.EventBuffer); err != nil {
+		return err
+	}
+	w.SetSummaryEvents(cfg.SummaryEvents)
+	w.SetOverlayAwareness(cfg.OverlayAwareness)
+	w.SetHierarchicalOrdering(cfg.HierarchicalOrdering)
+	w.SetMirrorSafeOrdering(cfg.MirrorSafeOrdering)
+	w.SetRootSelfEvents(!cfg.NoRootSelfEvents)
+	w.SetDirModTimeEvents(!cfg.NoDirModTimeEvents)
+	w.SetUniqueOps(cfg.UniqueOps)
+	w.SetInitialEvents(cfg.InitialEvents)
+	w.SetLinkCountEvents(cfg.LinkCountEvents)
+	w.SetEventFingerprints(cfg.EventFingerprints)
+	w.SetInodeInfo(cfg.InodeInfo)
+	w.SetRenameChainCoalescing(cfg.RenameChainWindow)
+	w.SetDirDebounce(cfg.DirDebounce)
+	w.SetDebounce(cfg.Debounce)
+	w.SetEdgeMode(cfg.EdgeMode)
+	w.SetSuppressEphemeral(cfg.SuppressEphemeral)
+	w.SetArrivalCycles(cfg.ArrivalCycles)
+	w.SetStatFailureThreshold(cfg.StatFailureThreshold)
+	w.SetFlapDetection(cfg.FlapCount, cfg.FlapWindow, cfg.FlapCooldown)
+	w.SetScanTimeout(cfg.ScanTimeout)
+	w.SetDirFDCaching(cfg.DirFDCaching)
+	w.SetReadDirPlus(cfg.ReadDirPlus)
+	if err := w.SetLockMonitoring(cfg.LockMonitoring); err != nil {
+		return err
+	}
+	w.SetWarningsChannel(cfg.WarningsChannel)
+	if err := w.SetInodeMonitoring(cfg.InodeThreshold); err != nil {
+		return err
+	}
+	w.SetWatchSetChangeThreshold(cfg.WatchSetChangeThreshold)
+	w.SetDirModTimeScanning(cfg.DirModTimeScanning)
+	w.SetForcedFullScanEvery(cfg.ForcedFullScanEvery)
+	w.SetYieldEvery(cfg.YieldEvery)
+	w.SetSignificantFields(cfg.SignificantFields)
+	w.SetWebhook(cfg.WebhookURL, nil)
+	if err := w.SetRotatingJournal(cfg.JournalDir, cfg.JournalMaxSize, cfg.JournalMaxFiles); err != nil {
+		return err
+	}
+	w.SetTriggerDefaults(cfg.TriggerName, cfg.TriggerMode)
+	w.SetManualTicks(cfg.ManualTicks)
+	w.SetQuietStart(cfg.QuietStart)
+	if err := w.SetAdaptivePolling(cfg.AdaptiveMin, cfg.AdaptiveMax); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.interval = cfg.Interval
+	w.schedule = cfg.Schedule
+	w.mu.Unlock()
+
+	return nil
+}
+
+// opFromString returns the Op whose String method returns name.
+func opFromString(name string) (Op, bool) {
+	for op, s := range ops {
+		if s == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+// opsFromStrings returns the Ops named by names, or an error if one of them
+// isn't an Op.
+func opsFromStrings(names []string) ([]Op, error) {
+	var result []Op
+	for _, name := range names {
+		op, found := opFromString(name)
+		if !found {
+			return nil, fmt.Errorf("error: unknown op %q in config", name)
+		}
+		result = append(result, op)
+	}
+	return result, nil
+}
+
+// opStrings returns the sorted names of the ops in set. It's never nil, so
+// that a root added with AddWithOps and no ops keeps its empty set.
+func opStrings(set map[Op]struct{}) []string {
+	names := []string{}
+	for op := range set {
+		names = append(names, op.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// byRootPath sorts a slice of RootConfig by path.
+type byRootPath []RootConfig
+
+func (r byRootPath) Len() int           { return len(r) }
+func (r byRootPath) Less(i, j int) bool { return r[i].Path < r[j].Path }
+func (r byRootPath) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -0,0 +1,106 @@
+package watcher
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// contentSniffLen is the maximum number of bytes that are read from the
+// start of a file by content based filter hooks.
+const contentSniffLen = 512
+
+// contentCache caches the result of matching the first bytes of files so
+// that a file is only read again when its size or mod time changes.
+type contentCache struct {
+	match func(firstBytes []byte) bool
+
+	mu      sync.Mutex
+	results map[string]contentResult
+}
+
+type contentResult struct {
+	size    int64
+	modTime time.Time
+	matched bool
+}
+
+func newContentCache(match func(firstBytes []byte) bool) *contentCache {
+	return &contentCache{
+		match:   match,
+		results: make(map[string]contentResult),
+	}
+}
+
+// matches reports whether the first bytes of the file at path match.
+func (c *contentCache) matches(info os.FileInfo, path string) (bool, error) {
+	c.mu.Lock()
+	result, found := c.results[path]
+	c.mu.Unlock()
+	if found && result.size == info.Size() && result.modTime.Equal(info.ModTime()) {
+		return result.matched, nil
+	}
+
+	firstBytes, err := readFirstBytes(path)
+	if err != nil {
+		return false, err
+	}
+
+	result = contentResult{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		matched: c.match(firstBytes),
+	}
+	c.mu.Lock()
+	c.results[path] = result
+	c.mu.Unlock()
+
+	return result.matched, nil
+}
+
+// readFirstBytes reads up to contentSniffLen bytes from the start of the
+// file at path.
+func readFirstBytes(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, contentSniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// ContentMatchHook is a function that accepts or rejects a regular file
+// for listing based on whether match returns true for the first bytes of
+// its contents, such as a #! shebang. At most 512 bytes are read from each
+// file, and a file is only read again once its size or mod time changes.
+// Directories and other non-regular files are always accepted.
+func ContentMatchHook(match func(firstBytes []byte) bool) FilterFileHookFunc {
+	cache := newContentCache(match)
+
+	return func(info os.FileInfo, fullPath string) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		matched, err := cache.matches(info, fullPath)
+		if os.IsNotExist(err) {
+			// The file was removed since it was listed.
+			return ErrSkip
+		}
+		if err != nil {
+			return err
+		}
+
+		if matched {
+			return nil
+		}
+		return ErrSkip
+	}
+}
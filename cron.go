@@ -0,0 +1,181 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A schedule is a parsed cron expression. Each field is a bit set of the
+// values that the field matches.
+type schedule struct {
+	second, minute, hour, dom, month, dow uint64
+
+	// domStar and dowStar are true when the day of month or day of week
+	// fields are *, which changes how the two fields are combined.
+	domStar, dowStar bool
+}
+
+// scheduleBounds holds the minimum and maximum values for each field.
+var scheduleBounds = [...]struct{ min, max int }{
+	{0, 59}, // second
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, where both 0 and 7 are sunday
+}
+
+// parseSchedule parses a cron expression with 5 or 6 fields.
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		// Run at the start of the minute.
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("error: invalid schedule %q: expected 5 or 6 fields", spec)
+	}
+
+	var sets [6]uint64
+	for i, field := range fields {
+		set, err := parseScheduleField(field, scheduleBounds[i].min, scheduleBounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("error: invalid schedule %q: %s", spec, err)
+		}
+		sets[i] = set
+	}
+
+	// Sunday can be written as either 0 or 7.
+	if sets[5]&(1<<7) != 0 {
+		sets[5] |= 1
+	}
+
+	s := &schedule{
+		second:  sets[0],
+		minute:  sets[1],
+		hour:    sets[2],
+		dom:     sets[3],
+		month:   sets[4],
+		dow:     sets[5],
+		domStar: fields[3] == "*",
+		dowStar: fields[5] == "*",
+	}
+
+	// Make sure the schedule can ever fire, such as not on the 30th of February.
+	now := time.Now()
+	if s.next(now).IsZero() {
+		return nil, fmt.Errorf("error: invalid schedule %q: never fires", spec)
+	}
+
+	return s, nil
+}
+
+// parseScheduleField parses a comma separated list of *, numbers and
+// ranges with optional steps into a bit set.
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var set uint64
+
+	for _, item := range strings.Split(field, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			rng = item[:i]
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %q", item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value in %q", item)
+				}
+			} else if step > 1 {
+				// A step from a single value runs to the maximum.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", item, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	if set == 0 {
+		return 0, errors.New("empty field")
+	}
+	return set, nil
+}
+
+// next returns the first time after t that the schedule fires, or the zero
+// time if it doesn't fire in the next 5 years.
+func (s *schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		// Step the hour and minute on the wall clock, since truncating
+		// the absolute time only lands on them in zones whose offset is a
+		// whole number of hours.
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = after(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()))
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = after(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location()))
+			continue
+		}
+		if s.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// after returns next if it's after t. Otherwise the wall clock went back
+// between them, such as when daylight saving time ends, and it returns the
+// second after t so that the schedule keeps moving forward.
+func after(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Second)
+}
+
+// matchesDay reports whether the day of month and day of week fields
+// match t. Like cron, if both fields are restricted, either can match.
+func (s *schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
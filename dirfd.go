@@ -0,0 +1,11 @@
+// +build !linux
+
+package watcher
+
+// dirFDBackend is only implemented on Linux.
+type dirFDBackend struct{ osBackend }
+
+// newDirFDBackend returns nil, since directory fds are only cached on Linux.
+func newDirFDBackend() *dirFDBackend { return nil }
+
+func (b *dirFDBackend) close() {}
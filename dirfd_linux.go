@@ -0,0 +1,203 @@
+// +build linux
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// oPath is O_PATH, which the syscall package doesn't define. An O_PATH fd
+// can be passed to fstat without the file having to be readable.
+const oPath = 0x200000
+
+// maxDirFDs is the most directory fds a dirFDBackend keeps open at once,
+// so that scanning a tree with many directories doesn't run out of fds.
+const maxDirFDs = 64
+
+// dirFDBackend is the Backend for the local filesystem that opens every
+// directory it lists once per scan and stats the directory's entries
+// relative to the directory's fd, rather than resolving each entry's full
+// path again. Since an open fd keeps referring to its directory, renaming
+// one of the directory's parents part way through a scan doesn't stop the
+// rest of the scan from listing it.
+//
+// Only the maxDirFDs most recently used fds are kept open. A directory
+// whose parent's fd has been closed is opened by its full path instead.
+type dirFDBackend struct {
+	fds  map[string]int // open directory fds, by path.
+	used []string       // paths of the open fds, least recently used first.
+}
+
+// newDirFDBackend returns a dirFDBackend with no open fds.
+func newDirFDBackend() *dirFDBackend {
+	return &dirFDBackend{fds: make(map[string]int)}
+}
+
+// close closes all of the backend's directory fds.
+func (b *dirFDBackend) close() {
+	for path, fd := range b.fds {
+		syscall.Close(fd)
+		delete(b.fds, path)
+	}
+	b.used = nil
+}
+
+// touch marks the fd for path as the most recently used.
+func (b *dirFDBackend) touch(path string) {
+	for i, p := range b.used {
+		if p == path {
+			b.used = append(b.used[:i], b.used[i+1:]...)
+			break
+		}
+	}
+	b.used = append(b.used, path)
+}
+
+// dirFD returns an fd for the directory path, opening it relative to its
+// parent's fd if the parent is still open.
+func (b *dirFDBackend) dirFD(path string) (int, error) {
+	if fd, found := b.fds[path]; found {
+		b.touch(path)
+		return fd, nil
+	}
+
+	const flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_CLOEXEC
+
+	var fd int
+	var err error
+	dir := filepath.Dir(path)
+	if parent, found := b.fds[dir]; found && dir != path {
+		fd, err = syscall.Openat(parent, filepath.Base(path), flags, 0)
+		b.touch(dir)
+	} else {
+		fd, err = syscall.Open(path, flags, 0)
+	}
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	// Close the least recently used fd to make room for this one.
+	if len(b.used) >= maxDirFDs {
+		oldest := b.used[0]
+		b.used = b.used[1:]
+		syscall.Close(b.fds[oldest])
+		delete(b.fds, oldest)
+	}
+	b.fds[path] = fd
+	b.used = append(b.used, path)
+	return fd, nil
+}
+
+// stat returns the FileInfo for path, relative to its parent's fd if the
+// parent is already open.
+func (b *dirFDBackend) stat(path string, follow bool) (os.FileInfo, error) {
+	parent, found := b.fds[filepath.Dir(path)]
+	if !found || filepath.Dir(path) == path {
+		if follow {
+			return os.Stat(path)
+		}
+		return os.Lstat(path)
+	}
+
+	flags := oPath | syscall.O_CLOEXEC
+	if !follow {
+		flags |= syscall.O_NOFOLLOW
+	}
+	fd, err := syscall.Openat(parent, filepath.Base(path), flags, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return &statInfo{name: filepath.Base(path), sys: st}, nil
+}
+
+func (b *dirFDBackend) Stat(path string) (os.FileInfo, error)  { return b.stat(path, true) }
+func (b *dirFDBackend) Lstat(path string) (os.FileInfo, error) { return b.stat(path, false) }
+
+func (b *dirFDBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	fd, err := b.dirFD(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := syscall.Seek(fd, 0, 0); err != nil {
+		return nil, &os.PathError{Op: "seek", Path: path, Err: err}
+	}
+
+	var names []string
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdirent", Path: path, Err: err}
+		}
+		if n <= 0 {
+			break
+		}
+		_, _, names = syscall.ParseDirent(buf[:n], -1, names)
+	}
+
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		info, err := b.stat(filepath.Join(path, name), false)
+		if err != nil {
+			// The entry was removed since the directory was read.
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Sort(byName(infos))
+	return infos, nil
+}
+
+// statInfo is the os.FileInfo for a syscall.Stat_t.
+type statInfo struct {
+	name string
+	sys  syscall.Stat_t
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.sys.Size }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(fi.sys.Mtim.Unix()) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statInfo) Sys() interface{}   { return &fi.sys }
+
+// Mode converts the stat mode bits in the same way as os.Lstat.
+func (fi *statInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.sys.Mode & 0777)
+	switch fi.sys.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if fi.sys.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.sys.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.sys.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,57 @@
+// +build linux
+
+package watcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDirFDCachingManyDirs(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	const dirs = 400
+	for i := 0; i < dirs; i++ {
+		dir := filepath.Join(testDir, fmt.Sprintf("dir_%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.SetDirFDCaching(true)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	want := len(w.WatchedFiles())
+
+	// Allow fewer open fds than there are directories in the tree.
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	lowered := limit
+	lowered.Cur = 256
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+
+	var errs []error
+	fileList := w.scanFiles(func(err error) { errs = append(errs, err) })
+	if len(errs) > 0 {
+		t.Fatalf("expected no errors, got %d, the first being %v", len(errs), errs[0])
+	}
+	if len(fileList) != want {
+		t.Errorf("expected %d files, got %d", want, len(fileList))
+	}
+}
@@ -0,0 +1,89 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// SetDirModTimeScanning sets whether scans only read the directories whose
+// mod times have changed since the last scan. The entries of a directory
+// whose mod time hasn't changed are taken from the last scan without being
+// read or statted again, so a scan of a large tree that hasn't changed only
+// stats its directories. Creates, removes and renames are still found, as
+// long as the filesystem updates a directory's mod time when its entries
+// change, but writes and chmods to the files in unchanged directories are
+// not. Use SetForcedFullScanEvery to find those, and anything missed on
+// filesystems that don't update directory mod times, every few scans. It has
+// no effect with SetPresenceOnly, whose files have no mod times.
+func (w *Watcher) SetDirModTimeScanning(enabled bool) {
+	w.mu.Lock()
+	w.dirModTimeScan = enabled
+	w.mu.Unlock()
+}
+
+// SetForcedFullScanEvery sets the watcher to read and stat everything on
+// every nth scan with SetDirModTimeScanning, whether or not the directories'
+// mod times have changed, to catch anything that the other scans missed. An
+// n of 0, the default, never forces a full scan.
+func (w *Watcher) SetForcedFullScanEvery(n int) {
+	w.mu.Lock()
+	w.fullScanEvery = n
+	w.mu.Unlock()
+}
+
+// fastScan reports whether the next scan should only read the directories
+// whose mod times have changed, and counts the scan towards the next full
+// scan. The caller must hold w.mu.
+func (w *Watcher) fastScan() bool {
+	if !w.dirModTimeScan {
+		return false
+	}
+	w.fastScans++
+	if w.fullScanEvery > 0 && w.fastScans >= w.fullScanEvery {
+		w.fastScans = 0
+		return false
+	}
+	return true
+}
+
+// modTimeBackend is a Backend that answers ReadDir for the directories whose
+// mod times are the same as in the last scan with the entries they had then,
+// and passes everything else on to the backend it wraps.
+type modTimeBackend struct {
+	Backend
+	dirs map[string]*knownDir
+}
+
+// knownDir is a directory as it was listed by the last scan.
+type knownDir struct {
+	info    os.FileInfo
+	entries []os.FileInfo
+}
+
+// newModTimeBackend returns a modTimeBackend for backend that knows the
+// directories in files, which are the watched files of the last scan.
+func newModTimeBackend(backend Backend, files map[string]os.FileInfo) *modTimeBackend {
+	b := &modTimeBackend{Backend: backend, dirs: make(map[string]*knownDir)}
+	for path, info := range files {
+		if info.IsDir() {
+			b.dirs[path] = &knownDir{info: info}
+		}
+	}
+	for path, info := range files {
+		parent := filepath.Dir(path)
+		if dir, found := b.dirs[parent]; found && parent != path {
+			dir.entries = append(dir.entries, info)
+		}
+	}
+	return b
+}
+
+func (b *modTimeBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	if dir, found := b.dirs[path]; found {
+		info, err := b.Backend.Lstat(path)
+		if err == nil && info.ModTime().Equal(dir.info.ModTime()) {
+			return dir.entries, nil
+		}
+	}
+	return b.Backend.ReadDir(path)
+}
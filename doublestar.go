@@ -0,0 +1,96 @@
+package watcher
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// validateDoubleStar returns path.ErrBadPattern if pattern is malformed.
+func validateDoubleStar(pattern string) error {
+	for _, segment := range strings.Split(filepath.ToSlash(pattern), "/") {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchAnyDoubleStar reports whether name matches any of the patterns.
+func matchAnyDoubleStar(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchDoubleStar(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAnyGlob reports whether name matches any of the patterns passed to
+// IgnoreGlob.
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether name matches the filepath.Match pattern. A
+// rooted pattern is matched against the whole of name and a relative one
+// against as many of name's trailing elements as the pattern has.
+func matchGlob(pattern, name string) bool {
+	if strings.Contains(pattern, "**") {
+		return matchDoubleStar(pattern, name)
+	}
+	if !filepath.IsAbs(pattern) {
+		n := strings.Count(filepath.ToSlash(pattern), "/") + 1
+		elems := strings.Split(filepath.ToSlash(name), "/")
+		if n > len(elems) {
+			return false
+		}
+		name = filepath.FromSlash(strings.Join(elems[len(elems)-n:], "/"))
+	}
+	matched, _ := filepath.Match(pattern, name)
+	return matched
+}
+
+// matchDoubleStar reports whether name matches the doublestar pattern.
+// Patterns that aren't rooted with a / match at any depth.
+func matchDoubleStar(pattern, name string) bool {
+	pattern = filepath.ToSlash(pattern)
+	if !strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "**") {
+		pattern = "**/" + pattern
+	}
+	return matchSegments(
+		strings.Split(pattern, "/"),
+		strings.Split(filepath.ToSlash(name), "/"),
+	)
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// ** matches zero or more segments, so try to match the
+			// rest of the pattern from every remaining segment.
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,103 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"time"
+)
+
+// fingerprint is the cached content hash of a file, which is valid for as
+// long as the file's size and mod time don't change.
+type fingerprint struct {
+	size    int64
+	modTime time.Time
+	sum     [sha256.Size]byte
+}
+
+// SetEventFingerprints sets the watcher to compare the contents of created,
+// renamed and moved regular files with the other files that it was already
+// watching. If a file has the same contents as one of them, the event's
+// DuplicateOf is set to that file's path, so that a mirror can hard link or
+// skip copying it. Only files of the same size are hashed, and hashes are
+// cached until a file's size or mod time changes.
+func (w *Watcher) SetEventFingerprints(enabled bool) {
+	w.mu.Lock()
+	w.fingerprintEvents = enabled
+	w.mu.Unlock()
+}
+
+// duplicateOf returns the path of a file in both the old and new file lists
+// that has the same contents as the file of e, or an empty string if there
+// isn't one. The caller must hold w.mu.
+func (w *Watcher) duplicateOf(e Event, files map[string]os.FileInfo) string {
+	if !w.fingerprintEvents || !e.Mode().IsRegular() {
+		return ""
+	}
+
+	var sum *[sha256.Size]byte
+	var duplicate string
+	for path, info := range w.files {
+		if path == e.Path || path == e.OldPath || !info.Mode().IsRegular() ||
+			info.Size() != e.Size() {
+			continue
+		}
+		// Compare to the current version of the file.
+		if info = files[path]; info == nil || info.Size() != e.Size() {
+			continue
+		}
+		// Prefer the first path in lexical order if there are several.
+		if duplicate != "" && path > duplicate {
+			continue
+		}
+
+		if sum == nil {
+			s, err := w.fingerprint(e.Path, e.FileInfo)
+			if err != nil {
+				return ""
+			}
+			sum = &s
+		}
+		other, err := w.fingerprint(path, info)
+		if err == nil && other == *sum {
+			duplicate = path
+		}
+	}
+	return duplicate
+}
+
+// fingerprint returns the content hash of the file at path, hashing it only
+// if it changed since it was last hashed. The caller must hold w.mu.
+func (w *Watcher) fingerprint(path string, info os.FileInfo) ([sha256.Size]byte, error) {
+	fp, found := w.fingerprints[path]
+	if found && fp.size == info.Size() && fp.modTime.Equal(info.ModTime()) {
+		return fp.sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fp.sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fp.sum, err
+	}
+
+	fp = fingerprint{size: info.Size(), modTime: info.ModTime()}
+	copy(fp.sum[:], h.Sum(nil))
+	w.fingerprints[path] = fp
+
+	return fp.sum, nil
+}
+
+// pruneFingerprints forgets the hashes of files that are no longer in files.
+// The caller must hold w.mu.
+func (w *Watcher) pruneFingerprints(files map[string]os.FileInfo) {
+	for path := range w.fingerprints {
+		if _, found := files[path]; !found {
+			delete(w.fingerprints, path)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package watcher
+
+import "time"
+
+// flapState is the recent history of a path's events with
+// SetFlapDetection.
+type flapState struct {
+	times []time.Time // when the path's events in the window were sent.
+	until time.Time   // the end of the path's cooldown, if it's flapping.
+}
+
+// SetFlapDetection sets the watcher to detect files that change too often,
+// such as one being rewritten by a misbehaving process. Once more than count
+// events have been sent for a path within window, a single Flapping event is
+// sent for it instead of the next one, and every other event for the path is
+// dropped until cooldown has passed. A path's history is forgotten once it
+// has had no events for a whole window and has finished cooling down, and
+// every history is forgotten when the watcher starts. A count of 0 or less
+// disables flap detection, which is the default.
+func (w *Watcher) SetFlapDetection(count int, window, cooldown time.Duration) {
+	w.flapMu.Lock()
+	w.flapCount = count
+	w.flapWindow = window
+	w.flapCooldown = cooldown
+	w.flaps = make(map[string]*flapState)
+	w.flapMu.Unlock()
+}
+
+// checkFlapping returns e as it should be sent with SetFlapDetection, which
+// is a Flapping event if e's path has just started flapping, and false if e
+// should be dropped since its path is cooling down. It's called while
+// pollEvents holds w.mu, so it must not try to lock it.
+func (w *Watcher) checkFlapping(e Event) (Event, bool) {
+	if e.Op == Summary || e.Path == "-" {
+		return e, true
+	}
+
+	w.flapMu.Lock()
+	defer w.flapMu.Unlock()
+
+	if w.flapCount <= 0 {
+		return e, true
+	}
+
+	now := time.Now()
+	if now.Sub(w.flapSwept) >= w.flapWindow {
+		w.sweepFlaps(now)
+	}
+
+	f, found := w.flaps[e.Path]
+	if !found {
+		f = new(flapState)
+		w.flaps[e.Path] = f
+	}
+	if now.Before(f.until) {
+		return e, false
+	}
+
+	// Forget the events that have left the window.
+	recent := f.times[:0]
+	for _, t := range f.times {
+		if now.Sub(t) < w.flapWindow {
+			recent = append(recent, t)
+		}
+	}
+	f.times = append(recent, now)
+
+	if len(f.times) > w.flapCount {
+		e.Op = Flapping
+		f.times = nil
+		f.until = now.Add(w.flapCooldown)
+	}
+	return e, true
+}
+
+// sweepFlaps forgets the paths that have had no events within the window and
+// aren't cooling down, so that paths that stop changing, such as temporary
+// files, don't stay in w.flaps forever. It's called at most once per window.
+// The caller must hold w.flapMu.
+func (w *Watcher) sweepFlaps(now time.Time) {
+	for path, f := range w.flaps {
+		if now.Before(f.until) {
+			continue
+		}
+		if n := len(f.times); n == 0 || now.Sub(f.times[n-1]) >= w.flapWindow {
+			delete(w.flaps, path)
+		}
+	}
+	w.flapSwept = now
+}
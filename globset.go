@@ -0,0 +1,78 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AddGlobSet watches every file that matches any of the doublestar patterns,
+// such as "src/**/*.go" and "templates/**/*.html", as a single set. The
+// patterns are matched again in every watching cycle, so files that start
+// matching are reported as created and files that stop matching as removed.
+// A file that matches more than one of the patterns is only watched once.
+// Relative patterns are relative to the current directory.
+func (w *Watcher) AddGlobSet(patterns ...string) error {
+	for _, pattern := range patterns {
+		if err := validateDoubleStar(pattern); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var absPatterns []string
+	for _, pattern := range patterns {
+		pattern, err := w.abs(pattern)
+		if err != nil {
+			return err
+		}
+		absPatterns = append(absPatterns, pattern)
+	}
+
+	if err := w.addFiles("", w.listGlobs(w.backend, absPatterns)); err != nil {
+		return err
+	}
+	w.globs = append(w.globs, absPatterns...)
+
+	return nil
+}
+
+// listGlobs lists the files on backend that match any of patterns. The
+// caller must hold w.mu.
+func (w *Watcher) listGlobs(backend Backend, patterns []string) map[string]os.FileInfo {
+	fileList := make(map[string]os.FileInfo)
+
+	for _, pattern := range patterns {
+		// Skip anything that can't be listed, since the files that
+		// match can come and go.
+		list, _ := w.walk(backend, globBase(pattern), func(path string, err error) error {
+			return nil
+		})
+		for path, info := range list {
+			if matchDoubleStar(pattern, path) {
+				fileList[path] = info
+			}
+		}
+	}
+
+	return fileList
+}
+
+// globBase returns the directory that the files matching the absolute
+// pattern are in, which is the part of pattern before the first segment
+// with a wildcard.
+func globBase(pattern string) string {
+	segments := strings.Split(pattern, string(filepath.Separator))
+	for i, segment := range segments {
+		if strings.ContainsAny(segment, "*?[\\") {
+			base := strings.Join(segments[:i], string(filepath.Separator))
+			if base == "" {
+				return string(filepath.Separator)
+			}
+			return base
+		}
+	}
+	return filepath.Dir(pattern)
+}
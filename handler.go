@@ -0,0 +1,83 @@
+package watcher
+
+// On sets a function that's called with every event of type op that w
+// sends, in place of reading them from the Event channel. Setting f to nil
+// removes the handler for op. Events without a handler of their own are
+// passed to the function set with OnUnhandled, if any, so that new ops
+// aren't silently dropped.
+//
+// The handlers are called one at a time in the goroutine that fans the
+// events out to every subscriber, so a slow handler holds up the others.
+// While any handlers are set, the events are read from the Event channel
+// for them, so the Event channel shouldn't be read as well. A handler
+// that panics is reported as a warning wrapping a *HookPanicError.
+func (w *Watcher) On(op Op, f func(Event)) {
+	w.handlersMu.Lock()
+	if f == nil {
+		delete(w.handlers, op)
+	} else {
+		w.handlers[op] = f
+	}
+	w.handlersMu.Unlock()
+	w.startHandling()
+}
+
+// OnUnhandled sets a function that's called with every event that has no
+// handler set for its op with On. Setting f to nil removes it.
+func (w *Watcher) OnUnhandled(f func(Event)) {
+	w.handlersMu.Lock()
+	w.onUnhandled = f
+	w.handlersMu.Unlock()
+	w.startHandling()
+}
+
+// startHandling subscribes to w's events to pass them to the handlers, if
+// it hasn't already. w.handlersMu is released before subscribing, since the
+// fan-out goroutine closes subscriptions while holding w.subsMu, and the
+// close function below locks w.handlersMu.
+func (w *Watcher) startHandling() {
+	w.handlersMu.Lock()
+	if w.handling {
+		w.handlersMu.Unlock()
+		return
+	}
+	w.handling = true
+	w.handlersMu.Unlock()
+
+	w.subscribe(w.handle, func() {
+		w.handlersMu.Lock()
+		w.handling = false
+		w.handlersMu.Unlock()
+	})
+}
+
+// handle passes e to the handler set for its op, or to the unhandled
+// handler if there isn't one.
+func (w *Watcher) handle(e Event, done <-chan struct{}) {
+	w.handlersMu.Lock()
+	f, found := w.handlers[e.Op]
+	if !found {
+		f = w.onUnhandled
+	}
+	w.handlersMu.Unlock()
+
+	if f == nil {
+		return
+	}
+	if err := callHandler(f, e); err != nil {
+		select {
+		case w.warnings() <- &WatcherError{Warning, e.Path, err}:
+		case <-done:
+		case <-w.stop:
+		}
+	}
+}
+
+// callHandler calls the event handler f with e, returning a
+// *HookPanicError if it panics.
+func callHandler(f func(Event), e Event) (err error) {
+	defer recoverHook(&err)
+
+	f(e)
+	return nil
+}
@@ -0,0 +1,56 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+)
+
+// HookPanicError is the error that's sent on the Error channel, wrapped in a
+// *WatcherError, when a filter hook or callback panics. A file whose filter
+// hook panics is skipped.
+type HookPanicError struct {
+	Value interface{} // the value passed to panic.
+	Stack []byte      // the stack trace of the panicking goroutine.
+}
+
+func (e *HookPanicError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrHookPanic, e.Value)
+}
+
+// Unwrap returns ErrHookPanic.
+func (e *HookPanicError) Unwrap() error {
+	return ErrHookPanic
+}
+
+// recoverHook turns a panic into a *HookPanicError stored in err. It must be
+// deferred directly.
+func recoverHook(err *error) {
+	if r := recover(); r != nil {
+		*err = &HookPanicError{Value: r, Stack: debug.Stack()}
+	}
+}
+
+// callHook calls the filter hook f for the file at path. If f panics, the
+// panic is queued to be sent on the Error channel and the file is skipped.
+// The caller must hold w.mu.
+func (w *Watcher) callHook(f FilterFileHookFunc, info os.FileInfo, path string) (err error) {
+	defer func() {
+		if perr, ok := err.(*HookPanicError); ok {
+			w.hookPanics = append(w.hookPanics, &WatcherError{Warning, path, perr})
+			err = ErrSkip
+		}
+	}()
+	defer recoverHook(&err)
+
+	return f(info, path)
+}
+
+// callWatchSetChange calls the watch set change callback f, returning a
+// *HookPanicError if it panics.
+func callWatchSetChange(f func(oldCount, newCount int), oldCount, newCount int) (err error) {
+	defer recoverHook(&err)
+
+	f(oldCount, newCount)
+	return nil
+}
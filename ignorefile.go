@@ -0,0 +1,181 @@
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ignoreFile is a gitignore-format file added with AddIgnoreFile.
+type ignoreFile struct {
+	path    string
+	dir     string // directory that the rules are relative to.
+	modTime time.Time
+	size    int64
+	rules   []ignoreRule
+}
+
+// ignoreRule is one of the patterns in an ignore file.
+type ignoreRule struct {
+	segments []string // pattern split on /.
+	negate   bool     // the pattern started with !.
+	dirOnly  bool     // the pattern ended with /.
+	anchored bool     // the pattern contained a / before its end.
+}
+
+// AddIgnoreFile ignores the paths matched by the gitignore-format file at
+// path, such as a project's .gitignore. Patterns are relative to the
+// directory that contains the file and support # comments, negation with
+// !, patterns ending in / that only match directories, and **. Like with
+// git, the last pattern that matches a path decides whether it's ignored,
+// and a file inside an ignored directory can't be re-included.
+//
+// The file is read again at the start of a scan whenever it has changed.
+//
+// For files that are already added, AddIgnoreFile removes them.
+func (w *Watcher) AddIgnoreFile(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	f := &ignoreFile{path: path, dir: filepath.Dir(path)}
+	if err := f.load(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.ignoreFiles = append(w.ignoreFiles, f)
+
+	// Remove any of the files that were already added.
+	for path, info := range w.files {
+		if f.matchTree(path, info.IsDir()) {
+			w.deleteFile(path)
+		}
+	}
+	return nil
+}
+
+// reloadIgnoreFiles reads the ignore files that changed since they were
+// last read. An ignore file that can't be read keeps its last rules. The
+// caller must hold w.mu.
+func (w *Watcher) reloadIgnoreFiles() {
+	for _, f := range w.ignoreFiles {
+		info, err := os.Stat(f.path)
+		if err != nil || (info.ModTime().Equal(f.modTime) && info.Size() == f.size) {
+			continue
+		}
+		f.load()
+	}
+}
+
+// isIgnoredByFile reports whether path is ignored by the rules of any of
+// the ignore files. The caller must hold w.mu.
+func (w *Watcher) isIgnoredByFile(path string, isDir bool) bool {
+	ignored := false
+	for _, f := range w.ignoreFiles {
+		if matched, negate := f.match(path, isDir); matched {
+			ignored = !negate
+		}
+	}
+	return ignored
+}
+
+// load reads and parses the ignore file's rules.
+func (f *ignoreFile) load() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.rules, f.modTime, f.size = rules, info.ModTime(), info.Size()
+	return nil
+}
+
+// parseIgnoreRule parses a line of a gitignore-format file. It returns false
+// for blank lines and comments.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	var rule ignoreRule
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+
+	// A pattern with a / anywhere but its end is relative to the ignore
+	// file's directory, and one without is matched at any depth.
+	rule.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if !rule.anchored && line != "**" {
+		line = "**/" + line
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// match reports whether the last of the ignore file's rules that matches
+// path, if any, is a negated one.
+func (f *ignoreFile) match(path string, isDir bool) (matched, negate bool) {
+	rel, err := filepath.Rel(f.dir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false, false
+	}
+	name := strings.Split(filepath.ToSlash(rel), "/")
+
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		rule := f.rules[i]
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(rule.segments, name) {
+			return true, rule.negate
+		}
+	}
+	return false, false
+}
+
+// matchTree reports whether path or any of its parent directories below the
+// ignore file's directory are ignored by the ignore file.
+func (f *ignoreFile) matchTree(path string, isDir bool) bool {
+	for dir := path; strings.HasPrefix(dir, f.dir+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if matched, negate := f.match(dir, isDir || dir != path); matched && !negate {
+			return true
+		}
+	}
+	return false
+}
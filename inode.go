@@ -0,0 +1,17 @@
+// +build !windows,!plan9
+
+package watcher
+
+import (
+	"os"
+	"syscall"
+)
+
+// inodeOf returns the inode and device numbers of the file described by info.
+func inodeOf(info os.FileInfo) (ino, dev uint64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(stat.Ino), uint64(stat.Dev), true
+}
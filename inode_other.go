@@ -0,0 +1,10 @@
+// +build windows plan9
+
+package watcher
+
+import "os"
+
+// inodeOf returns the inode and device numbers of the file described by info.
+func inodeOf(info os.FileInfo) (ino, dev uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,169 @@
+package watcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// journalName is the name of the journal file that events are written to.
+// Rotated files are named events.1.ndjson, events.2.ndjson and so on, with
+// events.1.ndjson the most recent.
+const journalName = "events.ndjson"
+
+// rotatingJournal writes events to NDJSON files in a directory, rolling over
+// to a new file when the current one would grow past maxSize.
+type rotatingJournal struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+// SetRotatingJournal writes every event sent on the Event channel to dir as
+// a line of JSON, for agents that keep a journal of the changes they've
+// seen. Events are written to events.ndjson, which is rolled over to
+// events.1.ndjson once writing another event would make it larger than
+// maxSize bytes, and at most maxFiles files are kept, including the current
+// one. An error writing the journal is sent on the Error channel as a
+// warning, and the watcher keeps watching without waiting for the warning to
+// be received. Any errors while the warning is waiting are dropped. An empty
+// dir stops writing the journal.
+func (w *Watcher) SetRotatingJournal(dir string, maxSize int64, maxFiles int) error {
+	var j *rotatingJournal
+	if dir != "" {
+		if maxSize < 1 || maxFiles < 1 {
+			return errors.New("error: journal max size and max files must be at least 1")
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		j = &rotatingJournal{dir: dir, maxSize: maxSize, maxFiles: maxFiles}
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+
+	w.journalMu.Lock()
+	old := w.journal
+	w.journal = j
+	w.journalMu.Unlock()
+
+	if old != nil {
+		return old.close()
+	}
+	return nil
+}
+
+// journalEvent writes e to the journal set with SetRotatingJournal, if any.
+// It's called while pollEvents holds w.mu, so it must not try to lock it.
+// A failed write is reported from a goroutine of its own, so that the
+// watching process doesn't wait for the Error channel to be read, and any
+// failures while that warning is waiting to be received are dropped.
+func (w *Watcher) journalEvent(e Event) {
+	w.journalMu.Lock()
+	j := w.journal
+	var err error
+	if j != nil {
+		err = j.write(e)
+	}
+	w.journalMu.Unlock()
+
+	if err != nil && atomic.CompareAndSwapInt32(&w.journalWarning, 0, 1) {
+		w.spawn(func() {
+			defer atomic.StoreInt32(&w.journalWarning, 0)
+			select {
+			case <-w.stop:
+			case w.warnings() <- &WatcherError{Warning, j.dir, err}:
+			}
+		})
+	}
+}
+
+// open opens the current journal file for appending.
+func (j *rotatingJournal) open() error {
+	f, err := os.OpenFile(filepath.Join(j.dir, journalName),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.f, j.size = f, info.Size()
+	return nil
+}
+
+// close closes the current journal file.
+func (j *rotatingJournal) close() error {
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// write writes e to the current journal file as a line of JSON, rolling
+// over to a new file first if e wouldn't fit.
+func (j *rotatingJournal) write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if j.f != nil && j.size > 0 && j.size+int64(len(line)) > j.maxSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	if j.f == nil {
+		// The last rollover or write failed, so try again.
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := j.f.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		j.close()
+	}
+	return err
+}
+
+// rotate renames the current journal file to events.1.ndjson, shifting the
+// older files along and removing any beyond maxFiles.
+func (j *rotatingJournal) rotate() error {
+	if err := j.close(); err != nil {
+		return err
+	}
+
+	current := filepath.Join(j.dir, journalName)
+	if j.maxFiles == 1 {
+		return os.Remove(current)
+	}
+
+	rotated := func(n int) string {
+		return filepath.Join(j.dir, fmt.Sprintf("events.%d.ndjson", n))
+	}
+
+	// Remove the oldest file to make room, then shift the rest along.
+	if err := os.Remove(rotated(j.maxFiles - 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := j.maxFiles - 2; n >= 1; n-- {
+		if err := os.Rename(rotated(n), rotated(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(current, rotated(1))
+}
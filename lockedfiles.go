@@ -0,0 +1,9 @@
+// +build !linux
+
+package watcher
+
+// lockedFiles returns ErrLockMonitoringUnsupported, since the locks held
+// on files are only found through /proc on Linux.
+func lockedFiles() (map[fileID]bool, error) {
+	return nil, ErrLockMonitoringUnsupported
+}
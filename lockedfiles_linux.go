@@ -0,0 +1,60 @@
+// +build linux
+
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lockedFiles returns the files that any process holds an advisory lock
+// on, as listed in /proc/locks.
+func lockedFiles() (map[fileID]bool, error) {
+	f, err := os.Open("/proc/locks")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	held := make(map[fileID]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines look like "1: FLOCK  ADVISORY  WRITE 1234 08:01:5678 0 EOF".
+		// Locks that are waiting to be acquired have "->" after the ID
+		// and are skipped.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] == "->" {
+			continue
+		}
+		id, ok := parseLockedFile(fields[5])
+		if ok {
+			held[id] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return held, nil
+}
+
+// parseLockedFile parses a file from /proc/locks in the form
+// "major:minor:inode", where major and minor are in hex, into the device
+// and inode numbers that stat returns for it.
+func parseLockedFile(s string) (fileID, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return fileID{}, false
+	}
+	major, err1 := strconv.ParseUint(parts[0], 16, 32)
+	minor, err2 := strconv.ParseUint(parts[1], 16, 32)
+	ino, err3 := strconv.ParseUint(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return fileID{}, false
+	}
+	// Encode the device number the same way as glibc's makedev.
+	dev := (minor & 0xff) | ((major & 0xfff) << 8) |
+		((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32)
+	return fileID{dev, ino}, true
+}
@@ -0,0 +1,93 @@
+package watcher
+
+import "os"
+
+// fileID identifies a file by its device and inode numbers.
+type fileID struct {
+	dev, ino uint64
+}
+
+// SetLockMonitoring sets whether the watcher checks which of the watched
+// files are advisory locked, such as with flock or fcntl, in every watching
+// cycle. A Locked event is sent when a file becomes locked by any process,
+// and an Unlocked event when it's no longer locked, such as to coordinate
+// with tools that lock files while they work on them. Files that are
+// already locked when it's enabled don't send an event.
+//
+// Lock monitoring is only supported on Linux, where the locks are read from
+// /proc/locks. On other platforms, enabling it returns
+// ErrLockMonitoringUnsupported. Locks are only found for files on the local
+// filesystem, even if a backend was set with SetBackend.
+func (w *Watcher) SetLockMonitoring(enabled bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !enabled {
+		w.locks = nil
+		return nil
+	}
+
+	held, err := lockedFiles()
+	if err != nil {
+		return err
+	}
+	w.locks = make(map[string]bool)
+	for path, info := range w.files {
+		if isLocked(held, info) {
+			w.locks[path] = true
+		}
+	}
+	return nil
+}
+
+// isLocked reports whether the file described by info is in held.
+func isLocked(held map[fileID]bool, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	ino, dev, ok := inodeOf(info)
+	return ok && held[fileID{dev, ino}]
+}
+
+// pollLocks sends Locked and Unlocked events for the files in files whose
+// lock state changed since the last cycle, with SetLockMonitoring, passing
+// any error listing the locks to report.
+func (w *Watcher) pollLocks(files map[string]os.FileInfo, send func(Event) bool, report func(error)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.locks == nil {
+		return
+	}
+
+	held, err := lockedFiles()
+	if err != nil {
+		report(&WatcherError{Warning, "", err})
+		return
+	}
+
+	// Forget the files that are gone.
+	for path := range w.locks {
+		if _, found := files[path]; !found {
+			delete(w.locks, path)
+		}
+	}
+
+	for path, info := range files {
+		locked := isLocked(held, info)
+		if locked == w.locks[path] {
+			continue
+		}
+		e := w.newEvent(Unlocked, path, "", info)
+		if locked {
+			e.Op = Locked
+			w.locks[path] = true
+		} else {
+			delete(w.locks, path)
+		}
+
+		if !send(e) {
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// +build linux
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetLockMonitoring(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+	w.FilterOps(Locked, Unlocked)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetLockMonitoring(true); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Config().LockMonitoring {
+		t.Error("expected the config to have lock monitoring enabled")
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	tick := func() []Event {
+		ticked := make(chan error)
+		go func() { ticked <- w.Tick() }()
+
+		var events []Event
+		for {
+			select {
+			case event := <-w.Event:
+				events = append(events, event)
+			case err := <-ticked:
+				if err != nil {
+					t.Fatal(err)
+				}
+				return events
+			}
+		}
+	}
+
+	name, err := filepath.Abs(filepath.Join(testDir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	events := tick()
+	if len(events) != 1 || events[0].Op != Locked || events[0].Path != name {
+		t.Fatalf("expected a Locked event for %s, got %v", name, events)
+	}
+
+	// The lock is only reported once.
+	if events := tick(); len(events) != 0 {
+		t.Errorf("expected no events while the file stays locked, got %v", events)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	events = tick()
+	if len(events) != 1 || events[0].Op != Unlocked || events[0].Path != name {
+		t.Fatalf("expected an Unlocked event for %s, got %v", name, events)
+	}
+}
@@ -0,0 +1,145 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileEntryCost is the estimated number of bytes used for each watched file
+// besides its path, for its map entry and FileInfo.
+const fileEntryCost = 200
+
+// SetMemoryBudget sets the maximum number of bytes that the watcher's list
+// of watched files should use, such as to avoid running out of memory when
+// a watched tree is unexpectedly large. The memory used is estimated from
+// the length of each file's path plus a fixed overhead per file.
+//
+// Adding files that would exceed the budget fails with ErrMemoryBudget and
+// nothing is added. If new files found by a scan would exceed the budget,
+// the least important of the new files are left out, starting with those in
+// the lowest priority roots, set with SetPriority, and the deepest
+// directories, and ErrMemoryBudget is sent on the Error channel as a
+// warning. Files that were already being watched are kept, and a directory
+// is only left out along with the files below it. A budget of 0 means no
+// limit, which is the default.
+func (w *Watcher) SetMemoryBudget(bytes int64) {
+	w.mu.Lock()
+	w.memoryBudget = bytes
+	w.mu.Unlock()
+}
+
+// fileCost returns the estimated number of bytes used to watch path.
+func fileCost(path string) int64 {
+	return fileEntryCost + int64(len(path))
+}
+
+// filesCost returns the estimated number of bytes used to watch files.
+func filesCost(files map[string]os.FileInfo) int64 {
+	var cost int64
+	for path := range files {
+		cost += fileCost(path)
+	}
+	return cost
+}
+
+// checkMemoryBudget returns ErrMemoryBudget if adding fileList to the
+// watched files would exceed the memory budget. The caller must hold w.mu.
+func (w *Watcher) checkMemoryBudget(fileList map[string]os.FileInfo) error {
+	if w.memoryBudget <= 0 {
+		return nil
+	}
+	cost := filesCost(w.files)
+	for path := range fileList {
+		if _, found := w.files[path]; !found {
+			cost += fileCost(path)
+		}
+	}
+	if cost > w.memoryBudget {
+		return ErrMemoryBudget
+	}
+	return nil
+}
+
+// enforceMemoryBudget removes the least important new files from fileList
+// until it fits in the memory budget, passing ErrMemoryBudget to report the
+// first time it doesn't. Files that are already being watched are never
+// removed, since that would look as if they had been deleted, and neither
+// are directories that still have files below them. The caller must hold
+// w.mu.
+func (w *Watcher) enforceMemoryBudget(fileList map[string]os.FileInfo, report func(error)) {
+	if w.memoryBudget <= 0 {
+		return
+	}
+	cost := filesCost(fileList)
+	if cost <= w.memoryBudget {
+		w.overBudget = false
+		return
+	}
+
+	// children holds the number of files in fileList directly below each
+	// directory.
+	children := make(map[string]int)
+	candidates := make([]evictionCandidate, 0, len(fileList))
+	for path := range fileList {
+		children[filepath.Dir(path)]++
+		if _, known := w.files[path]; known {
+			continue
+		}
+		candidates = append(candidates, evictionCandidate{
+			path:     path,
+			priority: w.priorities[w.rootOf(path)],
+			depth:    strings.Count(path, string(filepath.Separator)),
+		})
+	}
+	sort.Sort(byEviction(candidates))
+
+	// A directory can only be removed once its files have been, so keep
+	// going over the candidates for as long as more of them can be removed.
+	for removed := true; removed && cost > w.memoryBudget; {
+		removed = false
+		for i, c := range candidates {
+			if cost <= w.memoryBudget {
+				break
+			}
+			if c.path == "" || children[c.path] > 0 {
+				continue
+			}
+			delete(fileList, c.path)
+			children[filepath.Dir(c.path)]--
+			cost -= fileCost(c.path)
+			candidates[i].path = ""
+			removed = true
+		}
+	}
+
+	if !w.overBudget {
+		report(&WatcherError{Warning, "", ErrMemoryBudget})
+	}
+	w.overBudget = true
+}
+
+// An evictionCandidate is a new file that can be left out of a scan to stay
+// within the memory budget.
+type evictionCandidate struct {
+	path     string
+	priority int // the priority of the file's root.
+	depth    int
+}
+
+// byEviction sorts files with the least important first: by ascending
+// priority, then by descending depth.
+type byEviction []evictionCandidate
+
+func (e byEviction) Len() int      { return len(e) }
+func (e byEviction) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byEviction) Less(i, j int) bool {
+	switch {
+	case e[i].priority != e[j].priority:
+		return e[i].priority < e[j].priority
+	case e[i].depth != e[j].depth:
+		return e[i].depth > e[j].depth
+	}
+	return e[i].path < e[j].path
+}
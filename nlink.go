@@ -0,0 +1,17 @@
+// +build !windows,!plan9
+
+package watcher
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount is a variable so tests can mock the link counts of files.
+var linkCount = func(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Nlink), true
+}
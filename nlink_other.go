@@ -0,0 +1,10 @@
+// +build windows plan9
+
+package watcher
+
+import "os"
+
+// linkCount is a variable so tests can mock the link counts of files.
+var linkCount = func(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package watcher
+
+// writableFiles returns ErrProcessFilesUnsupported, since a process's open
+// files are only found through /proc on Linux.
+func writableFiles(pid int) ([]string, error) {
+	return nil, ErrProcessFilesUnsupported
+}
@@ -0,0 +1,61 @@
+// +build linux
+
+package watcher
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// writableFiles returns the paths of the files that the process pid has
+// open for writing.
+func writableFiles(pid int) ([]string, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, fd := range fds {
+		path, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+		// Skip pipes, sockets and the like, which aren't linked to a path.
+		if err != nil || !filepath.IsAbs(path) {
+			continue
+		}
+		flags, err := fdFlags(filepath.Join(dir, "fdinfo", fd.Name()))
+		if err != nil || flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// fdFlags returns the flags that the fd described by the fdinfo file at
+// path was opened with.
+func fdFlags(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "flags:" {
+			return strconv.ParseUint(fields[1], 8, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, os.ErrNotExist
+}
@@ -0,0 +1,31 @@
+package watcher
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// whiteoutPrefix is the prefix overlay filesystems give to the files
+	// that mark a file in a lower layer as deleted.
+	whiteoutPrefix = ".wh."
+
+	// whiteoutMetaPrefix is the prefix of overlay metadata files such as
+	// opaque directory markers, which don't shadow any file.
+	whiteoutMetaPrefix = ".wh..wh."
+)
+
+// isWhiteout reports whether path is an overlay whiteout or metadata file.
+func isWhiteout(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), whiteoutPrefix)
+}
+
+// whiteoutTarget returns the path that the whiteout file at path shadows.
+// If path is an overlay metadata file, whiteoutTarget returns false.
+func whiteoutTarget(path string) (string, bool) {
+	base := filepath.Base(path)
+	if strings.HasPrefix(base, whiteoutMetaPrefix) {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(path), strings.TrimPrefix(base, whiteoutPrefix)), true
+}
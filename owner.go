@@ -0,0 +1,17 @@
+// +build !windows,!plan9
+
+package watcher
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner is a variable so tests can mock the owners of files.
+var fileOwner = func(info os.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
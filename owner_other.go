@@ -0,0 +1,10 @@
+// +build windows plan9
+
+package watcher
+
+import "os"
+
+// fileOwner is a variable so tests can mock the owners of files.
+var fileOwner = func(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,65 @@
+package watcher
+
+import (
+	"os"
+	"time"
+)
+
+// SetPresenceOnly sets whether the watcher only tracks which files exist,
+// without reading their modification times, sizes or permissions, such as
+// for a cleanup process that only cares about Create and Remove events.
+// Directories are listed without statting each of their entries, which
+// makes scans of large trees much cheaper, but Write and Chmod events are
+// never sent and renamed files are reported as a Remove and a Create.
+//
+// It isn't enabled automatically by FilterOps, since filter hooks are given
+// the same minimal FileInfo. SetPresenceOnly replaces a backend set with
+// SetBackend and should be called before any files are added.
+func (w *Watcher) SetPresenceOnly(enabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case enabled:
+		w.backend, w.backendRoot = presenceBackend{}, ""
+	case isPresenceOnly(w.backend):
+		w.backend = osBackend{}
+	}
+}
+
+// isPresenceOnly reports whether backend was set with SetPresenceOnly.
+func isPresenceOnly(backend Backend) bool {
+	_, presence := backend.(presenceBackend)
+	return presence
+}
+
+// presenceBackend is the Backend for the local filesystem that lists the
+// entries of directories without statting them. Its FileInfo only has the
+// file's name and type.
+type presenceBackend struct{}
+
+func (presenceBackend) Stat(path string) (os.FileInfo, error)      { return presenceStat(os.Stat(path)) }
+func (presenceBackend) Lstat(path string) (os.FileInfo, error)     { return presenceStat(os.Lstat(path)) }
+func (presenceBackend) ReadDir(path string) ([]os.FileInfo, error) { return readDirTypes(path) }
+
+// presenceStat returns a presenceInfo for the result of a stat.
+func presenceStat(info os.FileInfo, err error) (os.FileInfo, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &presenceInfo{name: info.Name(), mode: info.Mode() & os.ModeType}, nil
+}
+
+// presenceInfo is the FileInfo of a directory entry that wasn't statted. It
+// only has the entry's name and type.
+type presenceInfo struct {
+	name string
+	mode os.FileMode
+}
+
+func (fi *presenceInfo) Name() string       { return fi.name }
+func (fi *presenceInfo) Size() int64        { return 0 }
+func (fi *presenceInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *presenceInfo) ModTime() time.Time { return time.Time{} }
+func (fi *presenceInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *presenceInfo) Sys() interface{}   { return nil }
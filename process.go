@@ -0,0 +1,99 @@
+package watcher
+
+import "os"
+
+// AddProcessFiles watches the regular files that the process pid has open
+// for writing, which are found through /proc/pid/fd. The set of files is
+// evaluated again in every watching cycle, so files are watched from the
+// cycle after the process opens them until the cycle after it closes them,
+// and Write events are sent whenever they change in between. Opening or
+// closing a file doesn't send an event of its own. Once the process exits,
+// a warning is sent on the Error channel and it's no longer watched.
+//
+// AddProcessFiles is only supported on Linux. On other platforms, it returns
+// ErrProcessFilesUnsupported. Process files are always read from the local
+// filesystem, even if a backend was set with SetBackend.
+func (w *Watcher) AddProcessFiles(pid int) error {
+	paths, err := writableFiles(pid)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	list := make(map[string]os.FileInfo)
+	current := make(map[string]bool)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		current[path] = true
+		if _, found := w.files[path]; !found {
+			list[path] = info
+		}
+	}
+
+	if err := w.addFiles("", list); err != nil {
+		return err
+	}
+	w.processes[pid] = current
+
+	return nil
+}
+
+// listProcessFiles adds the files that the processes added with
+// AddProcessFiles have open for writing to fileList, passing any errors to
+// report. The caller must hold w.mu.
+func (w *Watcher) listProcessFiles(fileList map[string]os.FileInfo, report func(error)) {
+	if len(w.processes) == 0 {
+		return
+	}
+
+	// The files that any of the processes had open, and the ones they
+	// have open that aren't watched anyway.
+	previous := make(map[string]bool)
+	added := make(map[string]bool)
+
+	for pid, files := range w.processes {
+		for path := range files {
+			previous[path] = true
+		}
+
+		paths, err := writableFiles(pid)
+		if err != nil {
+			// The process has exited.
+			report(&WatcherError{Warning, "", err})
+			delete(w.processes, pid)
+			continue
+		}
+
+		files = make(map[string]bool)
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			files[path] = true
+
+			if _, listed := fileList[path]; !listed {
+				fileList[path] = info
+				added[path] = true
+			}
+		}
+		w.processes[pid] = files
+	}
+
+	// Start and stop watching files silently as they're opened and closed.
+	for path := range added {
+		if _, found := w.files[path]; !found {
+			w.setFile(path, fileList[path])
+		}
+	}
+	for path := range previous {
+		if _, listed := fileList[path]; !listed {
+			w.deleteFile(path)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// +build go1.16
+
+package watcher
+
+import "os"
+
+// readDirTypes lists the entries of the directory path with only their
+// names and types, which most platforms return without statting each entry.
+func readDirTypes(path string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, len(entries))
+	for i, entry := range entries {
+		infos[i] = &presenceInfo{name: entry.Name(), mode: entry.Type()}
+	}
+	return infos, nil
+}
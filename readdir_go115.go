@@ -0,0 +1,24 @@
+// +build !go1.16
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// readDirTypes lists the entries of the directory path with only their
+// names and types. Before Go 1.16 the entries have to be statted to find
+// their types.
+func readDirTypes(path string) ([]os.FileInfo, error) {
+	list, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, len(list))
+	for i, info := range list {
+		infos[i] = &presenceInfo{name: info.Name(), mode: info.Mode() & os.ModeType}
+	}
+	return infos, nil
+}
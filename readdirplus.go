@@ -0,0 +1,113 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ReadDirPlusBackend is a Backend that can list a whole directory tree
+// along with every entry's FileInfo in a single round trip, such as a
+// client for a network filesystem that supports NFS's READDIRPLUS.
+type ReadDirPlusBackend interface {
+	Backend
+
+	// ReadDirPlus returns the FileInfo for root and for every file and
+	// directory below it, by path, without following symlinks.
+	ReadDirPlus(root string) (map[string]os.FileInfo, error)
+}
+
+// SetReadDirPlus sets whether directories added with AddRecursive are
+// listed with a single call to the backend's ReadDirPlus method each scan,
+// instead of a call to ReadDir for every directory in the tree, which saves
+// round trips on a network filesystem. The whole tree is listed, including
+// ignored directories, and then filtered like usual.
+//
+// SetReadDirPlus has no effect unless the backend set with SetBackend
+// implements ReadDirPlusBackend. If ReadDirPlus returns an error, the tree
+// is listed directory by directory instead, so that errors are reported for
+// the paths that caused them.
+func (w *Watcher) SetReadDirPlus(enabled bool) {
+	w.mu.Lock()
+	w.readDirPlus = enabled
+	w.mu.Unlock()
+}
+
+// readDirPlus lists the tree at root with backend's ReadDirPlus method,
+// keeping to the scan timeout if one is set. It returns false if backend
+// doesn't implement ReadDirPlusBackend.
+func readDirPlus(backend Backend, root string) (map[string]os.FileInfo, bool, error) {
+	switch b := backend.(type) {
+	case ReadDirPlusBackend:
+		infos, err := b.ReadDirPlus(root)
+		return infos, true, err
+	case *modTimeBackend:
+		// The tree is listed in one round trip anyway.
+		return readDirPlus(b.Backend, root)
+	case *timeoutBackend:
+		inner := b.Backend
+		if fast, ok := inner.(*modTimeBackend); ok {
+			inner = fast.Backend
+		}
+		plus, ok := inner.(ReadDirPlusBackend)
+		if !ok {
+			return nil, false, nil
+		}
+		var infos map[string]os.FileInfo
+		var err error
+		if terr := b.do(func() { infos, err = plus.ReadDirPlus(root) }); terr != nil {
+			return nil, true, terr
+		}
+		return infos, true, err
+	}
+	return nil, false, nil
+}
+
+// plusBackend is a Backend that answers Lstat and ReadDir for a tree listed
+// with ReadDirPlus from memory, and passes everything else on to the
+// backend it wraps.
+type plusBackend struct {
+	Backend
+	infos map[string]os.FileInfo   // every listed path's info.
+	dirs  map[string][]os.FileInfo // the entries of every listed directory.
+}
+
+// newPlusBackend returns a plusBackend for the tree at root, or nil if the
+// tree can't be listed with ReadDirPlus.
+func newPlusBackend(backend Backend, root string) *plusBackend {
+	infos, ok, err := readDirPlus(backend, root)
+	if !ok || err != nil {
+		return nil
+	}
+
+	b := &plusBackend{
+		Backend: backend,
+		infos:   infos,
+		dirs:    make(map[string][]os.FileInfo),
+	}
+	for path, info := range infos {
+		if info.IsDir() {
+			if _, found := b.dirs[path]; !found {
+				b.dirs[path] = nil
+			}
+		}
+		if path != root {
+			dir := filepath.Dir(path)
+			b.dirs[dir] = append(b.dirs[dir], info)
+		}
+	}
+	return b
+}
+
+func (b *plusBackend) Lstat(path string) (os.FileInfo, error) {
+	if info, found := b.infos[path]; found {
+		return info, nil
+	}
+	return b.Backend.Lstat(path)
+}
+
+func (b *plusBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	if infos, found := b.dirs[path]; found {
+		return append([]os.FileInfo(nil), infos...), nil
+	}
+	return b.Backend.ReadDir(path)
+}
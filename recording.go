@@ -0,0 +1,289 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// A record is a line of a recording made with StartRecording.
+type record struct {
+	// Type is "start" for the first record, which holds the watched roots
+	// and files when the recording started, "scan" for the files listed
+	// by a scan, or "event" for an event that was sent.
+	Type  string          `json:"type"`
+	Roots map[string]bool `json:"roots,omitempty"`
+	Files []recordedFile  `json:"files,omitempty"`
+	Event json.RawMessage `json:"event,omitempty"`
+}
+
+// A recordedFile is the FileInfo of a listed file in a recording.
+type recordedFile struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Ino     uint64      `json:"ino,omitempty"`
+	Dev     uint64      `json:"dev,omitempty"`
+}
+
+// recordedSys is the Sys value of a replayed file, so that renames can
+// still be detected.
+type recordedSys struct {
+	ino, dev uint64
+}
+
+// sameRecordedFile reports whether fi1 and fi2 are the same replayed file.
+// ok is false unless both are replayed files with inode numbers.
+func sameRecordedFile(fi1, fi2 os.FileInfo) (same, ok bool) {
+	sys1, ok1 := fi1.Sys().(*recordedSys)
+	sys2, ok2 := fi2.Sys().(*recordedSys)
+	if !ok1 || !ok2 || sys1.ino == 0 || sys2.ino == 0 {
+		return false, false
+	}
+	return *sys1 == *sys2, true
+}
+
+// StartRecording starts recording the watching process to out, such as to
+// attach a reproduction of an issue to a bug report. The watched roots and
+// files are recorded first, followed by the files listed by every scan and
+// every event sent on the Event channel, each as a line of JSON. The events
+// sent in each cycle are recorded at the end of the cycle, sorted by path,
+// so that they're in the same order as when they're replayed. The
+// recording can be played back with Replay. Recording stops at the first
+// error writing to out, which is returned by StopRecording.
+func (w *Watcher) StartRecording(out io.Writer) error {
+	w.mu.Lock()
+	start := record{Type: "start", Roots: make(map[string]bool)}
+	for name, recursive := range w.names {
+		start.Roots[name] = recursive
+	}
+	start.Files = recordFiles(w.files)
+	w.mu.Unlock()
+
+	enc := json.NewEncoder(out)
+	if err := enc.Encode(start); err != nil {
+		return err
+	}
+
+	w.recMu.Lock()
+	w.recorder, w.recErr, w.recEvents = enc, nil, nil
+	w.recMu.Unlock()
+
+	return nil
+}
+
+// StopRecording stops a recording started with StartRecording and returns
+// the first error that occurred writing it, if any.
+func (w *Watcher) StopRecording() error {
+	w.recMu.Lock()
+	defer w.recMu.Unlock()
+
+	w.recordEvents()
+	err := w.recErr
+	w.recorder, w.recErr, w.recEvents = nil, nil, nil
+	return err
+}
+
+// record writes rec to the recording, if there is one. The caller must
+// hold w.recMu.
+func (w *Watcher) record(rec record) {
+	if w.recorder == nil {
+		return
+	}
+	if err := w.recorder.Encode(rec); err != nil {
+		w.recorder, w.recErr = nil, err
+	}
+}
+
+// recordScan records the events sent since the last scan, followed by the
+// files listed by a scan.
+func (w *Watcher) recordScan(fileList map[string]os.FileInfo) {
+	w.recMu.Lock()
+	defer w.recMu.Unlock()
+
+	if w.recorder == nil {
+		return
+	}
+	w.recordEvents()
+	w.record(record{Type: "scan", Files: recordFiles(fileList)})
+}
+
+// recordEvent holds an event that was sent, to record it with the rest of
+// the cycle's events.
+func (w *Watcher) recordEvent(e Event) {
+	w.recMu.Lock()
+	defer w.recMu.Unlock()
+
+	if w.recorder != nil {
+		w.recEvents = append(w.recEvents, e)
+	}
+}
+
+// recordEvents records the events held since the last scan, sorted by
+// path. The caller must hold w.recMu.
+func (w *Watcher) recordEvents() {
+	sort.Sort(byEventPath(w.recEvents))
+	for _, e := range w.recEvents {
+		data, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		w.record(record{Type: "event", Event: data})
+	}
+	w.recEvents = nil
+}
+
+// recordFiles returns files as recordedFiles sorted by path.
+func recordFiles(files map[string]os.FileInfo) []recordedFile {
+	recorded := make([]recordedFile, 0, len(files))
+	for path, info := range files {
+		rf := recordedFile{
+			Path:    path,
+			Size:    info.Size(),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+		rf.Ino, rf.Dev, _ = inodeOf(info)
+		if sys, ok := info.Sys().(*recordedSys); ok {
+			rf.Ino, rf.Dev = sys.ino, sys.dev
+		}
+		recorded = append(recorded, rf)
+	}
+	sort.Sort(byRecordedPath(recorded))
+	return recorded
+}
+
+// replayFiles returns the file list for recorded files.
+func replayFiles(recorded []recordedFile) map[string]os.FileInfo {
+	files := make(map[string]os.FileInfo)
+	for _, rf := range recorded {
+		files[rf.Path] = &fileInfo{
+			name:    filepath.Base(rf.Path),
+			size:    rf.Size,
+			mode:    rf.Mode,
+			modTime: rf.ModTime,
+			sys:     &recordedSys{ino: rf.Ino, dev: rf.Dev},
+			dir:     rf.Mode.IsDir(),
+		}
+	}
+	return files
+}
+
+// Replay plays back a recording made with StartRecording, without accessing
+// the filesystem. The files listed by each recorded scan are compared to the
+// previous scan in the same way as a running watcher does, and the events
+// for the changes that pass the watcher's filters are sent on the returned
+// channel, sorted by path within each scan. The channel is closed at the
+// end of the recording. Summary events, debouncing, SetMaxEvents and
+// SetLockMonitoring aren't applied. The recorded events are ignored, since
+// they're found again.
+//
+// w should be a new watcher set up with the same options as the recorded
+// watcher. Its watched roots and files are replaced by the recorded ones, so
+// Replay returns ErrWatcherRunning if w is running. w counts as running
+// until the replay is over, so Start returns ErrWatcherRunning in the
+// meantime, and Close stops the replay early, closing the channel, in the
+// same way as it stops a started watcher.
+func (w *Watcher) Replay(r io.Reader) (<-chan Event, error) {
+	dec := json.NewDecoder(r)
+
+	var start record
+	if err := dec.Decode(&start); err != nil {
+		return nil, err
+	}
+	if start.Type != "start" {
+		return nil, fmt.Errorf("error: recording starts with a %q record", start.Type)
+	}
+
+	var scans []map[string]os.FileInfo
+	for {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec.Type == "scan" {
+			scans = append(scans, replayFiles(rec.Files))
+		}
+	}
+
+	w.mu.Lock()
+	if w.running {
+		w.mu.Unlock()
+		return nil, ErrWatcherRunning
+	}
+	w.running = true
+	w.names = start.Roots
+	w.replaceFiles(replayFiles(start.Files))
+	w.mu.Unlock()
+
+	// The replay isn't started with spawn, since like Start it shuts the
+	// watcher down when it's closed, which waits for w.workers.
+	events := make(chan Event)
+	atomic.AddInt64(&w.goroutines, 1)
+	go func() {
+		defer close(events)
+		defer atomic.AddInt64(&w.goroutines, -1)
+		for _, scan := range scans {
+			select {
+			case <-w.close:
+				w.shutdown()
+				return
+			default:
+			}
+
+			// Nobody receives from the Error channel during a replay,
+			// and since locks aren't polled, nothing is reported anyway.
+			cycle := w.applyScan(scan, func(error) {}, false)
+			sort.Sort(byEventPath(cycle))
+			for _, e := range cycle {
+				select {
+				case events <- e:
+				case <-w.close:
+					w.shutdown()
+					return
+				}
+			}
+		}
+
+		// If Close was called as the replay finished, it's waiting to
+		// send the close signal.
+		w.mu.Lock()
+		closing := !w.running
+		w.running = false
+		w.mu.Unlock()
+		if closing {
+			<-w.close
+			w.shutdown()
+		}
+	}()
+	return events, nil
+}
+
+// byEventPath sorts a slice of Event by path, then by op.
+type byEventPath []Event
+
+func (e byEventPath) Len() int      { return len(e) }
+func (e byEventPath) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byEventPath) Less(i, j int) bool {
+	if e[i].Path != e[j].Path {
+		return e[i].Path < e[j].Path
+	}
+	return e[i].Op < e[j].Op
+}
+
+// byRecordedPath sorts a slice of recordedFile by path.
+type byRecordedPath []recordedFile
+
+func (r byRecordedPath) Len() int           { return len(r) }
+func (r byRecordedPath) Less(i, j int) bool { return r[i].Path < r[j].Path }
+func (r byRecordedPath) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -5,5 +5,16 @@ package watcher
 import "os"
 
 func sameFile(fi1, fi2 os.FileInfo) bool {
+	if same, ok := sameRecordedFile(fi1, fi2); ok {
+		return same
+	}
+	// Compare the stat results directly, since os.SameFile only
+	// handles FileInfo returned by the os package, not the FileInfo
+	// listed with SetDirFDCaching.
+	ino1, dev1, ok1 := inodeOf(fi1)
+	ino2, dev2, ok2 := inodeOf(fi2)
+	if ok1 && ok2 {
+		return dev1 == dev2 && ino1 == ino2
+	}
 	return os.SameFile(fi1, fi2)
 }
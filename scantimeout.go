@@ -0,0 +1,112 @@
+package watcher
+
+import (
+	"os"
+	"time"
+)
+
+// SetScanTimeout sets a hard timeout for each of the watcher's scans. If
+// listing the watched files takes longer than d, such as when a network
+// mount stops responding, the scan is abandoned, its partial results are
+// discarded, ErrScanTimeout is sent on the Error channel and the watcher
+// moves on to the next cycle. A d of 0 disables the timeout, which is the
+// default.
+//
+// A call to the filesystem that hangs can't be interrupted, so it is left
+// running in the background while the watcher carries on. While a timeout
+// is set, each scan makes its calls to the filesystem from one extra
+// goroutine. A call that was abandoned isn't waited for by Close and may
+// still be running after Done is closed.
+func (w *Watcher) SetScanTimeout(d time.Duration) {
+	w.mu.Lock()
+	w.scanTimeout = d
+	w.mu.Unlock()
+}
+
+// timeoutBackend is a Backend whose calls fail with ErrScanTimeout once the
+// scan's timeout has passed, even if the underlying call hasn't returned.
+// The calls are made one at a time by a single goroutine, so that only the
+// call that's blocked when the timeout passes is abandoned.
+type timeoutBackend struct {
+	Backend
+	timer    *time.Timer
+	calls    chan func()
+	done     chan struct{}
+	timedOut bool
+}
+
+// newTimeoutBackend returns a timeoutBackend for backend that times out
+// after d. It must be stopped once the scan is over.
+func newTimeoutBackend(backend Backend, d time.Duration) *timeoutBackend {
+	b := &timeoutBackend{
+		Backend: backend,
+		timer:   time.NewTimer(d),
+		calls:   make(chan func()),
+		// Buffered, so that an abandoned call can still finish.
+		done: make(chan struct{}, 1),
+	}
+	go func() {
+		for fn := range b.calls {
+			fn()
+			b.done <- struct{}{}
+		}
+	}()
+	return b
+}
+
+// stop stops the timer and the goroutine that makes the calls, once any
+// abandoned call has returned.
+func (b *timeoutBackend) stop() {
+	b.timer.Stop()
+	close(b.calls)
+}
+
+// do calls fn, or returns ErrScanTimeout if it doesn't return before the
+// timeout.
+func (b *timeoutBackend) do(fn func()) error {
+	if b.timedOut {
+		return ErrScanTimeout
+	}
+
+	select {
+	case <-b.timer.C:
+		b.timedOut = true
+		return ErrScanTimeout
+	case b.calls <- fn:
+	}
+
+	select {
+	case <-b.done:
+		return nil
+	case <-b.timer.C:
+		b.timedOut = true
+		return ErrScanTimeout
+	}
+}
+
+func (b *timeoutBackend) Stat(path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	var err error
+	if terr := b.do(func() { info, err = b.Backend.Stat(path) }); terr != nil {
+		return nil, terr
+	}
+	return info, err
+}
+
+func (b *timeoutBackend) Lstat(path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	var err error
+	if terr := b.do(func() { info, err = b.Backend.Lstat(path) }); terr != nil {
+		return nil, terr
+	}
+	return info, err
+}
+
+func (b *timeoutBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	var err error
+	if terr := b.do(func() { infos, err = b.Backend.ReadDir(path) }); terr != nil {
+		return nil, terr
+	}
+	return infos, err
+}
@@ -0,0 +1,67 @@
+// Package sftpbackend lets a watcher.Watcher watch a directory on a remote
+// host over SFTP, using a client from github.com/pkg/sftp.
+//
+// It's kept out of the watcher package so that the watcher package doesn't
+// depend on github.com/pkg/sftp.
+package sftpbackend
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"github.com/radovskyb/watcher"
+)
+
+// An *sftp.Client has the methods of a watcher.Backend itself, but Backend
+// wraps it to turn the watcher's paths into remote ones.
+var _ watcher.Backend = (*sftp.Client)(nil)
+
+var _ watcher.Backend = (*Backend)(nil)
+
+// Backend is a watcher.Backend that lists files on a remote host with an
+// SFTP client.
+type Backend struct {
+	client *sftp.Client
+}
+
+// New returns a Backend that lists files with client.
+func New(client *sftp.Client) *Backend {
+	return &Backend{client: client}
+}
+
+// WithSFTPBackend sets w to list files on the remote host that client is
+// connected to, so that the files of a remote directory are watched in the
+// same way as local ones. Relative paths passed to w are joined to root,
+// which should be an absolute path on the remote host.
+//
+// WithSFTPBackend should be called before any files are added to w.
+func WithSFTPBackend(w *watcher.Watcher, client *sftp.Client, root string) {
+	w.SetBackend(New(client), remotePath(root))
+}
+
+// remotePath returns name as a path on the remote host. The watcher joins
+// paths with filepath, so on Windows their separators are backslashes,
+// while SFTP paths are always separated by forward slashes.
+func remotePath(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// Stat returns the FileInfo for name on the remote host, following
+// symlinks.
+func (b *Backend) Stat(name string) (os.FileInfo, error) {
+	return b.client.Stat(remotePath(name))
+}
+
+// Lstat returns the FileInfo for name on the remote host without following
+// symlinks.
+func (b *Backend) Lstat(name string) (os.FileInfo, error) {
+	return b.client.Lstat(remotePath(name))
+}
+
+// ReadDir returns the FileInfo for each of the entries in the directory
+// name on the remote host.
+func (b *Backend) ReadDir(name string) ([]os.FileInfo, error) {
+	return b.client.ReadDir(remotePath(name))
+}
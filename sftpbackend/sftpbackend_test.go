@@ -0,0 +1,138 @@
+package sftpbackend
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/radovskyb/watcher"
+)
+
+// newClient returns a client connected to an in-process SFTP server for the
+// local filesystem.
+func newClient(t *testing.T) (*sftp.Client, func()) {
+	serverConn, clientConn := net.Pipe()
+
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, func() {
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestWithSFTPBackend(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "sftpbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	dir := filepath.Join(testDir, "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file.txt")
+	if err := ioutil.WriteFile(file, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	client, teardown := newClient(t)
+	defer teardown()
+
+	w := watcher.New()
+	WithSFTPBackend(w, client, testDir)
+	w.FilterOps(watcher.Create, watcher.Write, watcher.Remove)
+
+	// Relative paths are joined to the remote root.
+	if err := w.AddRecursive("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := w.WatchedFiles()[file]; !found {
+		t.Fatalf("expected %s to be watched, got %v", file, w.WatchedFiles())
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 100); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer w.Close()
+
+	w.Wait()
+
+	newFile := filepath.Join(dir, "new.txt")
+
+	// SFTP mod times only have a resolution of a second, so the written
+	// file's mod time is moved on by an hour to be sure it changes.
+	write := func() error {
+		if err := ioutil.WriteFile(file, []byte("hello"), 0755); err != nil {
+			return err
+		}
+		modTime := time.Now().Add(time.Hour)
+		return os.Chtimes(file, modTime, modTime)
+	}
+
+	testCases := []struct {
+		change func() error
+		op     watcher.Op
+		path   string
+	}{
+		{func() error { return ioutil.WriteFile(newFile, []byte{}, 0755) }, watcher.Create, newFile},
+		{write, watcher.Write, file},
+		{func() error { return os.Remove(newFile) }, watcher.Remove, newFile},
+	}
+
+	for _, tc := range testCases {
+		if err := tc.change(); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case event := <-w.Event:
+			if event.Op != tc.op {
+				t.Errorf("expected event to be %s, got %s", tc.op, event.Op)
+			}
+			if event.Path != tc.path {
+				t.Errorf("expected event.Path to be %s, got %s", tc.path, event.Path)
+			}
+		case err := <-w.Error:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatalf("received no %s event", tc.op)
+		}
+	}
+}
+
+func TestRemotePath(t *testing.T) {
+	testCases := []struct {
+		name, expected string
+		windows        bool // only on Windows, where backslashes are separators.
+	}{
+		{"/remote/dir", "/remote/dir", false},
+		{"/remote/dir/", "/remote/dir", false},
+		{`\remote\dir\file.txt`, "/remote/dir/file.txt", true},
+	}
+
+	for _, tc := range testCases {
+		if tc.windows && filepath.Separator != '\\' {
+			continue
+		}
+		if got := remotePath(tc.name); got != tc.expected {
+			t.Errorf("expected remotePath(%q) to be %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
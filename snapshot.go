@@ -0,0 +1,78 @@
+package watcher
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SnapshotTar writes the current contents of every watched regular file to
+// out as a tar archive. Only the files that the watcher is watching right
+// now are included, so ignored and filtered files are left out. Entry names
+// are relative to the watched file or directory that each file belongs to,
+// prefixed with that root's base name. Files that are removed before they
+// can be read are skipped.
+func (w *Watcher) SnapshotTar(out io.Writer) error {
+	w.mu.Lock()
+	paths := make(map[string]string) // paths by entry name.
+	var names []string
+	for path, info := range w.files {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		root := w.rootOf(path)
+		name := filepath.Base(path)
+		if root != "" && root != path {
+			rel, err := filepath.Rel(root, path)
+			if err == nil {
+				name = filepath.Join(filepath.Base(root), rel)
+			}
+		}
+		name = filepath.ToSlash(name)
+		paths[name] = path
+		names = append(names, name)
+	}
+	w.mu.Unlock()
+
+	sort.Strings(names)
+
+	tw := tar.NewWriter(out)
+	for _, name := range names {
+		if err := writeTarFile(tw, paths[name], name); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeTarFile writes the file at path to tw as name.
+func writeTarFile(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Stat the open file so the header matches what's read.
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, info.Size())
+	return err
+}
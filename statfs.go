@@ -0,0 +1,17 @@
+// +build linux darwin freebsd
+
+package watcher
+
+import "syscall"
+
+// inodeMonitoringSupported is whether freeInodes can count free inodes.
+const inodeMonitoringSupported = true
+
+// freeInodes is a variable so tests can mock the filesystem's inode counts.
+var freeInodes = func(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Ffree), nil
+}
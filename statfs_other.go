@@ -0,0 +1,11 @@
+// +build !linux,!darwin,!freebsd
+
+package watcher
+
+// inodeMonitoringSupported is whether freeInodes can count free inodes.
+const inodeMonitoringSupported = false
+
+// freeInodes is a variable so tests can mock the filesystem's inode counts.
+var freeInodes = func(path string) (uint64, error) {
+	return 0, ErrInodeMonitoringUnsupported
+}
@@ -0,0 +1,84 @@
+package watcher
+
+import "sync"
+
+// subscriber receives every event read from the Event channel by fanOut.
+type subscriber struct {
+	// deliver is called in the fan-out goroutine for each event. It
+	// should give up once done or w.stop is closed.
+	deliver func(e Event, done <-chan struct{})
+
+	// close is called in the fan-out goroutine once the subscription
+	// has been canceled or the watcher has closed.
+	close func()
+
+	done chan struct{} // closed when the subscription is canceled.
+}
+
+// subscribe adds a subscriber and starts the fan-out goroutine if it isn't
+// already running. It returns a function that cancels the subscription.
+func (w *Watcher) subscribe(deliver func(Event, <-chan struct{}), closeFn func()) func() {
+	s := &subscriber{deliver: deliver, close: closeFn, done: make(chan struct{})}
+
+	w.subsMu.Lock()
+	w.subs = append(w.subs, s)
+	if !w.fanning {
+		w.fanning = true
+		w.spawn(w.fanOut)
+	}
+	w.subsMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(s.done)
+			select {
+			case w.subsChanged <- struct{}{}:
+			default:
+			}
+		})
+	}
+}
+
+// fanOut reads events from the Event channel and delivers them to every
+// subscriber, until there are no subscribers left or the watcher closes.
+func (w *Watcher) fanOut() {
+	for {
+		w.subsMu.Lock()
+		subs := w.subs[:0]
+		for _, s := range w.subs {
+			select {
+			case <-s.done:
+				s.close()
+			default:
+				subs = append(subs, s)
+			}
+		}
+		w.subs = subs
+		if len(subs) == 0 {
+			// Leave the Event channel to be read directly again.
+			w.fanning = false
+			w.subsMu.Unlock()
+			return
+		}
+		current := append([]*subscriber(nil), subs...)
+		w.subsMu.Unlock()
+
+		select {
+		case e := <-w.Event:
+			for _, s := range current {
+				s.deliver(e, s.done)
+			}
+		case <-w.subsChanged:
+		case <-w.stop:
+			w.subsMu.Lock()
+			for _, s := range w.subs {
+				s.close()
+			}
+			w.subs = nil
+			w.fanning = false
+			w.subsMu.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// +build go1.18
+
+package watcher
+
+// SubscribeAs returns a channel that receives every event sent by w, after
+// it has been passed to transform, such as to receive domain specific
+// values instead of Events. transform is called in the goroutine that
+// fans the events out to every subscriber, so a slow transform or reader
+// holds up the other subscribers. The returned function cancels the
+// subscription, after which the channel is closed. The channel is also
+// closed once the watcher has closed. A transform that panics is reported
+// as a warning wrapping a *HookPanicError, and the event is skipped for the
+// subscription.
+//
+// While there are any subscribers, the events are read from the Event
+// channel for them, so the Event channel shouldn't be read as well.
+func SubscribeAs[T any](w *Watcher, transform func(Event) T) (<-chan T, func()) {
+	ch := make(chan T)
+	cancel := w.subscribe(func(e Event, done <-chan struct{}) {
+		v, err := callTransform(transform, e)
+		if err != nil {
+			select {
+			case w.warnings() <- &WatcherError{Warning, e.Path, err}:
+			case <-done:
+			case <-w.stop:
+			}
+			return
+		}
+		select {
+		case ch <- v:
+		case <-done:
+		case <-w.stop:
+		}
+	}, func() {
+		close(ch)
+	})
+	return ch, cancel
+}
+
+// callTransform calls the SubscribeAs transform with e, returning a
+// *HookPanicError if it panics.
+func callTransform[T any](transform func(Event) T, e Event) (v T, err error) {
+	defer recoverHook(&err)
+
+	return transform(e), nil
+}
@@ -0,0 +1,138 @@
+// +build go1.18
+
+package watcher
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fileCreated struct {
+	Name string
+}
+
+func TestSubscribeAs(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	created, cancel := SubscribeAs(w, func(e Event) fileCreated {
+		return fileCreated{Name: e.Name()}
+	})
+	names, cancelNames := SubscribeAs(w, func(e Event) string {
+		return e.Name()
+	})
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	if err := ioutil.WriteFile(filepath.Join(testDir, "new.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case fc := <-created:
+		if fc != (fileCreated{Name: "new.txt"}) {
+			t.Errorf("expected fileCreated{new.txt}, got %v", fc)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no typed event")
+	}
+
+	// Every subscriber receives every event.
+	select {
+	case name := <-names:
+		if name != "new.txt" {
+			t.Errorf("expected name to be new.txt, got %s", name)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no typed event")
+	}
+
+	// Canceling a subscription closes its channel.
+	cancel()
+	select {
+	case _, ok := <-created:
+		if ok {
+			t.Error("expected the channel to be closed")
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("expected the channel to be closed")
+	}
+
+	// Closing the watcher closes the remaining channels.
+	defer cancelNames()
+	w.Close()
+	select {
+	case _, ok := <-names:
+		if ok {
+			t.Error("expected the channel to be closed")
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("expected the channel to be closed")
+	}
+}
+
+func TestSubscribeAsPanic(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first transform panics for every event, which mustn't stop the
+	// second one from receiving them.
+	_, cancelPanics := SubscribeAs(w, func(e Event) string {
+		panic("bad transform")
+	})
+	defer cancelPanics()
+	names, cancelNames := SubscribeAs(w, func(e Event) string {
+		return e.Name()
+	})
+	defer cancelNames()
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	if err := ioutil.WriteFile(filepath.Join(testDir, "new.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-w.Error:
+		werr, ok := err.(*WatcherError)
+		if !ok || werr.Severity != Warning {
+			t.Fatalf("expected a warning, got %v", err)
+		}
+		if perr, ok := werr.Err.(*HookPanicError); !ok || perr.Value != "bad transform" {
+			t.Errorf("expected a *HookPanicError for the panic, got %v", werr.Err)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no warning for the panic")
+	}
+
+	select {
+	case name := <-names:
+		if name != "new.txt" {
+			t.Errorf("expected name to be new.txt, got %s", name)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no typed event")
+	}
+}
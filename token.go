@@ -0,0 +1,168 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxChangeLog is the least number of the most recent changes to the watched
+// files that are kept for ChangesSince. The log is trimmed back to this many
+// once it holds twice as many.
+const maxChangeLog = 10000
+
+// epochs is the number of token epochs created by newTokenEpoch.
+var epochs uint64
+
+// newTokenEpoch returns a prefix for a new watcher's tokens that's unique
+// within the process, and across restarts of it, so that a token can't be
+// mistaken for another watcher's.
+func newTokenEpoch() string {
+	return fmt.Sprintf("%x.%x", time.Now().UnixNano(), atomic.AddUint64(&epochs, 1))
+}
+
+// A Token identifies the state of a watcher's files when it was returned by
+// SnapshotToken or ChangesSince. It's opaque, but can be stored as a string
+// by a client that pulls changes from the watcher.
+type Token string
+
+// A fileChange is an entry in the change log kept for ChangesSince.
+type fileChange struct {
+	path string
+	old  os.FileInfo // the file before the change, or nil if it was added.
+}
+
+// SnapshotToken returns a Token for the watcher's files as of its last scan,
+// which can later be passed to ChangesSince to get the changes made since.
+// A token is the generation of the watched files, which counts the changes
+// made to them, so it holds no state of its own and any number of clients
+// can hold tokens at once.
+func (w *Watcher) SnapshotToken() Token {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.snapshotToken()
+}
+
+// ChangesSince returns the events that would transform the watched files at
+// the time tok was returned into the watched files as of the last scan, in
+// the same order as Diff, along with a new Token for the current state.
+// Renames aren't detected, and the events aren't filtered. The changes are
+// replayed from a log of at least the 10000 most recent changes to the
+// watched files, so it returns ErrUnknownToken if more changes than are
+// logged have been made since tok, or if tok wasn't returned by the watcher.
+func (w *Watcher) ChangesSince(tok Token) ([]Event, Token, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	gen, ok := w.tokenGeneration(tok)
+	if !ok || gen < w.logBase || gen > w.tokenGen {
+		return nil, "", ErrUnknownToken
+	}
+
+	// The first logged change to each path after gen holds the path's
+	// state at gen.
+	source := make(map[string]os.FileInfo)
+	current := make(map[string]os.FileInfo)
+	seen := make(map[string]bool)
+	for _, c := range w.changeLog[gen-w.logBase:] {
+		if seen[c.path] {
+			continue
+		}
+		seen[c.path] = true
+		if c.old != nil {
+			source[c.path] = c.old
+		}
+		if info, found := w.files[c.path]; found {
+			current[c.path] = info
+		}
+	}
+	return w.diffStates(source, current), w.snapshotToken(), nil
+}
+
+// snapshotToken returns the Token for the current generation of the watched
+// files, and starts logging changes to them if it hasn't already. The caller
+// must hold w.mu.
+func (w *Watcher) snapshotToken() Token {
+	w.tokensUsed = true
+	return Token(fmt.Sprintf("%s.%d", w.tokenEpoch, w.tokenGen))
+}
+
+// tokenGeneration returns the generation of tok, and false if tok wasn't
+// returned by the watcher.
+func (w *Watcher) tokenGeneration(tok Token) (uint64, bool) {
+	prefix := w.tokenEpoch + "."
+	if !strings.HasPrefix(string(tok), prefix) {
+		return 0, false
+	}
+	gen, err := strconv.ParseUint(strings.TrimPrefix(string(tok), prefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return gen, true
+}
+
+// logChange adds a change to path, which was old before it, to the change
+// log once tokens are in use. The caller must hold w.mu.
+func (w *Watcher) logChange(path string, old os.FileInfo) {
+	if !w.tokensUsed {
+		return
+	}
+	w.tokenGen++
+	w.changeLog = append(w.changeLog, fileChange{path: path, old: old})
+
+	// Copy the kept changes to a new slice so that the trimmed ones can be
+	// garbage collected.
+	if len(w.changeLog) >= 2*maxChangeLog {
+		trimmed := len(w.changeLog) - maxChangeLog
+		w.changeLog = append([]fileChange(nil), w.changeLog[trimmed:]...)
+		w.logBase += uint64(trimmed)
+	}
+}
+
+// setFile sets the watched file path to info, logging the change. The
+// caller must hold w.mu.
+func (w *Watcher) setFile(path string, info os.FileInfo) {
+	old, found := w.files[path]
+	if !found || !sameFileInfo(old, info) {
+		w.logChange(path, old)
+	}
+	w.files[path] = info
+}
+
+// deleteFile stops watching the file path, logging the change. The caller
+// must hold w.mu.
+func (w *Watcher) deleteFile(path string) {
+	if old, found := w.files[path]; found {
+		w.logChange(path, old)
+		delete(w.files, path)
+	}
+}
+
+// replaceFiles makes fileList the watched files, logging the changes from
+// the current ones. The caller must hold w.mu.
+func (w *Watcher) replaceFiles(fileList map[string]os.FileInfo) {
+	if w.tokensUsed {
+		for path, old := range w.files {
+			info, found := fileList[path]
+			if !found || !sameFileInfo(old, info) {
+				w.logChange(path, old)
+			}
+		}
+		for path := range fileList {
+			if _, found := w.files[path]; !found {
+				w.logChange(path, nil)
+			}
+		}
+	}
+	w.files = fileList
+}
+
+// sameFileInfo reports whether a and b have the same mod time, size and
+// mode, the fields that ChangesSince compares.
+func sameFileInfo(a, b os.FileInfo) bool {
+	return a.ModTime() == b.ModTime() && a.Size() == b.Size() && a.Mode() == b.Mode()
+}
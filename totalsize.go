@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// totalSize holds the state of a root watched with WatchTotalSize.
+type totalSize struct {
+	threshold int64
+	above     bool
+}
+
+// WatchTotalSize sends a TotalSizeAbove event when the total size of the
+// watched files in root, and in every directory below it, exceeds threshold
+// bytes, and a TotalSizeBelow event when it drops back to threshold or
+// below, such as for enforcing a quota. The total is added up from the
+// files found by each scan, so it doesn't cost any extra reads, and only
+// counts the files that are watched. The root's total when WatchTotalSize
+// is called is its starting state, so a root that's already above the
+// threshold only sends an event once it drops below it.
+func (w *Watcher) WatchTotalSize(root string, threshold int64) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	root, err = w.abs(root)
+	if err != nil {
+		return err
+	}
+
+	w.totalSizes[root] = &totalSize{
+		threshold: threshold,
+		above:     sumSizes(w.files, root) > threshold,
+	}
+
+	return nil
+}
+
+// sumSizes returns the total size of the regular files in files that are
+// root or below it.
+func sumSizes(files map[string]os.FileInfo, root string) int64 {
+	prefix := root
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+
+	var total int64
+	for path, info := range files {
+		if (path == root || strings.HasPrefix(path, prefix)) && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+func (w *Watcher) pollTotalSizes(files map[string]os.FileInfo, send func(Event) bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for root, ts := range w.totalSizes {
+		info, found := files[root]
+		if !found {
+			continue
+		}
+
+		above := sumSizes(files, root) > ts.threshold
+		if above == ts.above {
+			continue
+		}
+		ts.above = above
+
+		e := w.newEvent(TotalSizeBelow, root, "", info)
+		if above {
+			e.Op = TotalSizeAbove
+		}
+
+		if !send(e) {
+			return
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package watcher
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +30,10 @@ var (
 	// from previously calling Start and not yet calling Close.
 	ErrWatcherRunning = errors.New("error: watcher is already running")
 
+	// ErrWatcherNotRunning occurs when trying to call the watcher's
+	// Close method when the watcher was never started or is already closed.
+	ErrWatcherNotRunning = errors.New("error: watcher is not running")
+
 	// ErrWatchedFileDeleted is an error that occurs when a file or folder that was
 	// being watched has been deleted.
 	ErrWatchedFileDeleted = errors.New("error: watched file or folder deleted")
@@ -29,8 +41,145 @@ var (
 	// ErrSkip is less of an error, but more of a way for path hooks to skip a file or
 	// directory.
 	ErrSkip = errors.New("error: skipping file")
+
+	// ErrDirUnreadable occurs when a watched directory can no longer be
+	// read, such as after its permissions are changed. Its last known
+	// contents are kept until it can be read again.
+	ErrDirUnreadable = errors.New("error: watched directory is unreadable")
+
+	// ErrNotManualTicks occurs when calling the watcher's Tick method
+	// without first enabling manual ticks with SetManualTicks.
+	ErrNotManualTicks = errors.New("error: manual ticks are not enabled")
+
+	// ErrNotWatched occurs when calling the watcher's Refresh, SuspendRoot
+	// or ResumeRoot methods with a path that isn't being watched.
+	ErrNotWatched = errors.New("error: file is not being watched")
+
+	// ErrHookPanic is wrapped by a HookPanicError when a filter hook or
+	// callback panics.
+	ErrHookPanic = errors.New("error: hook panicked")
+
+	// ErrScanTimeout occurs when a scan takes longer than the timeout set
+	// with SetScanTimeout. The scan's results are discarded.
+	ErrScanTimeout = errors.New("error: scan timed out")
+
+	// ErrMemoryBudget occurs when watching more files would exceed the
+	// memory budget set with SetMemoryBudget.
+	ErrMemoryBudget = errors.New("error: memory budget exceeded")
+
+	// ErrProcessFilesUnsupported occurs when AddProcessFiles is called on a
+	// platform other than Linux.
+	ErrProcessFilesUnsupported = errors.New("error: watching a process's files is only supported on linux")
+
+	// ErrLowInodes occurs when the number of free inodes on a watched root's
+	// filesystem drops below the threshold set with SetInodeMonitoring.
+	ErrLowInodes = errors.New("error: free inodes below threshold")
+
+	// ErrInodeMonitoringUnsupported occurs when SetInodeMonitoring is
+	// called on a platform other than Linux, macOS or FreeBSD.
+	ErrInodeMonitoringUnsupported = errors.New("error: inode monitoring is only supported on linux, darwin and freebsd")
+
+	// ErrUnknownToken occurs when ChangesSince is passed a token that the
+	// watcher didn't return, or that's too old to still be kept.
+	ErrUnknownToken = errors.New("error: unknown or expired snapshot token")
+
+	// ErrLockMonitoringUnsupported occurs when SetLockMonitoring is called
+	// on a platform other than Linux.
+	ErrLockMonitoringUnsupported = errors.New("error: lock monitoring is only supported on linux")
+
+	// ErrWebhookQueueFull occurs when events are dropped instead of being
+	// sent to the webhook set with SetWebhook, since too many events are
+	// already waiting to be sent.
+	ErrWebhookQueueFull = errors.New("error: webhook queue is full")
+)
+
+// A WalkError occurs when a single file or directory inside a watched
+// directory can't be listed during a scan. The rest of the directory is
+// still scanned, and the path keeps its last known info until it can be
+// listed again. It's sent as the Err of a Warning WatcherError.
+type WalkError struct {
+	Path string // the file or directory that couldn't be listed.
+	Err  error  // the underlying error.
+}
+
+func (e *WalkError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *WalkError) Unwrap() error {
+	return e.Err
+}
+
+// Severity describes how serious a WatcherError is.
+type Severity int
+
+// Severities
+const (
+	Info Severity = iota
+	Warning
+	Fatal
 )
 
+var severities = map[Severity]string{
+	Info:    "INFO",
+	Warning: "WARNING",
+	Fatal:   "FATAL",
+}
+
+// String prints the string version of the Severity consts
+func (s Severity) String() string {
+	if severity, found := severities[s]; found {
+		return severity
+	}
+	return "???"
+}
+
+// A WatcherError is sent on the Error channel whenever an error occurs
+// during the watching process. Its Severity lets consumers decide whether
+// to keep watching or abort. Warnings such as a single file failing to be
+// read are transient, while a Fatal error such as a watched root being
+// deleted means the watcher has stopped watching that root.
+//
+// Every error on the Error channel is a *WatcherError, so comparing one to a
+// sentinel such as ErrWatchedFileDeleted with == doesn't match. Use Is
+// instead.
+type WatcherError struct {
+	Severity Severity
+	Path     string // the watched root or file the error occurred for.
+	Err      error  // the underlying error.
+}
+
+func (e *WatcherError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *WatcherError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether err is target or wraps it, following the Unwrap methods
+// of errors such as *WatcherError and *WalkError, like errors.Is does from
+// Go 1.13 on. For example, Is(err, ErrWatchedFileDeleted) reports whether an
+// error from the Error channel is for a deleted root.
+func Is(err, target error) bool {
+	comparable := target == nil || reflect.TypeOf(target).Comparable()
+	for err != nil {
+		if comparable && err == target {
+			return true
+		}
+		wrapper, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			return false
+		}
+		err = wrapper.Unwrap()
+	}
+	return err == target
+}
+
 // An Op is a type that is used to describe what type
 // of event has occurred during the watching process.
 type Op uint32
@@ -43,15 +192,42 @@ const (
 	Rename
 	Chmod
 	Move
+	Summary
+	ChildCountAbove
+	ChildCountBelow
+	LinkCount
+	Filled
+	Emptied
+	Flapping
+	TotalSizeAbove
+	TotalSizeBelow
+	Locked
+	Unlocked
 )
 
 var ops = map[Op]string{
-	Create: "CREATE",
-	Write:  "WRITE",
-	Remove: "REMOVE",
-	Rename: "RENAME",
-	Chmod:  "CHMOD",
-	Move:   "MOVE",
+	Create:  "CREATE",
+	Write:   "WRITE",
+	Remove:  "REMOVE",
+	Rename:  "RENAME",
+	Chmod:   "CHMOD",
+	Move:    "MOVE",
+	Summary: "SUMMARY",
+
+	ChildCountAbove: "CHILD_COUNT_ABOVE",
+	ChildCountBelow: "CHILD_COUNT_BELOW",
+	LinkCount:       "LINK_COUNT",
+
+	Filled:  "FILLED",
+	Emptied: "EMPTIED",
+
+	Flapping: "FLAPPING",
+
+	TotalSizeAbove: "TOTAL_SIZE_ABOVE",
+	TotalSizeBelow: "TOTAL_SIZE_BELOW",
+
+	Locked:   "LOCKED",
+	Unlocked: "UNLOCKED",
 }
 
 // String prints the string version of the Op consts
@@ -62,6 +238,38 @@ func (e Op) String() string {
 	return "???"
 }
 
+// Source describes which kind of scan found an Event.
+type Source int
+
+// Sources
+const (
+	// SourceScan is a periodic scan.
+	SourceScan Source = iota
+	// SourceManual is a scan run by Tick.
+	SourceManual
+	// SourceInitial is the snapshot of the watched files sent when the
+	// watcher starts, with SetInitialEvents.
+	SourceInitial
+	// SourceTrigger is a scan started by the channel set with
+	// SetTriggerChannel.
+	SourceTrigger
+)
+
+var sources = map[Source]string{
+	SourceScan:    "SCAN",
+	SourceManual:  "MANUAL",
+	SourceInitial: "INITIAL",
+	SourceTrigger: "TRIGGER",
+}
+
+// String prints the string version of the Source consts
+func (s Source) String() string {
+	if source, found := sources[s]; found {
+		return source
+	}
+	return "???"
+}
+
 // An Event describes an event that is received when files or directory
 // changes occur. It includes the os.FileInfo of the changed file or
 // directory and the type of event that's occurred and the full path of the file.
@@ -69,7 +277,52 @@ type Event struct {
 	Op
 	Path    string
 	OldPath string
+
+	// FileInfo is the file's info from the scan that found the event.
+	// For a Remove event, it's the file's last known info from the last
+	// scan that saw it, including its size, mode and modification time,
+	// which is also the case for every file inside a removed directory.
 	os.FileInfo
+
+	// OldFileInfo is the file's info from the scan before the one that
+	// found a Write or Chmod event, such as to tell how much a file grew.
+	// It's nil for every other event.
+	OldFileInfo os.FileInfo
+
+	// Paths lists every path that changed during a watching cycle
+	// for Summary events.
+	Paths []string
+
+	// Root is the watched file or directory that Path belongs to, and
+	// Depth is how many levels below Root that Path is. Changes to Root
+	// itself have a depth of 0 and changes to its direct children have a
+	// depth of 1.
+	Root  string
+	Depth int
+
+	// DuplicateOf is the path of an already watched file with the same
+	// contents as a created, renamed or moved file, when fingerprints are
+	// enabled with SetEventFingerprints.
+	DuplicateOf string
+
+	// Ino and Dev are the inode and device numbers of the file, when inode
+	// info is enabled with SetInodeInfo on a platform that supports it.
+	Ino uint64
+	Dev uint64
+
+	// Age is how long ago the file was last modified when the event was
+	// sent.
+	Age time.Duration
+
+	// Context is the value passed to AddWithContext for Root, if any.
+	Context interface{}
+
+	// Group is the name of the group that Root was added to with
+	// AddGroup, if any.
+	Group string
+
+	// Source is the kind of scan that found the event.
+	Source Source
 }
 
 // String returns a string depending on what type of event occurred and the
@@ -86,10 +339,60 @@ func (e Event) String() string {
 	return fmt.Sprintf("%s %q %s [%s]", pathType, e.Name(), e.Op, e.Path)
 }
 
+// MarshalJSON encodes the event along with its file's info as JSON.
+func (e Event) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Op      string      `json:"op"`
+		Path    string      `json:"path"`
+		OldPath string      `json:"old_path,omitempty"`
+		Name    string      `json:"name,omitempty"`
+		Size    int64       `json:"size"`
+		Mode    os.FileMode `json:"mode"`
+		ModTime time.Time   `json:"mod_time"`
+		IsDir   bool        `json:"is_dir"`
+		Paths   []string    `json:"paths,omitempty"`
+		Root    string      `json:"root,omitempty"`
+		Depth   int         `json:"depth"`
+		DupOf   string      `json:"duplicate_of,omitempty"`
+		Ino     uint64      `json:"ino,omitempty"`
+		Dev     uint64      `json:"dev,omitempty"`
+		Age     int64       `json:"age"`
+		Source  string      `json:"source"`
+	}{
+		Op:      e.Op.String(),
+		Path:    e.Path,
+		OldPath: e.OldPath,
+		Paths:   e.Paths,
+		Root:    e.Root,
+		Depth:   e.Depth,
+		DupOf:   e.DuplicateOf,
+		Ino:     e.Ino,
+		Dev:     e.Dev,
+		Age:     int64(e.Age),
+		Source:  e.Source.String(),
+	}
+	if e.FileInfo != nil {
+		v.Name = e.Name()
+		v.Size = e.Size()
+		v.Mode = e.Mode()
+		v.ModTime = e.ModTime()
+		v.IsDir = e.IsDir()
+	}
+	return json.Marshal(v)
+}
+
 // FilterFileHookFunc is a function that is called to filter files during listings.
 // If a file is ok to be listed, nil is returned otherwise ErrSkip is returned.
 type FilterFileHookFunc func(info os.FileInfo, fullPath string) error
 
+// EventFilterFunc is a function that is called for every event before it's
+// sent. Returning false drops the event.
+type EventFilterFunc func(e Event) bool
+
+// PathRewriteHookFunc is a function that is called to rewrite the paths of
+// an event before it's sent, such as to map container paths to host paths.
+type PathRewriteHookFunc func(path string) string
+
 // RegexFilterHook is a function that accepts or rejects a file
 // for listing based on whether it's filename or full path matches
 // a regular expression.
@@ -111,24 +414,377 @@ func RegexFilterHook(r *regexp.Regexp, useFullPath bool) FilterFileHookFunc {
 	}
 }
 
+// ExtensionHook is a function that accepts or rejects a file for listing
+// based on whether its extension is one of exts, such as ".go", compared
+// case-insensitively. Extensions can be given with or without their leading
+// dot. Directories are always accepted so that the matching files inside of
+// them are found.
+func ExtensionHook(exts ...string) FilterFileHookFunc {
+	set := make(map[string]struct{}, len(exts))
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		set[strings.ToLower(ext)] = struct{}{}
+	}
+
+	return func(info os.FileInfo, fullPath string) error {
+		if info.IsDir() {
+			return nil
+		}
+
+		// Match
+		if _, found := set[strings.ToLower(filepath.Ext(info.Name()))]; found {
+			return nil
+		}
+
+		// No match.
+		return ErrSkip
+	}
+}
+
+// A FieldMask is a set of FileInfo fields that are compared to detect
+// changes to files.
+type FieldMask uint8
+
+// FieldMask fields
+const (
+	// FieldSize and FieldModTime changes are reported as Write events.
+	FieldSize FieldMask = 1 << iota
+	FieldModTime
+
+	// FieldMode changes are reported as Chmod events.
+	FieldMode
+)
+
+// An EdgeMode describes when a directory debounced with SetDirDebounce is
+// reported, relative to the burst of changes in it.
+type EdgeMode uint8
+
+// EdgeModes
+const (
+	// Leading reports a directory as soon as it first changes, then
+	// ignores further changes until it has settled.
+	Leading EdgeMode = 1 << iota
+
+	// Trailing reports a directory once it has settled. This is the
+	// default.
+	Trailing
+
+	// Both reports a directory as soon as it first changes, and again
+	// once it has settled if it changed again in the meantime.
+	Both = Leading | Trailing
+)
+
+// BrokenSymlinkPolicy describes what the watcher does with a watched symlink
+// whose target has been removed.
+type BrokenSymlinkPolicy int
+
+// BrokenSymlinkPolicies
+const (
+	// KeepWatching keeps watching a broken symlink as a link. This is
+	// the default.
+	KeepWatching BrokenSymlinkPolicy = iota
+
+	// ReportRemove stops watching a broken symlink and reports it as
+	// removed.
+	ReportRemove
+)
+
 // Watcher describes a process that watches files for changes.
 type Watcher struct {
+	// goroutines is the number of running goroutines started with spawn.
+	// It's first so that it's 64-bit aligned for atomic operations.
+	goroutines int64
+
 	Event  chan Event
 	Error  chan error
 	Closed chan struct{}
 	close  chan struct{}
 	wg     *sync.WaitGroup
 
+	// Warnings receives the errors with a Severity of Warning instead of
+	// the Error channel when enabled with SetWarningsChannel. It's set
+	// before Start, so warningsOn is read without locking.
+	Warnings   chan error
+	warningsOn bool
+
+	// ticks receives a channel from Tick for every cycle requested in
+	// manual mode, which is closed once the cycle has finished.
+	ticks chan chan struct{}
+
+	// started is closed once Start has been called, like w.wg.
+	started chan struct{}
+
+	// finished is closed once Start has returned and all of the watcher's
+	// goroutines have exited.
+	finished chan struct{}
+
+	// stop is closed when the watcher is closing to stop any background
+	// goroutines, which are started with spawn and tracked by workers.
+	stop    chan struct{}
+	workers sync.WaitGroup
+
+	webhook chan Event // events waiting to be sent to the webhook.
+
+	// webhookDropped is the number of events dropped from the full
+	// webhook queue that haven't been warned about yet. It's accessed
+	// atomically.
+	webhookDropped uint64
+
+	// subs are the subscribers added with SubscribeAs. While there are
+	// any, fanning is true and the fan-out goroutine reads the Event
+	// channel. subsChanged wakes it up when a subscription is canceled.
+	subsMu      sync.Mutex
+	subs        []*subscriber
+	fanning     bool
+	subsChanged chan struct{}
+
+	// handlers are the event handlers set with On, and onUnhandled is the
+	// one set with OnUnhandled. handling is true while they're subscribed
+	// to the events. handlersMu is never held while locking subsMu, since
+	// subscriptions are closed while subsMu is held.
+	handlersMu  sync.Mutex
+	handlers    map[Op]func(Event)
+	onUnhandled func(Event)
+	handling    bool
+
+	// counts holds the number of events sent for each Op. It's never
+	// modified after New so it can be read without locking w.mu.
+	counts map[Op]*uint64
+
+	// hot holds the number of events sent for each path since Start, for
+	// at most maxHotPaths paths. It's protected by hotMu instead of w.mu
+	// since events are sent while pollEvents holds w.mu.
+	hotMu sync.Mutex
+	hot   map[string]uint64
+
+	// recorder writes the recording started with StartRecording. It's
+	// protected by recMu for the same reason as hot.
+	recMu     sync.Mutex
+	recorder  *json.Encoder
+	recErr    error   // the error that stopped the recording.
+	recEvents []Event // events sent since the last recorded scan.
+
+	// journal is set with SetRotatingJournal. It's protected by journalMu
+	// for the same reason as hot.
+	journalMu sync.Mutex
+	journal   *rotatingJournal
+
+	// journalWarning is 1 while the warning for a failed journal write is
+	// waiting to be received. It's accessed atomically.
+	journalWarning int32
+
+	// rewriteHooks are added with AddPathRewriteHook. They're protected
+	// by rewriteMu for the same reason as hot.
+	rewriteMu    sync.Mutex
+	rewriteHooks []PathRewriteHookFunc
+
+	// uniqueSent holds the ops that were sent while SetUniqueOps is
+	// enabled. It's protected by uniqueMu for the same reason as hot.
+	// uniqueSending is held while an event is sent with SetUniqueOps
+	// enabled, so that only one event of an op can be sent at a time.
+	uniqueMu      sync.Mutex
+	uniqueOps     bool
+	uniqueSent    map[Op]bool
+	uniqueSending chan struct{}
+
+	// flaps holds the recent events of each path with SetFlapDetection.
+	// It's protected by flapMu for the same reason as hot.
+	flapMu       sync.Mutex
+	flapCount    int
+	flapWindow   time.Duration
+	flapCooldown time.Duration
+	flaps        map[string]*flapState
+	flapSwept    time.Time // when flaps was last swept of quiet paths.
+
 	// mu protects the following.
 	mu           *sync.Mutex
 	ffh          []FilterFileHookFunc
+	eventFilters []EventFilterFunc
 	running      bool
+	interval     time.Duration          // polling interval passed to Start.
+	pollMin      time.Duration          // shortest adaptive polling interval.
+	pollMax      time.Duration          // longest adaptive polling interval.
+	pollCurrent  time.Duration          // interval until the next cycle.
+	manualTicks  bool                   // only scan when Tick is called.
+	trigger      <-chan struct{}        // starts a scan when received on.
+	schedule     string                 // schedule passed to StartSchedule.
 	names        map[string]bool        // bool for recursive or not.
+	lenient      map[string]struct{}    // names added with AddRecursiveLenient.
 	files        map[string]os.FileInfo // map of files.
 	ignored      map[string]struct{}    // ignored files or directories.
+	ignoredMany  *pathSet               // paths passed to IgnoreManyPaths.
+	ignoredGlobs []string               // ignored doublestar patterns.
+	ignoreGlobs  []string               // patterns passed to IgnoreGlob.
+	ignoreFiles  []*ignoreFile          // files added with AddIgnoreFile.
 	ops          map[Op]struct{}        // Op filtering.
 	ignoreHidden bool                   // ignore hidden files or not.
 	maxEvents    int                    // max sent events per cycle
+	summary      bool                   // send one Summary event per cycle.
+	suspended    bool                   // skip scanning while suspended.
+	sentinel     string                 // skip scanning while this exists.
+	symlinks     BrokenSymlinkPolicy    // what to do with broken symlinks.
+	follow       bool                   // walk symlinked directories.
+	overlay      bool                   // report overlay whiteouts as removes.
+	hierarchical bool                   // order creates and removes by depth.
+	mirrorSafe   bool                   // send directory creates before renames.
+	noRootSelf   bool                   // hide directory roots themselves.
+	noDirWrites  bool                   // don't send Writes for directories.
+	initial      bool                   // send the watched files on start.
+	unreadable   map[string]bool        // directories that can't be read.
+	ownerUID     int                    // only watch files owned by uid.
+	ownerGID     int                    // only watch files owned by gid.
+	linkCounts   bool                   // send LinkCount events.
+	yieldEvery   int                    // files between yields in scans.
+	since        time.Time              // report files modified after since.
+	dirDebounce  time.Duration          // window to coalesce events per dir.
+	edgeMode     EdgeMode               // when debounced dirs are reported.
+	debounce     time.Duration          // window to coalesce events per path.
+	significant  FieldMask              // fields compared to detect changes.
+
+	hookPanics []error // panics in filter hooks to report after the scan.
+
+	rootOps map[string]map[Op]struct{} // Op filtering per root.
+	globs   []string                   // patterns added with AddGlobSet.
+
+	priorities map[string]int // root priorities set with SetPriority.
+
+	contexts map[string]interface{} // root contexts set with AddWithContext.
+	groups   map[string]string      // root groups set with AddGroup.
+
+	suspendedRoots map[string]bool // roots suspended with SuspendRoot.
+
+	quietStart bool // don't report roots deleted before the first scan.
+	scanned    bool // whether a scan has listed the roots since Start.
+
+	scans     int           // number of scans since Start.
+	lastScan  time.Duration // duration of the last scan.
+	totalScan time.Duration // total duration of the scans since Start.
+
+	memoryBudget int64 // max estimated bytes for the watched files.
+	overBudget   bool  // whether the last scan exceeded the budget.
+
+	inodeInfo bool // set Ino and Dev on events.
+
+	// archives added with AddArchive, and whether the last read failed.
+	archives map[string]bool
+
+	// processes added with AddProcessFiles, and the files that each one
+	// had open for writing in the last scan.
+	processes map[int]map[string]bool
+
+	ignoreBinary bool                    // ignore binary files.
+	binaryChecks map[string]*binaryCheck // cached binary file checks.
+	binaryScan   uint64                  // the current scan for binaryChecks.
+
+	fingerprintEvents bool                   // set DuplicateOf on events.
+	fingerprints      map[string]fingerprint // cached content hashes.
+
+	dirModTimeScan bool // only read directories whose mod times changed.
+	fullScanEvery  int  // scans between forced full scans.
+	fastScans      int  // scans since the last full scan.
+
+	inodeThreshold uint64          // min free inodes before warning.
+	lowInodes      map[string]bool // roots currently below the threshold.
+
+	childCounts map[string]*childCount // directories with child count alerts.
+	totalSizes  map[string]*totalSize  // roots with total size alerts.
+	locks       map[string]bool        // locked files, if monitoring locks.
+
+	tokenEpoch string       // distinguishes this watcher's tokens.
+	tokenGen   uint64       // number of changes logged to the watched files.
+	tokensUsed bool         // whether changes are being logged for tokens.
+	changeLog  []fileChange // the changes made after generation logBase.
+	logBase    uint64
+
+	webhookURL    string
+	webhookClient *http.Client
+
+	triggerName string      // file name for events triggered with nil.
+	triggerMode os.FileMode // file mode for events triggered with nil.
+
+	backend     Backend // filesystem that files are listed from.
+	backendRoot string  // root that relative paths are joined to.
+
+	scanTimeout  time.Duration // hard timeout for each scan.
+	dirFDCaching bool          // stat files relative to directory fds.
+	readDirPlus  bool          // list recursive roots with ReadDirPlus.
+
+	renameWindow time.Duration            // window to coalesce rename chains.
+	renames      map[string]*pendingEvent // renames held back, by new path.
+
+	ephemeralLifetime time.Duration            // max lifetime of suppressed files.
+	ephemeral         map[string]*pendingEvent // creates held back, by path.
+
+	arrivalCycles int            // unchanged cycles before a file is ready.
+	arrivals      map[string]int // unchanged cycles of arriving files.
+
+	statThreshold int            // failed cycles before a path is removed.
+	statFailures  map[string]int // consecutive failed cycles, by path.
+
+	onWatchSetChange  func(oldCount, newCount int)
+	watchSetThreshold float64 // percentage change before onWatchSetChange.
+}
+
+// debounce is a directory with changes waiting to settle with
+// SetDirDebounce.
+type debounce struct {
+	changed time.Time // the time of the last change.
+	pending bool      // whether there are changes that haven't been sent.
+}
+
+// coalesce adds e to the events held back in pending by SetDebounce,
+// merging it with the pending event for the same file, and holds it until
+// deadline.
+func coalesce(pending map[string]*pendingEvent, e Event, deadline time.Time) {
+	if e.Op == Rename || e.Op == Move {
+		// A file that's still pending creation is created at its new
+		// path instead.
+		if p, found := pending[e.OldPath]; found {
+			delete(pending, e.OldPath)
+			if p.event.Op == Create {
+				e.Op, e.OldPath = Create, ""
+			}
+		}
+	}
+
+	if p, found := pending[e.Path]; found && p.event.Op == Create {
+		switch e.Op {
+		case Remove:
+			// The file was created and removed again.
+			delete(pending, e.Path)
+			return
+		case Write, Chmod:
+			p.event.FileInfo = e.FileInfo
+			p.deadline = deadline
+			return
+		}
+	}
+	if p, found := pending[e.Path]; found && p.event.Op == e.Op &&
+		(e.Op == Write || e.Op == Chmod) {
+		// Keep the info from before the first of the merged changes.
+		e.OldFileInfo = p.event.OldFileInfo
+	}
+	pending[e.Path] = &pendingEvent{event: e, deadline: deadline}
+}
+
+// pendingEvent is an event that's held back until its deadline, such as a
+// rename held back by SetRenameChainCoalescing in case the file is renamed
+// again.
+type pendingEvent struct {
+	event    Event
+	deadline time.Time
+}
+
+// childCount holds the state of a directory watched with WatchChildCount.
+type childCount struct {
+	threshold int
+	above     bool
+
+	// emptiness is true for directories added with WatchEmptiness,
+	// which send Filled and Emptied events instead.
+	emptiness bool
 }
 
 // New creates a new Watcher.
@@ -137,16 +793,66 @@ func New() *Watcher {
 	var wg sync.WaitGroup
 	wg.Add(1)
 
+	// Set up a counter for every Op.
+	counts := make(map[Op]*uint64)
+	for op := range ops {
+		counts[op] = new(uint64)
+	}
+
 	return &Watcher{
-		Event:   make(chan Event),
-		Error:   make(chan error),
-		Closed:  make(chan struct{}),
-		close:   make(chan struct{}),
-		mu:      new(sync.Mutex),
+		Event:  make(chan Event),
+		Error:  make(chan error),
+		Closed: make(chan struct{}),
+		close:  make(chan struct{}),
+		mu:     new(sync.Mutex),
+
+		Warnings: make(chan error),
+
+		finished: make(chan struct{}),
+		started:  make(chan struct{}),
+		ticks:    make(chan chan struct{}),
+		stop:     make(chan struct{}),
+		webhook:  make(chan Event, webhookQueueSize),
+		counts:   counts,
+		hot:      make(map[string]uint64),
+
+		subsChanged:   make(chan struct{}, 1),
+		uniqueSending: make(chan struct{}, 1),
+		handlers:      make(map[Op]func(Event)),
+
 		wg:      &wg,
 		files:   make(map[string]os.FileInfo),
 		ignored: make(map[string]struct{}),
 		names:   make(map[string]bool),
+		lenient: make(map[string]struct{}),
+		rootOps: make(map[string]map[Op]struct{}),
+
+		priorities: make(map[string]int),
+		contexts:   make(map[string]interface{}),
+		groups:     make(map[string]string),
+
+		suspendedRoots: make(map[string]bool),
+
+		lowInodes:   make(map[string]bool),
+		childCounts: make(map[string]*childCount),
+		tokenEpoch:  newTokenEpoch(),
+		totalSizes:  make(map[string]*totalSize),
+		renames:     make(map[string]*pendingEvent),
+		ephemeral:   make(map[string]*pendingEvent),
+		arrivals:    make(map[string]int),
+
+		fingerprints: make(map[string]fingerprint),
+		archives:     make(map[string]bool),
+		binaryChecks: make(map[string]*binaryCheck),
+		processes:    make(map[int]map[string]bool),
+
+		backend:     osBackend{},
+		ownerUID:    -1,
+		yieldEvery:  defaultYieldEvery,
+		significant: FieldModTime | FieldMode,
+		edgeMode:    Trailing,
+		ownerGID:    -1,
+		triggerName: "triggered event",
 	}
 }
 
@@ -159,139 +865,1075 @@ func (w *Watcher) SetMaxEvents(delta int) {
 	w.mu.Unlock()
 }
 
-// AddFilterHook
-func (w *Watcher) AddFilterHook(f FilterFileHookFunc) {
+// SetEventBufferSize replaces the Event channel with one that buffers up to
+// n events, so that a watching cycle can finish and release the watcher's
+// lock even if the consumer lags behind by a few events. Events are never
+// dropped because the buffer is full, the watcher waits for room instead,
+// but SetMaxEvents still limits the number of events sent per cycle.
+// SetEventBufferSize must be called before Start, and before the Event
+// channel is passed anywhere, and returns ErrWatcherRunning otherwise.
+func (w *Watcher) SetEventBufferSize(n int) error {
 	w.mu.Lock()
-	w.ffh = append(w.ffh, f)
-	w.mu.Unlock()
+	defer w.mu.Unlock()
+
+	if w.running {
+		return ErrWatcherRunning
+	}
+	w.Event = make(chan Event, n)
+	return nil
 }
 
-// IgnoreHiddenFiles sets the watcher to ignore any file or directory
-// that starts with a dot.
-func (w *Watcher) IgnoreHiddenFiles(ignore bool) {
+// SetSummaryEvents sets the watcher to send a single Summary event per
+// watching cycle instead of individual events. The Summary event's Paths
+// field lists every path that changed during the cycle.
+func (w *Watcher) SetSummaryEvents(enabled bool) {
 	w.mu.Lock()
-	w.ignoreHidden = ignore
+	w.summary = enabled
 	w.mu.Unlock()
 }
 
-// FilterOps filters which event op types should be returned
-// when an event occurs.
-func (w *Watcher) FilterOps(ops ...Op) {
-	w.mu.Lock()
-	w.ops = make(map[Op]struct{})
-	for _, op := range ops {
-		w.ops[op] = struct{}{}
+// SetInodeMonitoring makes the watcher send an ErrLowInodes warning on the
+// Error channel when the number of free inodes on a watched root's filesystem
+// drops below threshold. A threshold of 0 disables inode monitoring,
+// which is the default.
+//
+// Inode monitoring is only supported on Linux, macOS and FreeBSD. On other
+// platforms, enabling it returns ErrInodeMonitoringUnsupported.
+func (w *Watcher) SetInodeMonitoring(threshold uint64) error {
+	if threshold > 0 && !inodeMonitoringSupported {
+		return ErrInodeMonitoringUnsupported
 	}
+
+	w.mu.Lock()
+	w.inodeThreshold = threshold
 	w.mu.Unlock()
+
+	return nil
 }
 
-// Add adds either a single file or directory to the file list.
-func (w *Watcher) Add(name string) (err error) {
+// WatchChildCount sends a ChildCountAbove event when the number of watched
+// files directly inside of the directory path exceeds threshold, and a
+// ChildCountBelow event when it drops back to threshold or below.
+func (w *Watcher) WatchChildCount(path string, threshold int) (err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	name, err = filepath.Abs(name)
+	path, err = w.abs(path)
 	if err != nil {
 		return err
 	}
 
-	// If name is on the ignored list or if hidden files are
-	// ignored and name is a hidden file or directory, simply return.
-	_, ignored := w.ignored[name]
+	w.childCounts[path] = &childCount{threshold: threshold}
 
-	isHidden, err := isHiddenFile(name)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	if ignored || (w.ignoreHidden && isHidden) {
-		return nil
-	}
+// WatchEmptiness sends a single Filled event when the directory path goes
+// from having no watched files directly inside of it to having some, and an
+// Emptied event when it becomes empty again, rather than an event for each
+// file, such as for a drop folder. The directory's state when WatchEmptiness
+// is called is its starting state, so a directory that already has files
+// only sends an event once it's emptied.
+func (w *Watcher) WatchEmptiness(path string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	// Add the directory's contents to the files list.
-	fileList, err := w.list(name)
+	path, err = w.abs(path)
 	if err != nil {
 		return err
 	}
-	for k, v := range fileList {
-		w.files[k] = v
-	}
 
-	// Add the name to the names list.
-	w.names[name] = false
+	cc := &childCount{emptiness: true}
+	for name := range w.files {
+		if filepath.Dir(name) == path && name != path {
+			cc.above = true
+			break
+		}
+	}
+	w.childCounts[path] = cc
 
 	return nil
 }
 
-func (w *Watcher) list(name string) (map[string]os.FileInfo, error) {
-	fileList := make(map[string]os.FileInfo)
-
-	// Make sure name exists.
-	stat, err := os.Stat(name)
-	if err != nil {
-		return nil, err
-	}
+// OnWatchSetChange sets a function that's called after a watching cycle
+// whenever the number of watched files changes by more than the percentage
+// set with SetWatchSetChangeThreshold.
+func (w *Watcher) OnWatchSetChange(f func(oldCount, newCount int)) {
+	w.mu.Lock()
+	w.onWatchSetChange = f
+	w.mu.Unlock()
+}
 
-	fileList[name] = stat
+// SetWatchSetChangeThreshold sets the percentage that the number of watched
+// files has to change by between watching cycles before the OnWatchSetChange
+// function is called. The default is 0, which calls it on any change.
+func (w *Watcher) SetWatchSetChangeThreshold(percent float64) {
+	w.mu.Lock()
+	w.watchSetThreshold = percent
+	w.mu.Unlock()
+}
 
-	// If it's not a directory, just return.
-	if !stat.IsDir() {
-		return fileList, nil
+// watchSetChanged reports whether the number of watched files changed from
+// oldCount to newCount by more than percent.
+func watchSetChanged(oldCount, newCount int, percent float64) bool {
+	if oldCount == newCount {
+		return false
 	}
-
-	// It's a directory.
-	fInfoList, err := ioutil.ReadDir(name)
-	if err != nil {
-		return nil, err
+	if oldCount == 0 {
+		return true
 	}
-	// Add all of the files in the directory to the file list as long
-	// as they aren't on the ignored list or are hidden files if ignoreHidden
-	// is set to true.
-outer:
-	for _, fInfo := range fInfoList {
-		path := filepath.Join(name, fInfo.Name())
-		_, ignored := w.ignored[path]
+	delta := float64(newCount - oldCount)
+	if delta < 0 {
+		delta = -delta
+	}
+	return delta/float64(oldCount)*100 > percent
+}
 
-		isHidden, err := isHiddenFile(path)
-		if err != nil {
-			return nil, err
-		}
+// AddFilterHook
+func (w *Watcher) AddFilterHook(f FilterFileHookFunc) {
+	w.mu.Lock()
+	w.ffh = append(w.ffh, f)
+	w.mu.Unlock()
+}
 
-		if ignored || (w.ignoreHidden && isHidden) {
-			continue
-		}
+// AddEventFilter adds a filter that every event must pass to be sent on the
+// Event channel, such as to only receive events for .go files larger than
+// 1KB. An event is only sent if all of the filters return true. Unlike
+// filter hooks, which decide which files are listed, event filters are
+// called for each event as it's about to be sent, with the event's Op,
+// OldPath and the rest of its fields.
+func (w *Watcher) AddEventFilter(f EventFilterFunc) {
+	w.mu.Lock()
+	w.eventFilters = append(w.eventFilters, f)
+	w.mu.Unlock()
+}
 
-		for _, f := range w.ffh {
-			err := f(fInfo, path)
-			if err == ErrSkip {
-				continue outer
-			}
-			if err != nil {
-				return nil, err
-			}
-		}
+// AddPathRewriteHook adds a hook that rewrites the Path, OldPath and Paths of
+// every event before it's sent. Hooks are applied in the order they were
+// added, each to the result of the previous one. Only the sent events are
+// rewritten, so WatchedFiles and the other methods still use the original
+// paths. Triggered events aren't rewritten.
+func (w *Watcher) AddPathRewriteHook(f PathRewriteHookFunc) {
+	w.rewriteMu.Lock()
+	w.rewriteHooks = append(w.rewriteHooks, f)
+	w.rewriteMu.Unlock()
+}
 
-		fileList[path] = fInfo
+// rewritePath applies the path rewrite hooks to path.
+func rewritePath(hooks []PathRewriteHookFunc, path string) string {
+	if path == "" || path == "-" {
+		return path
 	}
-	return fileList, nil
+	for _, f := range hooks {
+		path = f(path)
+	}
+	return path
 }
 
-// AddRecursive adds either a single file or directory recursively to the file list.
-func (w *Watcher) AddRecursive(name string) (err error) {
+// IgnoreHiddenFiles sets the watcher to ignore any file or directory
+// that starts with a dot.
+func (w *Watcher) IgnoreHiddenFiles(ignore bool) {
 	w.mu.Lock()
-	defer w.mu.Unlock()
+	w.ignoreHidden = ignore
+	w.mu.Unlock()
+}
 
-	name, err = filepath.Abs(name)
-	if err != nil {
-		return err
+// FilterOps filters which event op types should be returned
+// when an event occurs.
+func (w *Watcher) FilterOps(ops ...Op) {
+	w.mu.Lock()
+	w.ops = make(map[Op]struct{})
+	for _, op := range ops {
+		w.ops[op] = struct{}{}
+	}
+	w.mu.Unlock()
+}
+
+// SetUniqueOps sets whether only the first event of each Op is sent. Once an
+// event of an Op has been sent for any path, later events of that Op are
+// dropped until ResetUniqueOps is called.
+func (w *Watcher) SetUniqueOps(enabled bool) {
+	w.uniqueMu.Lock()
+	w.uniqueOps = enabled
+	w.uniqueSent = make(map[Op]bool)
+	w.uniqueMu.Unlock()
+}
+
+// ResetUniqueOps forgets which Ops were sent, so that the next event of each
+// Op is sent again when SetUniqueOps is enabled.
+func (w *Watcher) ResetUniqueOps() {
+	w.uniqueMu.Lock()
+	w.uniqueSent = make(map[Op]bool)
+	w.uniqueMu.Unlock()
+}
+
+// FilterOwner sets the watcher to only watch files owned by the user uid and
+// the group gid. A uid or gid of -1 doesn't filter on that field, and
+// FilterOwner(-1, -1) removes the filter. Directories are always watched so
+// that the matching files inside of them are found. FilterOwner should be
+// called before any files are added, and is only supported on Unix.
+func (w *Watcher) FilterOwner(uid, gid int) {
+	w.mu.Lock()
+	w.ownerUID = uid
+	w.ownerGID = gid
+	w.mu.Unlock()
+}
+
+// isOwnerFiltered reports whether info is a file that's filtered out by
+// FilterOwner. The caller must hold w.mu.
+func (w *Watcher) isOwnerFiltered(info os.FileInfo) bool {
+	if (w.ownerUID < 0 && w.ownerGID < 0) || info.IsDir() {
+		return false
+	}
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return false
+	}
+	return (w.ownerUID >= 0 && uid != w.ownerUID) ||
+		(w.ownerGID >= 0 && gid != w.ownerGID)
+}
+
+// SetInodeInfo sets the watcher to set the Ino and Dev fields of events to
+// the inode and device numbers of their files, which are already known from
+// listing them. Inode info is only supported on Unix.
+func (w *Watcher) SetInodeInfo(enabled bool) {
+	w.mu.Lock()
+	w.inodeInfo = enabled
+	w.mu.Unlock()
+}
+
+// SetLinkCountEvents sets the watcher to send a LinkCount event whenever the
+// number of hard links to a watched file changes, such as when another name
+// for the file is removed, even if it's outside of the watched files. The
+// event's FileInfo has the new link count in its Sys value. Link counts are
+// only supported on Unix.
+func (w *Watcher) SetLinkCountEvents(enabled bool) {
+	w.mu.Lock()
+	w.linkCounts = enabled
+	w.mu.Unlock()
+}
+
+// defaultYieldEvery is the default number of files that are scanned between
+// yields to other goroutines.
+const defaultYieldEvery = 1000
+
+// SetYieldEvery sets the number of files that the watcher scans before
+// yielding to other goroutines with runtime.Gosched, so that scanning a
+// large tree doesn't starve the goroutine receiving its events on a busy or
+// single core system. The default is 1000, and n less than 1 never yields.
+func (w *Watcher) SetYieldEvery(n int) {
+	w.mu.Lock()
+	w.yieldEvery = n
+	w.mu.Unlock()
+}
+
+// yield lets other goroutines run after every w.yieldEvery calls, which
+// are counted in scanned. The caller must hold w.mu.
+func (w *Watcher) yield(scanned *int) {
+	*scanned++
+	if w.yieldEvery > 0 && *scanned%w.yieldEvery == 0 {
+		runtime.Gosched()
+	}
+}
+
+// PauseWhileExists stops the watcher from scanning for changes for as long as
+// a file or directory exists at sentinelPath, such as a lock file created by
+// another process during a bulk import. Any changes made while the watcher is
+// paused are reported once sentinelPath is removed. An empty sentinelPath
+// removes the sentinel.
+func (w *Watcher) PauseWhileExists(sentinelPath string) (err error) {
+	if sentinelPath != "" {
+		sentinelPath, err = filepath.Abs(sentinelPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	w.sentinel = sentinelPath
+	w.mu.Unlock()
+
+	return nil
+}
+
+// SetBrokenSymlinkPolicy sets what the watcher does with a watched symlink
+// whose target has been removed. With KeepWatching, which is the default,
+// the link itself keeps being watched. With ReportRemove, a Remove event is
+// sent for the link and it stops being watched until its target returns.
+func (w *Watcher) SetBrokenSymlinkPolicy(policy BrokenSymlinkPolicy) {
+	w.mu.Lock()
+	w.symlinks = policy
+	w.mu.Unlock()
+}
+
+// SetFollowSymlinks sets whether recursive watches walk into symlinked
+// directories, watching their targets' contents as if they were inside the
+// link. A directory that's already been walked during a scan isn't walked
+// again, so a link that points back up the tree can't loop forever. Links
+// are only followed on the local filesystem. By default, symlinked
+// directories are watched as links and not walked.
+func (w *Watcher) SetFollowSymlinks(enabled bool) {
+	w.mu.Lock()
+	w.follow = enabled
+	w.mu.Unlock()
+}
+
+// isBrokenSymlink reports whether info is a symlink whose target doesn't
+// exist on backend and the broken symlink policy is to stop watching it.
+func (w *Watcher) isBrokenSymlink(backend Backend, info os.FileInfo, path string) bool {
+	if w.symlinks != ReportRemove || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	_, err := backend.Stat(path)
+	return os.IsNotExist(err)
+}
+
+// SetOverlayAwareness sets the watcher to recognize overlay filesystem
+// whiteout files. When a whiteout file such as .wh.name is created, a
+// Remove event is sent for the path it shadows instead of a Create event
+// for the whiteout file itself.
+func (w *Watcher) SetOverlayAwareness(enabled bool) {
+	w.mu.Lock()
+	w.overlay = enabled
+	w.mu.Unlock()
+}
+
+// SetHierarchicalOrdering sets the watcher to always send the Create event
+// for a directory before the Create events for its children, and the Remove
+// events for a directory's children before the Remove event for the
+// directory itself, so a mirror can create parents first and remove them
+// last. Without it, the order of events within a watching cycle is random.
+func (w *Watcher) SetHierarchicalOrdering(enabled bool) {
+	w.mu.Lock()
+	w.hierarchical = enabled
+	w.mu.Unlock()
+}
+
+// SetMirrorSafeOrdering sets whether a created directory that a file was
+// renamed or moved into during a watching cycle has its Create event sent
+// before the Rename or Move event, so that a mirror applying the events in
+// order already has the destination directory. The directories are sent
+// parents first. Without it, renames and moves are sent before creates.
+func (w *Watcher) SetMirrorSafeOrdering(enabled bool) {
+	w.mu.Lock()
+	w.mirrorSafe = enabled
+	w.mu.Unlock()
+}
+
+// mirrorDirs returns the created directories that are the parents of the
+// destination of a rename or move between removes and creates, and that
+// aren't the destination of one themselves, parents first.
+func mirrorDirs(removes, creates map[string]os.FileInfo) []string {
+	dests := make(map[string]bool)
+	for _, info1 := range removes {
+		for path2, info2 := range creates {
+			if sameFile(info1, info2) {
+				dests[path2] = true
+				break
+			}
+		}
+	}
+
+	dirs := make(map[string]bool)
+	for dest := range dests {
+		for dir := filepath.Dir(dest); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			info, created := creates[dir]
+			if !created || !info.IsDir() || dests[dir] {
+				break
+			}
+			dirs[dir] = true
+		}
+	}
+
+	paths := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		paths = append(paths, dir)
+	}
+	sort.Sort(byDepth(paths))
+	return paths
+}
+
+// SetAdaptivePolling sets the watcher to poll every min while files are
+// changing, and to back off while they aren't, doubling the interval after
+// every cycle that finds no events up to max. Any event sets the interval
+// back to min. This keeps changes quick to be noticed while they're
+// happening, and cuts down on scans of a large tree that's idle. The
+// duration passed to Start is ignored while adaptive polling is set, and the
+// current interval is reported by Stats. A min and max of 0 turns adaptive
+// polling off, which is the default. SetAdaptivePolling must be called
+// before Start.
+func (w *Watcher) SetAdaptivePolling(min, max time.Duration) error {
+	if min != 0 || max != 0 {
+		if min < time.Nanosecond {
+			return ErrDurationTooShort
+		}
+		if max < min {
+			return errors.New("error: adaptive polling max can't be less than min")
+		}
+	}
+
+	w.mu.Lock()
+	w.pollMin, w.pollMax = min, max
+	w.mu.Unlock()
+	return nil
+}
+
+// SetInitialEvents sets whether the watcher sends a Create event for each of
+// the watched files when it starts, before any changes are reported. The
+// initial events have a Source of SourceInitial, so they can be told apart
+// from the changes found by later scans.
+func (w *Watcher) SetInitialEvents(enabled bool) {
+	w.mu.Lock()
+	w.initial = enabled
+	w.mu.Unlock()
+}
+
+// initialEvents returns the events sent when the watcher starts with
+// SetInitialEvents, sorted by path.
+func (w *Watcher) initialEvents() []Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.initial {
+		return nil
+	}
+
+	paths := make([]string, 0, len(w.files))
+	for path := range w.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	filter := w.opFilters()
+	var events []Event
+	for _, path := range paths {
+		e := w.newEvent(Create, path, "", w.files[path])
+		if !w.opAllowed(filter, e) {
+			continue
+		}
+		e.Source = SourceInitial
+		events = append(events, e)
+	}
+	return events
+}
+
+// SetRootSelfEvents sets whether the directories added to the watcher send
+// events for themselves, such as the Write event when a directory's
+// modification time changes because its children changed. When disabled,
+// the added directories are also left out of WatchedFiles, while their
+// contents are still watched and reported as usual. Added single files
+// aren't affected. It's enabled by default.
+func (w *Watcher) SetRootSelfEvents(enabled bool) {
+	w.mu.Lock()
+	w.noRootSelf = !enabled
+	w.mu.Unlock()
+}
+
+// SetDirModTimeEvents sets whether Write events are sent for directories
+// whose modification time or size changes between scans, which on most
+// systems happens whenever a child is added, removed or renamed. Disabling
+// them cuts down on noise when only the changes to the files themselves
+// matter. It's enabled by default.
+func (w *Watcher) SetDirModTimeEvents(enabled bool) {
+	w.mu.Lock()
+	w.noDirWrites = !enabled
+	w.mu.Unlock()
+}
+
+// isRootSelf reports whether path is a directory root that's hidden by
+// SetRootSelfEvents. The caller must hold w.mu.
+func (w *Watcher) isRootSelf(path string, info os.FileInfo) bool {
+	if !w.noRootSelf || !info.IsDir() {
+		return false
+	}
+	_, root := w.names[path]
+	return root
+}
+
+// SetSignificantFields sets which FileInfo fields are compared to detect
+// changes to files, such as to ignore mod times on a filesystem that reports
+// them unreliably. A Write event is sent when a file's size or mod time
+// changes and a Chmod event when its mode changes, if the field is in fields.
+// The default is FieldModTime | FieldMode.
+func (w *Watcher) SetSignificantFields(fields FieldMask) {
+	w.mu.Lock()
+	w.significant = fields
+	w.mu.Unlock()
+}
+
+// SetDirDebounce sets the watcher to coalesce events by directory. Instead of
+// sending an event for every changed file, a single Write event for the
+// changed files' parent directory is sent once none of its files have changed
+// for d, such as to trigger one rebuild per directory. Writes to a directory
+// itself count as changes to that directory. A d of 0 disables debouncing,
+// which is the default.
+func (w *Watcher) SetDirDebounce(d time.Duration) {
+	w.mu.Lock()
+	w.dirDebounce = d
+	w.mu.Unlock()
+}
+
+// SetDebounce sets the watcher to coalesce the events for each path, so that
+// only the last event for a path is sent once no new events for it have been
+// found for d, such as when an editor writes a file several times to save
+// it. A Create followed by Writes is sent as a single Create, a Write
+// followed by a Remove as a Remove, and a Create followed by a Remove isn't
+// sent at all. The pending events are checked at the end of every watching
+// cycle, so d is effectively rounded up to the polling interval, and any
+// pending events are dropped when the watcher is closed. A d of 0 disables
+// debouncing, which is the default.
+func (w *Watcher) SetDebounce(d time.Duration) {
+	w.mu.Lock()
+	w.debounce = d
+	w.mu.Unlock()
+}
+
+// SetEdgeMode sets when directories debounced with SetDirDebounce are
+// reported: on the leading edge of a burst of changes for responsiveness,
+// on the trailing edge once the directory has settled for completeness, or
+// on both. The default is Trailing, and an EdgeMode of 0 is the same as
+// Trailing.
+func (w *Watcher) SetEdgeMode(mode EdgeMode) {
+	if mode&Both == 0 {
+		mode = Trailing
+	}
+
+	w.mu.Lock()
+	w.edgeMode = mode & Both
+	w.mu.Unlock()
+}
+
+// SetSuppressEphemeral sets the watcher to hold back Create events for up to
+// maxLifetime, so that a file that's created and then removed again within
+// maxLifetime, such as a temporary file, produces no events at all, even if
+// its create and remove are seen in different watching cycles. A maxLifetime
+// of 0 disables suppression, which is the default.
+func (w *Watcher) SetSuppressEphemeral(maxLifetime time.Duration) {
+	w.mu.Lock()
+	w.ephemeralLifetime = maxLifetime
+	w.mu.Unlock()
+}
+
+// SetArrivalCycles sets the watcher to treat a created file as arriving
+// until it has stayed unchanged for n watching cycles, such as for files that
+// are written incrementally by an import pipeline. No events are sent for a
+// file while it's arriving, and a single Create event is sent once it's
+// ready. A file that's removed while it's arriving produces no events at all.
+// Directories are reported as usual. An n of 0 disables arrival tracking,
+// which is the default.
+func (w *Watcher) SetArrivalCycles(n int) {
+	w.mu.Lock()
+	w.arrivalCycles = n
+	w.mu.Unlock()
+}
+
+// SetStatFailureThreshold sets the watcher to retry paths that can't be
+// listed for up to n consecutive watching cycles, such as because of a
+// transient error on a network filesystem. While a path is being retried,
+// its last known files are kept and no error is sent. Once it has failed n
+// cycles in a row, it's treated as removed, so Remove events are sent for it
+// and everything below it, and it's reported as created again once it can
+// be listed. Deleted files and unreadable directories aren't affected. An n
+// of 0 disables retrying, which is the default, and sends a warning for
+// every failure.
+func (w *Watcher) SetStatFailureThreshold(n int) {
+	w.mu.Lock()
+	w.statThreshold = n
+	w.statFailures = make(map[string]int)
+	w.mu.Unlock()
+}
+
+// retryStat records that path couldn't be listed this cycle, in failures,
+// and reports whether its last known files should still be kept instead of
+// it being treated as removed. The caller must hold w.mu.
+func (w *Watcher) retryStat(path string, failures map[string]int) bool {
+	failures[path] = w.statFailures[path] + 1
+	return failures[path] < w.statThreshold
+}
+
+// SetRenameChainCoalescing sets the watcher to hold back Rename and Move
+// events for up to window, so that a file that's renamed again within the
+// window, such as from A to B and then from B to C, is reported as a single
+// event from A to C. A window of 0 disables coalescing, which is the default.
+func (w *Watcher) SetRenameChainCoalescing(window time.Duration) {
+	w.mu.Lock()
+	w.renameWindow = window
+	w.mu.Unlock()
+}
+
+// Suspend stops the watcher from scanning for changes until Resume or
+// ResumeQuiet is called.
+func (w *Watcher) Suspend() {
+	w.mu.Lock()
+	w.suspended = true
+	w.mu.Unlock()
+}
+
+// Resume resumes scanning after a call to Suspend. Any changes that were
+// made while the watcher was suspended are reported by the next scan.
+func (w *Watcher) Resume() {
+	w.mu.Lock()
+	w.suspended = false
+	w.mu.Unlock()
+}
+
+// ResumeQuiet resumes scanning after a call to Suspend, but first updates
+// the file list to the current state of the watched files so that any
+// changes made while the watcher was suspended are not reported.
+func (w *Watcher) ResumeQuiet() {
+	fileList := w.retrieveFileList()
+
+	w.mu.Lock()
+	if fileList != nil {
+		w.replaceFiles(fileList)
+	}
+	w.suspended = false
+	w.mu.Unlock()
+}
+
+// Resync lists all of the watched files again and makes them the watched
+// files without sending any events, so that changes made since the last
+// scan, such as bulk changes made while the watcher was suspended, aren't
+// reported, and the next change is found relative to the current state of
+// the files. Unlike Changes, it's safe to call while the watcher is
+// running. It returns ErrScanTimeout if the scan timed out, in which case
+// the watched files are left as they were.
+func (w *Watcher) Resync() error {
+	fileList := w.retrieveFileList()
+	if fileList == nil {
+		return ErrScanTimeout
+	}
+
+	w.mu.Lock()
+	w.replaceFiles(fileList)
+	w.since = time.Time{}
+	w.mu.Unlock()
+
+	return nil
+}
+
+// SuspendRoot stops scanning the watched root name until ResumeRoot or
+// ResumeRootQuiet is called, while the other roots are still scanned. Its
+// files are kept as they were, so they aren't reported as removed.
+func (w *Watcher) SuspendRoot(name string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name, err = w.abs(name)
+	if err != nil {
+		return err
+	}
+	if _, found := w.names[name]; !found {
+		return ErrNotWatched
+	}
+	w.suspendedRoots[name] = true
+	return nil
+}
+
+// ResumeRoot resumes scanning the root name after a call to SuspendRoot.
+// Any changes that were made to it while it was suspended are reported by
+// the next scan.
+func (w *Watcher) ResumeRoot(name string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name, err = w.abs(name)
+	if err != nil {
+		return err
+	}
+	if _, found := w.names[name]; !found {
+		return ErrNotWatched
+	}
+	delete(w.suspendedRoots, name)
+	return nil
+}
+
+// ResumeRootQuiet resumes scanning the root name after a call to
+// SuspendRoot, but first lists it again so that any changes that were made
+// to it while it was suspended are not reported.
+func (w *Watcher) ResumeRootQuiet(name string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name, err = w.abs(name)
+	if err != nil {
+		return err
+	}
+	recursive, found := w.names[name]
+	if !found {
+		return ErrNotWatched
+	}
+
+	var list map[string]os.FileInfo
+	if recursive {
+		list, err = w.walk(w.backend, name, nil)
+	} else {
+		list, err = w.list(w.backend, name)
+	}
+	if err != nil {
+		return err
+	}
+
+	for path := range w.files {
+		if w.rootOf(path) == name {
+			w.deleteFile(path)
+		}
+	}
+	for path, info := range list {
+		w.setFile(path, info)
+	}
+	delete(w.suspendedRoots, name)
+	return nil
+}
+
+// SetSince sets the watcher to report files that were modified after t as
+// created in its first watching cycle, such as to catch up on changes made
+// while a program wasn't running. Files modified at or before t are watched
+// without sending any events. SetSince must be called before the files are
+// added, and only affects files added before the first watching cycle.
+func (w *Watcher) SetSince(t time.Time) {
+	w.mu.Lock()
+	w.since = t
+	w.mu.Unlock()
+}
+
+// addFiles adds the files in fileList, which were listed from name, to the
+// watched files. Files modified after the time set with SetSince are left out
+// so that they're reported as created. The caller must hold w.mu.
+func (w *Watcher) addFiles(name string, fileList map[string]os.FileInfo) error {
+	if err := w.checkMemoryBudget(fileList); err != nil {
+		return err
+	}
+	for k, v := range fileList {
+		if k != name && !w.since.IsZero() && v.ModTime().After(w.since) {
+			continue
+		}
+		w.setFile(k, v)
+	}
+	return nil
+}
+
+// Add adds either a single file or directory to the file list.
+func (w *Watcher) Add(name string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err = w.add(name)
+	return err
+}
+
+// add adds name like Add and returns its absolute path. The caller must
+// hold w.mu.
+func (w *Watcher) add(name string) (string, error) {
+	name, err := w.abs(name)
+	if err != nil {
+		return "", err
+	}
+
+	// If name is on the ignored list or if hidden files are
+	// ignored and name is a hidden file or directory, simply return.
+	ignored, err := w.isIgnored(name)
+	if err != nil {
+		return "", err
+	}
+
+	if ignored {
+		return name, nil
+	}
+
+	// Add the directory's contents to the files list.
+	fileList, err := w.list(w.backend, name)
+	if err != nil {
+		return "", err
+	}
+	if err := w.addFiles(name, fileList); err != nil {
+		return "", err
+	}
+
+	// Add the name to the names list.
+	w.names[name] = false
+
+	return name, nil
+}
+
+// AddWithOps adds either a single file or directory to the file list like
+// Add, but only sends events with one of ops for it, instead of the ops set
+// with FilterOps.
+func (w *Watcher) AddWithOps(name string, ops ...Op) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Set the filter along with adding name, so that none of its events
+	// are filtered with FilterOps instead.
+	name, err := w.add(name)
+	if err != nil {
+		return err
+	}
+
+	filter := make(map[Op]struct{})
+	for _, op := range ops {
+		filter[op] = struct{}{}
+	}
+	w.rootOps[name] = filter
+
+	return nil
+}
+
+// AddWithContext adds either a single file or directory to the file list
+// like Add, and sets the Context of its events to ctx, such as to tag each
+// root with the ID of the handler that its events should be routed to.
+func (w *Watcher) AddWithContext(name string, ctx interface{}) error {
+	if err := w.Add(name); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name, err := w.abs(name)
+	if err != nil {
+		return err
+	}
+	w.contexts[name] = ctx
+
+	return nil
+}
+
+// AddGroup adds each of paths recursively like AddRecursive, and sets the
+// Group of their events to group, so that several unrelated sets of
+// directories can be watched by one Watcher and their events routed to
+// different handlers. A path that's inside another watched root belongs to
+// the deepest root's group.
+func (w *Watcher) AddGroup(group string, paths ...string) error {
+	for _, path := range paths {
+		if err := w.AddRecursive(path); err != nil {
+			return err
+		}
+		if err := w.setGroup(path, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setGroup sets the group of the watched root.
+func (w *Watcher) setGroup(root, group string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	root, err := w.abs(root)
+	if err != nil {
+		return err
+	}
+	if group == "" {
+		delete(w.groups, root)
+	} else {
+		w.groups[root] = group
+	}
+
+	return nil
+}
+
+// SetPriority sets the priority of the watched root, which is 0 by default.
+// Roots are listed in order of descending priority in each scan, and the
+// events for a cycle are sent in order of their roots' descending priority,
+// so that changes to high priority roots aren't starved by a scan timeout or
+// by SetMaxEvents. While any priorities are set, a cycle's events are only
+// sent once the whole cycle has finished.
+func (w *Watcher) SetPriority(root string, priority int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	root, err := w.abs(root)
+	if err != nil {
+		return err
+	}
+
+	if priority == 0 {
+		delete(w.priorities, root)
+	} else {
+		w.priorities[root] = priority
+	}
+	return nil
+}
+
+// rootsByPriority returns the watched roots in order of descending priority.
+// The caller must hold w.mu.
+func (w *Watcher) rootsByPriority() []string {
+	roots := make([]string, 0, len(w.names))
+	for name := range w.names {
+		roots = append(roots, name)
+	}
+	sort.Sort(byPriority{roots, w.priorities})
+	return roots
+}
+
+// byPriority sorts paths by descending priority, then by path.
+type byPriority struct {
+	paths      []string
+	priorities map[string]int
+}
+
+func (p byPriority) Len() int      { return len(p.paths) }
+func (p byPriority) Swap(i, j int) { p.paths[i], p.paths[j] = p.paths[j], p.paths[i] }
+func (p byPriority) Less(i, j int) bool {
+	pi, pj := p.priorities[p.paths[i]], p.priorities[p.paths[j]]
+	if pi != pj {
+		return pi > pj
+	}
+	return p.paths[i] < p.paths[j]
+}
+
+// byRootPriority sorts events by the descending priority of their roots.
+type byRootPriority struct {
+	events     []Event
+	priorities map[string]int
+}
+
+func (p byRootPriority) Len() int      { return len(p.events) }
+func (p byRootPriority) Swap(i, j int) { p.events[i], p.events[j] = p.events[j], p.events[i] }
+func (p byRootPriority) Less(i, j int) bool {
+	return p.priorities[p.events[i].Root] > p.priorities[p.events[j].Root]
+}
+
+// AddFromReader reads a newline separated list of files and directories from r
+// and adds each of them with Add. Blank lines and lines starting with # are
+// skipped. Paths that fail to be added don't stop the rest from being added,
+// and are all reported in the returned error.
+func (w *Watcher) AddFromReader(r io.Reader) error {
+	var errs []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := w.Add(line); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error: failed to add paths: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (w *Watcher) list(backend Backend, name string) (map[string]os.FileInfo, error) {
+	fileList := make(map[string]os.FileInfo)
+
+	// Make sure name exists.
+	stat, err := backend.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fileList[name] = stat
+
+	// If it's not a directory, just return.
+	if !stat.IsDir() {
+		return fileList, nil
+	}
+
+	// It's a directory.
+	fInfoList, err := backend.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	// Add all of the files in the directory to the file list as long
+	// as they aren't on the ignored list or are hidden files if ignoreHidden
+	// is set to true.
+	scanned := 0
+outer:
+	for _, fInfo := range fInfoList {
+		w.yield(&scanned)
+		path := filepath.Join(name, fInfo.Name())
+
+		ignored, err := w.isIgnored(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if ignored || w.isIgnoredByFile(path, fInfo.IsDir()) {
+			continue
+		}
+
+		for _, f := range w.ffh {
+			err := w.callHook(f, fInfo, path)
+			if err == ErrSkip {
+				continue outer
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if w.isBrokenSymlink(backend, fInfo, path) || w.isOwnerFiltered(fInfo) ||
+			w.isBinaryFiltered(path, fInfo) {
+			continue
+		}
+
+		fileList[path] = fInfo
+	}
+	return fileList, nil
+}
+
+// AddRecursiveLenient adds either a single file or directory recursively to
+// the file list like AddRecursive, but instead of failing on the first error,
+// it skips any files or directories that can't be listed and keeps going.
+// It returns the number of files and directories that were added along with
+// a *WatcherError for each path that was skipped. The skipped paths are also
+// silently skipped when watching.
+func (w *Watcher) AddRecursiveLenient(name string) (added int, errs []error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name, err := w.abs(name)
+	if err != nil {
+		return 0, []error{err}
+	}
+
+	fileList, _ := w.walk(w.backend, name, func(path string, err error) error {
+		errs = append(errs, &WatcherError{Warning, path, err})
+		return nil
+	})
+
+	// Don't watch name if it couldn't be listed at all.
+	if _, found := fileList[name]; !found {
+		return 0, errs
+	}
+
+	if err := w.addFiles(name, fileList); err != nil {
+		return 0, append(errs, err)
+	}
+
+	// Add the name to the names list.
+	w.names[name] = true
+	w.lenient[name] = struct{}{}
+
+	return len(fileList), errs
+}
+
+// AddRecursive adds either a single file or directory recursively to the file list.
+func (w *Watcher) AddRecursive(name string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name, err = w.abs(name)
+	if err != nil {
+		return err
 	}
 
 	fileList, err := w.listRecursive(name)
 	if err != nil {
 		return err
 	}
-	for k, v := range fileList {
-		w.files[k] = v
+	if err := w.addFiles(name, fileList); err != nil {
+		return err
 	}
 
 	// Add the name to the names list.
@@ -301,42 +1943,231 @@ func (w *Watcher) AddRecursive(name string) (err error) {
 }
 
 func (w *Watcher) listRecursive(name string) (map[string]os.FileInfo, error) {
+	return w.walk(w.backend, name, nil)
+}
+
+// walk lists name and everything below it from backend. If onErr isn't nil,
+// errors for individual paths are passed to it and the path is skipped,
+// rather than the whole walk being stopped, unless onErr returns an error.
+func (w *Watcher) walk(backend Backend, name string,
+	onErr func(path string, err error) error) (map[string]os.FileInfo, error) {
 	fileList := make(map[string]os.FileInfo)
 
-	return fileList, filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	// skip stops the walk with err, unless onErr handles it.
+	skip := func(path string, info os.FileInfo, err error) error {
+		if onErr == nil {
+			return err
+		}
+		if err := onErr(path, err); err != nil {
 			return err
 		}
+		if info != nil && info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	// visited holds the directories walked so far when following
+	// symlinks, to tell when a link leads back to one of them.
+	follow := w.follow && isLocal(backend)
+	var visited []os.FileInfo
+
+	scanned := 0
+	var walkFn filepath.WalkFunc
+	walkFn = func(path string, info os.FileInfo, err error) error {
+		w.yield(&scanned)
+		if err != nil {
+			return skip(path, info, err)
+		}
 
 		for _, f := range w.ffh {
-			err := f(info, path)
+			err := w.callHook(f, info, path)
 			if err == ErrSkip {
 				return nil
 			}
 			if err != nil {
-				return err
+				return skip(path, info, err)
 			}
 		}
 
 		// If path is ignored and it's a directory, skip the directory. If it's
 		// ignored and it's a single file, skip the file.
-		_, ignored := w.ignored[path]
-
-		isHidden, err := isHiddenFile(path)
+		ignored, err := w.isIgnored(path)
 		if err != nil {
-			return err
+			return skip(path, info, err)
 		}
 
-		if ignored || (w.ignoreHidden && isHidden) {
+		if ignored || w.isIgnoredByFile(path, info.IsDir()) {
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
 			return nil
 		}
+
+		if w.isBrokenSymlink(backend, info, path) || w.isOwnerFiltered(info) ||
+			w.isBinaryFiltered(path, info) {
+			return nil
+		}
+
 		// Add the path and it's info to the file list.
 		fileList[path] = info
+
+		if follow {
+			return w.followSymlink(backend, path, info, &visited, walkFn)
+		}
+		return nil
+	}
+
+	// List the whole tree in one round trip with SetReadDirPlus.
+	if w.readDirPlus {
+		if plus := newPlusBackend(backend, name); plus != nil {
+			backend = plus
+		}
+	}
+	return fileList, walkBackend(backend, name, walkFn)
+}
+
+// followSymlink records path in visited if it's a directory, or walks its
+// target on backend with walkFn if it's a symlink to a directory that
+// hasn't been visited yet.
+func (w *Watcher) followSymlink(backend Backend, path string, info os.FileInfo,
+	visited *[]os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	// The link's target is watched as the link itself, so a target
+	// that can't be read is just not walked.
+	target, err := os.Stat(path)
+	if err != nil || !target.IsDir() {
+		return nil
+	}
+	if info.IsDir() {
+		*visited = append(*visited, target)
 		return nil
+	}
+	for _, dir := range *visited {
+		if os.SameFile(dir, target) {
+			return nil
+		}
+	}
+
+	// List the target's contents below the link's path, without listing
+	// the link a second time.
+	err = walkBackendDir(backend, path, target, func(p string, info os.FileInfo, err error) error {
+		if p == path {
+			if err != nil {
+				return walkFn(p, info, err)
+			}
+			*visited = append(*visited, target)
+			return nil
+		}
+		return walkFn(p, info, err)
 	})
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// Refresh stats the watched file or directory path again and updates the
+// watcher's record of it, so that the next watching cycle doesn't report any
+// changes that were already made to it, such as by the program itself. A
+// path that no longer exists stops being watched without a Remove event.
+// Refresh doesn't list the contents of a directory.
+func (w *Watcher) Refresh(path string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	path, err = w.abs(path)
+	if err != nil {
+		return err
+	}
+
+	if _, found := w.files[path]; !found {
+		return ErrNotWatched
+	}
+
+	// Roots are listed following symlinks and everything else isn't.
+	var info os.FileInfo
+	if _, root := w.names[path]; root {
+		info, err = w.backend.Stat(path)
+	} else {
+		info, err = w.backend.Lstat(path)
+	}
+	if os.IsNotExist(err) {
+		w.deleteFile(path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	w.setFile(path, info)
+	return nil
+}
+
+// Changes scans the watched files once and returns the events for the
+// changes made since the previous call to Changes, or since the files were
+// added, such as for a consumer that polls for changes itself. It doesn't
+// need the watcher to be started, and shouldn't be called while it's
+// running. The events are filtered like those sent on the Event channel,
+// but aren't sent on it or counted. The errors found while scanning are
+// returned rather than sent on the Error channel. If the scan timed out,
+// there are no events and the errors include ErrScanTimeout.
+func (w *Watcher) Changes() ([]Event, []error) {
+	var errs []error
+	report := func(err error) {
+		errs = append(errs, err)
+	}
+
+	fileList := w.scanFiles(report)
+	if fileList == nil {
+		return nil, errs
+	}
+	return w.applyScan(fileList, report, true), errs
+}
+
+// applyScan compares fileList to the watched files, makes it the watched
+// files and returns the events for the changes that pass the filters,
+// passing any errors to report. The locks set with SetLockMonitoring are
+// read from the filesystem rather than fileList, so they're only polled if
+// locks is true.
+func (w *Watcher) applyScan(fileList map[string]os.FileInfo, report func(error), locks bool) []Event {
+	var events []Event
+	send := func(e Event) bool {
+		events = append(events, e)
+		return true
+	}
+	w.pollEvents(fileList, send)
+	w.pollChildCounts(fileList, send)
+	w.pollTotalSizes(fileList, send)
+	if locks {
+		w.pollLocks(fileList, send, report)
+	}
+
+	w.mu.Lock()
+	filter := w.opFilters()
+	w.mu.Unlock()
+
+	allowed := events[:0]
+	for _, e := range events {
+		if !w.opAllowed(filter, e) {
+			continue
+		}
+		if e.FileInfo != nil {
+			e.Age = time.Since(e.ModTime())
+		}
+		allowed = append(allowed, e)
+	}
+	events = allowed
+
+	w.mu.Lock()
+	w.replaceFiles(fileList)
+	w.since = time.Time{}
+	w.mu.Unlock()
+
+	return events
 }
 
 // Remove removes either a single file or directory from the file's list.
@@ -344,13 +2175,19 @@ func (w *Watcher) Remove(name string) (err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	name, err = filepath.Abs(name)
+	name, err = w.abs(name)
 	if err != nil {
 		return err
 	}
 
 	// Remove the name from w's names list.
 	delete(w.names, name)
+	delete(w.lenient, name)
+	delete(w.rootOps, name)
+	delete(w.priorities, name)
+	delete(w.contexts, name)
+	delete(w.groups, name)
+	delete(w.suspendedRoots, name)
 
 	// If name is a single file, remove it and return.
 	info, found := w.files[name]
@@ -358,17 +2195,17 @@ func (w *Watcher) Remove(name string) (err error) {
 		return nil // Doesn't exist, just return.
 	}
 	if !info.IsDir() {
-		delete(w.files, name)
+		w.deleteFile(name)
 		return nil
 	}
 
 	// Delete the actual directory from w.files
-	delete(w.files, name)
+	w.deleteFile(name)
 
 	// If it's a directory, delete all of it's contents from w.files.
 	for path := range w.files {
 		if filepath.Dir(path) == name {
-			delete(w.files, path)
+			w.deleteFile(path)
 		}
 	}
 	return nil
@@ -380,32 +2217,43 @@ func (w *Watcher) RemoveRecursive(name string) (err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	name, err = filepath.Abs(name)
+	name, err = w.abs(name)
 	if err != nil {
 		return err
 	}
+	w.removeRecursive(name)
+	return nil
+}
 
+// removeRecursive removes the absolute path name and everything below it
+// from the file's list. The caller must hold w.mu.
+func (w *Watcher) removeRecursive(name string) {
 	// Remove the name from w's names list.
 	delete(w.names, name)
+	delete(w.lenient, name)
+	delete(w.rootOps, name)
+	delete(w.priorities, name)
+	delete(w.contexts, name)
+	delete(w.groups, name)
+	delete(w.suspendedRoots, name)
 
 	// If name is a single file, remove it and return.
 	info, found := w.files[name]
 	if !found {
-		return nil // Doesn't exist, just return.
+		return // Doesn't exist, just return.
 	}
 	if !info.IsDir() {
-		delete(w.files, name)
-		return nil
+		w.deleteFile(name)
+		return
 	}
 
 	// If it's a directory, delete all of it's contents recursively
 	// from w.files.
 	for path := range w.files {
 		if strings.HasPrefix(path, name) {
-			delete(w.files, path)
+			w.deleteFile(path)
 		}
 	}
-	return nil
 }
 
 // Ignore adds paths that should be ignored.
@@ -413,7 +2261,9 @@ func (w *Watcher) RemoveRecursive(name string) (err error) {
 // For files that are already added, Ignore removes them.
 func (w *Watcher) Ignore(paths ...string) (err error) {
 	for _, path := range paths {
-		path, err = filepath.Abs(path)
+		w.mu.Lock()
+		path, err = w.abs(path)
+		w.mu.Unlock()
 		if err != nil {
 			return err
 		}
@@ -421,13 +2271,104 @@ func (w *Watcher) Ignore(paths ...string) (err error) {
 		if err := w.RemoveRecursive(path); err != nil {
 			return err
 		}
-		w.mu.Lock()
-		w.ignored[path] = struct{}{}
-		w.mu.Unlock()
+		w.mu.Lock()
+		w.ignored[path] = struct{}{}
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+// IgnoreDoubleStar adds doublestar patterns for paths that should be ignored.
+//
+// Patterns use the same syntax as filepath.Match with the addition of **,
+// which matches any number of directories, so **/node_modules/** ignores
+// node_modules directories at any depth. Patterns are matched against full
+// paths using forward slashes. A pattern that doesn't start with a / is
+// matched at any depth, as though it started with **/.
+//
+// For files that are already added, IgnoreDoubleStar removes them.
+func (w *Watcher) IgnoreDoubleStar(patterns ...string) error {
+	for _, pattern := range patterns {
+		if err := validateDoubleStar(pattern); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.ignoredGlobs = append(w.ignoredGlobs, patterns...)
+
+	// Remove any of the files that were already added.
+	for path := range w.files {
+		for dir := path; ; dir = filepath.Dir(dir) {
+			if matchAnyDoubleStar(patterns, dir) {
+				w.deleteFile(path)
+				break
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// IgnoreGlob adds shell patterns, in the syntax of filepath.Match, for
+// paths that should be ignored, such as IgnoreGlob("*.tmp", "build/*").
+//
+// A path is ignored if a pattern that starts with a separator matches its
+// full path, or if a relative pattern matches the path's trailing elements,
+// so *.tmp is matched against the path's base name and build/* against its
+// last two elements. Patterns that contain ** are matched in the same way
+// as with IgnoreDoubleStar.
+//
+// For files that are already added, IgnoreGlob removes them.
+func (w *Watcher) IgnoreGlob(patterns ...string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.ignoreGlobs = append(w.ignoreGlobs, patterns...)
+
+	// Remove any of the files that were already added.
+	for path := range w.files {
+		for dir := path; ; dir = filepath.Dir(dir) {
+			if matchAnyGlob(patterns, dir) {
+				w.deleteFile(path)
+				break
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
 	}
 	return nil
 }
 
+// isIgnored reports whether path is on the ignored list, matches an ignored
+// pattern or is a hidden file while hidden files are being ignored.
+func (w *Watcher) isIgnored(path string) (bool, error) {
+	if _, ignored := w.ignored[path]; ignored {
+		return true, nil
+	}
+	if w.ignoredMany != nil && w.ignoredMany.contains(path) {
+		return true, nil
+	}
+	if matchAnyDoubleStar(w.ignoredGlobs, path) || matchAnyGlob(w.ignoreGlobs, path) {
+		return true, nil
+	}
+	if !w.ignoreHidden {
+		return false, nil
+	}
+	return isHiddenFile(path)
+}
+
 // WatchedFiles returns a map of files added to a Watcher.
 func (w *Watcher) WatchedFiles() map[string]os.FileInfo {
 	w.mu.Lock()
@@ -435,12 +2376,93 @@ func (w *Watcher) WatchedFiles() map[string]os.FileInfo {
 
 	files := make(map[string]os.FileInfo)
 	for k, v := range w.files {
+		if w.isRootSelf(k, v) {
+			continue
+		}
 		files[k] = v
 	}
 
 	return files
 }
 
+// Diff returns the events that would transform other's watched files into
+// w's watched files, comparing the FileInfo that each watcher stored for
+// its files when they were last listed, such as to check the state of a
+// mirror. Create events are returned first, with parents before their
+// children, then Write and Chmod events sorted by path, and then Remove
+// events, with children before their parents. Renames aren't detected.
+func (w *Watcher) Diff(other *Watcher) []Event {
+	if other == w {
+		return nil
+	}
+
+	other.mu.Lock()
+	source := make(map[string]os.FileInfo, len(other.files))
+	for path, info := range other.files {
+		source[path] = info
+	}
+	other.mu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.diffFiles(source)
+}
+
+// diffFiles returns the events that would transform source into w's
+// watched files, in the order described by Diff. The caller must hold w.mu.
+func (w *Watcher) diffFiles(source map[string]os.FileInfo) []Event {
+	return w.diffStates(source, w.files)
+}
+
+// diffStates returns the events that would transform source into current,
+// in the order described by Diff. The caller must hold w.mu.
+func (w *Watcher) diffStates(source, current map[string]os.FileInfo) []Event {
+	var creates, changes []string
+	for path, info := range current {
+		oldInfo, found := source[path]
+		if !found {
+			creates = append(creates, path)
+			continue
+		}
+		if oldInfo.ModTime() != info.ModTime() || oldInfo.Size() != info.Size() ||
+			oldInfo.Mode() != info.Mode() {
+			changes = append(changes, path)
+		}
+	}
+	var removes []string
+	for path := range source {
+		if _, found := current[path]; !found {
+			removes = append(removes, path)
+		}
+	}
+	sort.Sort(byDepth(creates))
+	sort.Strings(changes)
+	sort.Sort(sort.Reverse(byDepth(removes)))
+
+	var events []Event
+	for _, path := range creates {
+		events = append(events, w.newEvent(Create, path, "", current[path]))
+	}
+	for _, path := range changes {
+		oldInfo, info := source[path], current[path]
+		if oldInfo.ModTime() != info.ModTime() || oldInfo.Size() != info.Size() {
+			e := w.newEvent(Write, path, path, info)
+			e.OldFileInfo = oldInfo
+			events = append(events, e)
+		}
+		if oldInfo.Mode() != info.Mode() {
+			e := w.newEvent(Chmod, path, path, info)
+			e.OldFileInfo = oldInfo
+			events = append(events, e)
+		}
+	}
+	for _, path := range removes {
+		events = append(events, w.newEvent(Remove, path, path, source[path]))
+	}
+	return events
+}
+
 // fileInfo is an implementation of os.FileInfo that can be used
 // as a mocked os.FileInfo when triggering an event when the specified
 // os.FileInfo is nil.
@@ -472,52 +2494,362 @@ func (fs *fileInfo) Sys() interface{} {
 	return fs.sys
 }
 
+// SetTriggerDefaults sets the name and mode of the file info that's used for
+// events triggered by TriggerEvent with a nil file. The default name is
+// "triggered event" with a mode of 0.
+func (w *Watcher) SetTriggerDefaults(name string, mode os.FileMode) {
+	w.mu.Lock()
+	w.triggerName = name
+	w.triggerMode = mode
+	w.mu.Unlock()
+}
+
 // TriggerEvent is a method that can be used to trigger an event, separate to
 // the file watching process.
 func (w *Watcher) TriggerEvent(eventType Op, file os.FileInfo) {
 	w.Wait()
+	w.triggerEvent(context.Background(), eventType, file)
+}
+
+// TriggerEventContext triggers an event like TriggerEvent, but gives up and
+// returns ctx.Err() if ctx is done before the watcher has started and the
+// event has been received from the Event channel.
+func (w *Watcher) TriggerEventContext(ctx context.Context, eventType Op, file os.FileInfo) error {
+	select {
+	case <-w.started:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return w.triggerEvent(ctx, eventType, file)
+}
+
+// triggerEvent sends the triggered event, using the trigger defaults if
+// file is nil.
+func (w *Watcher) triggerEvent(ctx context.Context, eventType Op, file os.FileInfo) error {
 	if file == nil {
-		file = &fileInfo{name: "triggered event", modTime: time.Now()}
+		w.mu.Lock()
+		file = &fileInfo{name: w.triggerName, mode: w.triggerMode, modTime: time.Now()}
+		w.mu.Unlock()
+	}
+	return w.sendEventContext(ctx, Event{Op: eventType, Path: "-", FileInfo: file})
+}
+
+// opFilter is a copy of the op filters of a watcher, to filter events with
+// without holding w.mu.
+type opFilter struct {
+	noRootSelf bool
+	filters    []EventFilterFunc
+	ops        map[Op]struct{}
+	rootOps    map[string]map[Op]struct{}
+}
+
+// opFilters returns a copy of w's op filters. The caller must hold w.mu.
+func (w *Watcher) opFilters() opFilter {
+	f := opFilter{
+		noRootSelf: w.noRootSelf,
+		filters:    append([]EventFilterFunc(nil), w.eventFilters...),
+		ops:        w.ops,
+		rootOps:    make(map[string]map[Op]struct{}, len(w.rootOps)),
+	}
+	// The filters of each root are replaced rather than changed, so
+	// they don't need to be copied.
+	for root, ops := range w.rootOps {
+		f.rootOps[root] = ops
+	}
+	return f
+}
+
+// opAllowed reports whether e's Op passes the filter for its root, set with
+// AddWithOps, or otherwise the filter set with FilterOps. Events for the
+// directory roots themselves are filtered out by SetRootSelfEvents, and
+// events that fail a filter added with AddEventFilter are filtered out too.
+func (w *Watcher) opAllowed(filter opFilter, e Event) bool {
+	if filter.noRootSelf && e.Path == e.Root && e.FileInfo != nil && e.IsDir() {
+		return false
+	}
+	for _, f := range filter.filters {
+		if !f(e) {
+			return false
+		}
+	}
+	ops, found := filter.rootOps[e.Root]
+	if !found {
+		ops = filter.ops
+		if len(ops) == 0 {
+			return true
+		}
+	}
+	_, found = ops[e.Op]
+	return found
+}
+
+// sendEvent sends e on the Event channel and then passes it on to the
+// webhook. sendEvent is called while pollEvents holds w.mu, so it must not
+// try to lock it.
+func (w *Watcher) sendEvent(e Event) {
+	w.sendEventContext(context.Background(), e)
+}
+
+// sendEventContext sends e like sendEvent, unless ctx is done first.
+func (w *Watcher) sendEventContext(ctx context.Context, e Event) error {
+	w.uniqueMu.Lock()
+	unique := w.uniqueOps
+	w.uniqueMu.Unlock()
+
+	if unique {
+		// The op is only marked as sent once the event has been received,
+		// since it can still be dropped below.
+		select {
+		case w.uniqueSending <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-w.uniqueSending }()
+
+		w.uniqueMu.Lock()
+		sent := w.uniqueSent[e.Op]
+		w.uniqueMu.Unlock()
+		if sent {
+			return nil
+		}
+	}
+
+	e, send := w.checkFlapping(e)
+	if !send {
+		return nil
+	}
+
+	w.rewriteMu.Lock()
+	hooks := w.rewriteHooks
+	w.rewriteMu.Unlock()
+	if len(hooks) > 0 {
+		e.Path = rewritePath(hooks, e.Path)
+		e.OldPath = rewritePath(hooks, e.OldPath)
+		if e.Paths != nil {
+			paths := make([]string, len(e.Paths))
+			for i, path := range e.Paths {
+				paths[i] = rewritePath(hooks, path)
+			}
+			e.Paths = paths
+		}
+	}
+
+	if e.FileInfo != nil {
+		e.Age = time.Since(e.ModTime())
+	}
+	select {
+	case w.Event <- e:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if unique {
+		w.uniqueMu.Lock()
+		w.uniqueSent[e.Op] = true
+		w.uniqueMu.Unlock()
+	}
+
+	if count, found := w.counts[e.Op]; found {
+		atomic.AddUint64(count, 1)
+	}
+
+	w.hotMu.Lock()
+	if e.Op == Summary {
+		for _, path := range e.Paths {
+			w.countHot(path)
+		}
+	} else if e.Path != "-" {
+		w.countHot(e.Path)
+	}
+	w.hotMu.Unlock()
+
+	w.recordEvent(e)
+	w.journalEvent(e)
+
+	select {
+	case w.webhook <- e:
+	default:
+		// Never block the watching process on a slow webhook.
+		atomic.AddUint64(&w.webhookDropped, 1)
+	}
+	return nil
+}
+
+// SetWarningsChannel sets whether errors with a Severity of Warning, such as
+// a WalkError for a single file that can't be listed, are sent on the
+// Warnings channel instead of the Error channel, so that the Error channel
+// only receives fatal errors. Both channels must be received from while it's
+// enabled. SetWarningsChannel must be called before Start.
+func (w *Watcher) SetWarningsChannel(enabled bool) {
+	w.warningsOn = enabled
+}
+
+// warnings returns the channel that warnings are sent on.
+func (w *Watcher) warnings() chan error {
+	if w.warningsOn {
+		return w.Warnings
 	}
-	w.Event <- Event{Op: eventType, Path: "-", FileInfo: file}
+	return w.Error
 }
 
+// retrieveFileList lists all of the watched files, sending any errors found
+// along the way on the Error or Warnings channel. It returns nil if the scan
+// timed out.
 func (w *Watcher) retrieveFileList() map[string]os.FileInfo {
+	return w.scanFiles(w.sendError)
+}
+
+// sendError sends err on the Warnings channel if it's a warning and
+// SetWarningsChannel is enabled, or on the Error channel otherwise.
+func (w *Watcher) sendError(err error) {
+	if werr, ok := err.(*WatcherError); ok && werr.Severity == Warning {
+		w.warnings() <- err
+		return
+	}
+	w.Error <- err
+}
+
+// scanFiles lists all of the watched files like retrieveFileList, but
+// passes any errors to report instead of sending them.
+func (w *Watcher) scanFiles(report func(error)) map[string]os.FileInfo {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	// The scan lists files through its own backend rather than replacing
+	// w.backend, since w.mu is released part way through the scan.
+	backend := w.backend
+
+	// List the local filesystem relative to directory fds.
+	if _, local := backend.(osBackend); local && w.dirFDCaching {
+		if fds := newDirFDBackend(); fds != nil {
+			defer fds.close()
+			backend = fds
+		}
+	}
+
+	// Only read the directories whose mod times have changed, unless it's
+	// time for a full scan.
+	if w.fastScan() && !isPresenceOnly(backend) {
+		backend = newModTimeBackend(backend, w.files)
+	}
+
+	// Abandon the scan if it takes longer than the scan timeout.
+	var scan *timeoutBackend
+	if w.scanTimeout > 0 {
+		scan = newTimeoutBackend(backend, w.scanTimeout)
+		defer scan.stop()
+		backend = scan
+	}
+
+	w.reloadIgnoreFiles()
+
+	// Roots that were deleted before the first scan are removed silently
+	// with SetQuietStart. Every scan counts, not only those of the Start
+	// loop, so that Changes and Resync report later deletions.
+	quiet := w.quietStart && !w.scanned
+	w.scanned = true
+
 	fileList := make(map[string]os.FileInfo)
 
 	var list map[string]os.FileInfo
 	var err error
 
-	for name, recursive := range w.names {
+	// Directories that can't be read this cycle.
+	unreadable := make(map[string]bool)
+
+	// Paths below the roots that couldn't be listed this cycle, which
+	// keep their last known info.
+	var walkErrs []*WatcherError
+	skipped := make(map[string]bool)
+
+	// Paths that couldn't be listed this cycle with
+	// SetStatFailureThreshold, and how many cycles in a row they've failed.
+	failures := make(map[string]int)
+
+	for _, name := range w.rootsByPriority() {
+		if scan != nil && scan.timedOut {
+			break
+		}
+		recursive, found := w.names[name]
+		if !found {
+			// The root was removed while the lock was released.
+			continue
+		}
+		if w.suspendedRoots[name] {
+			continue
+		}
 		if recursive {
-			list, err = w.listRecursive(name)
-			if err != nil {
+			_, lenient := w.lenient[name]
+			list, err = w.walk(backend, name, func(path string, err error) error {
+				if err == ErrScanTimeout {
+					return err
+				}
+				if w.isUnreadableDir(path, err) {
+					unreadable[path] = true
+					return nil
+				}
+				// Only stop if name itself can't be listed.
+				if path == name {
+					return err
+				}
+				// A path that was removed part way through the
+				// scan is reported as removed.
+				if os.IsNotExist(err) {
+					return nil
+				}
+				if lenient {
+					return nil
+				}
+				if w.statThreshold > 0 {
+					if w.retryStat(path, failures) {
+						skipped[path] = true
+					}
+					return nil
+				}
+				skipped[path] = true
+				walkErrs = append(walkErrs, &WatcherError{Warning, name, &WalkError{path, err}})
+				return nil
+			})
+			if err != nil && err != ErrScanTimeout {
 				if os.IsNotExist(err) {
 					w.mu.Unlock()
-					if name == err.(*os.PathError).Path {
-						w.Error <- ErrWatchedFileDeleted
+					if perr, ok := err.(*os.PathError); ok && perr.Path == name {
+						if !quiet {
+							report(&WatcherError{Fatal, name, ErrWatchedFileDeleted})
+						}
 						w.RemoveRecursive(name)
 					}
 					w.mu.Lock()
+				} else if w.statThreshold > 0 {
+					if w.retryStat(name, failures) {
+						skipped[name] = true
+					}
 				} else {
-					w.Error <- err
+					report(&WatcherError{Warning, name, err})
 				}
 			}
 		} else {
-			list, err = w.list(name)
-			if err != nil {
+			list, err = w.list(backend, name)
+			if w.isUnreadableDir(name, err) {
+				list, err = make(map[string]os.FileInfo), nil
+				unreadable[name] = true
+			}
+			if err != nil && err != ErrScanTimeout {
 				if os.IsNotExist(err) {
 					w.mu.Unlock()
-					if name == err.(*os.PathError).Path {
-						w.Error <- ErrWatchedFileDeleted
+					if perr, ok := err.(*os.PathError); ok && perr.Path == name {
+						if !quiet {
+							report(&WatcherError{Fatal, name, ErrWatchedFileDeleted})
+						}
 						w.Remove(name)
 					}
 					w.mu.Lock()
+				} else if w.statThreshold > 0 {
+					if w.retryStat(name, failures) {
+						skipped[name] = true
+					}
 				} else {
-					w.Error <- err
+					report(&WatcherError{Warning, name, err})
 				}
 			}
 		}
@@ -527,9 +2859,186 @@ func (w *Watcher) retrieveFileList() map[string]os.FileInfo {
 		}
 	}
 
+	// Keep the last known files of the suspended roots.
+	if len(w.suspendedRoots) > 0 {
+		for path, info := range w.files {
+			if _, listed := fileList[path]; !listed && w.suspendedRoots[w.rootOf(path)] {
+				fileList[path] = info
+			}
+		}
+	}
+
+	// Add the files that match the glob sets.
+	for k, v := range w.listGlobs(backend, w.globs) {
+		fileList[k] = v
+	}
+
+	w.pruneBinaryChecks()
+
+	if scan != nil && scan.timedOut {
+		report(&WatcherError{Warning, "", ErrScanTimeout})
+		return nil
+	}
+
+	// Add the entries of the watched archives.
+	w.listArchives(fileList, report)
+
+	// Add the files that the watched processes have open for writing.
+	w.listProcessFiles(fileList, report)
+
+	// Keep the last known contents of unreadable directories, and warn
+	// about directories that have just become unreadable.
+	for dir := range unreadable {
+		prefix := dir + string(filepath.Separator)
+		for path, info := range w.files {
+			if path == dir || strings.HasPrefix(path, prefix) {
+				fileList[path] = info
+			}
+		}
+		if !w.unreadable[dir] {
+			report(&WatcherError{Warning, dir, ErrDirUnreadable})
+		}
+	}
+	w.unreadable = unreadable
+
+	// Keep the last known info of the paths that couldn't be listed, and
+	// warn about them.
+	for path := range skipped {
+		prefix := path + string(filepath.Separator)
+		for p, info := range w.files {
+			if p == path || strings.HasPrefix(p, prefix) {
+				fileList[p] = info
+			}
+		}
+	}
+	for _, err := range walkErrs {
+		report(err)
+	}
+	if w.statThreshold > 0 {
+		w.statFailures = failures
+	}
+
+	// Leave out the least important files if there are too many.
+	w.enforceMemoryBudget(fileList, report)
+
+	// Report any filter hooks that panicked.
+	for _, err := range w.hookPanics {
+		report(err)
+	}
+	w.hookPanics = nil
+
 	return fileList
 }
 
+// isUnreadableDir reports whether err is a permission error from listing
+// the already watched directory path. The caller must hold w.mu.
+func (w *Watcher) isUnreadableDir(path string, err error) bool {
+	if err == nil || !os.IsPermission(err) {
+		return false
+	}
+	info, found := w.files[path]
+	return found && info.IsDir()
+}
+
+// checkInodes sends ErrLowInodes on the Error channel for every watched root
+// whose filesystem has dropped below the free inode threshold since the
+// previous check.
+func (w *Watcher) checkInodes() {
+	w.mu.Lock()
+	threshold := w.inodeThreshold
+	names := make([]string, 0, len(w.names))
+	for name := range w.names {
+		names = append(names, name)
+	}
+	w.mu.Unlock()
+
+	if threshold == 0 {
+		return
+	}
+
+	for _, name := range names {
+		free, err := freeInodes(name)
+		if err != nil {
+			// Deleted roots are reported by retrieveFileList.
+			continue
+		}
+		low := free < threshold
+
+		w.mu.Lock()
+		wasLow := w.lowInodes[name]
+		w.lowInodes[name] = low
+		w.mu.Unlock()
+
+		if low && !wasLow {
+			w.warnings() <- &WatcherError{Warning, name, ErrLowInodes}
+		}
+	}
+}
+
+// SetQuietStart sets whether the first scan after Start silently removes the
+// watched roots that no longer exist, such as the roots of a restored config
+// whose directories have since been deleted, instead of sending an
+// ErrWatchedFileDeleted error for each of them. Roots that are deleted while
+// the watcher is running are still reported.
+func (w *Watcher) SetQuietStart(enabled bool) {
+	w.mu.Lock()
+	w.quietStart = enabled
+	w.mu.Unlock()
+}
+
+// SetManualTicks sets the watcher to only scan for changes when Tick is
+// called, instead of on a timer, which gives tests full control over when
+// events happen. The duration passed to Start is ignored in manual mode.
+// SetManualTicks must be called before Start.
+func (w *Watcher) SetManualTicks(enabled bool) {
+	w.mu.Lock()
+	w.manualTicks = enabled
+	w.mu.Unlock()
+}
+
+// SetTriggerChannel sets a channel that starts a scan straight away every
+// time a value is received on it, as well as the scans started by the
+// timer or by Tick. This lets a hint from somewhere else, such as a message
+// queue saying that something might have changed, be picked up without
+// waiting for the next poll. The events of a triggered scan have a Source
+// of SourceTrigger. Closing the channel stops it triggering scans.
+// SetTriggerChannel must be called before Start.
+func (w *Watcher) SetTriggerChannel(trigger <-chan struct{}) {
+	w.mu.Lock()
+	w.trigger = trigger
+	w.mu.Unlock()
+}
+
+// Tick runs a single watching cycle for a watcher in manual mode, set with
+// SetManualTicks, and returns once all of the cycle's events have been sent
+// on the Event channel. Events must be received while Tick is running.
+func (w *Watcher) Tick() error {
+	w.mu.Lock()
+	manual, running := w.manualTicks, w.running
+	w.mu.Unlock()
+
+	if !manual {
+		return ErrNotManualTicks
+	}
+	if !running {
+		return ErrWatcherNotRunning
+	}
+
+	done := make(chan struct{})
+	select {
+	case w.ticks <- done:
+	case <-w.finished:
+		return ErrWatcherNotRunning
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-w.finished:
+		return ErrWatcherNotRunning
+	}
+}
+
 // Start begins the polling cycle which repeats every specified
 // duration until Close is called.
 func (w *Watcher) Start(d time.Duration) error {
@@ -538,79 +3047,465 @@ func (w *Watcher) Start(d time.Duration) error {
 		return ErrDurationTooShort
 	}
 
-	// Make sure the Watcher is not already running.
-	w.mu.Lock()
-	if w.running {
-		w.mu.Unlock()
-		return ErrWatcherRunning
+	return w.start(d, "", func() time.Duration { return d })
+}
+
+// StartSchedule begins the polling cycle like Start, but instead of polling
+// every fixed duration, it polls at the times described by the cron
+// expression spec until Close is called.
+//
+// spec has 5 space separated fields for the minute, hour, day of month,
+// month and day of week, or 6 fields with an extra leading field for the
+// second. Each field can be a *, a number, a range such as 1-5, a step such
+// as */15 or 0-30/10, or a comma separated list of any of them. For example,
+// "0 9-17 * * 1-5" polls at the top of every hour during business hours.
+func (w *Watcher) StartSchedule(spec string) error {
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return err
+	}
+
+	return w.start(0, spec, func() time.Duration {
+		now := time.Now()
+		return sched.next(now).Sub(now)
+	})
+}
+
+// start runs the polling cycle every interval, or on the schedule spec if
+// it's set, waiting for the duration returned by wait between cycles. With a
+// schedule, it also waits before the first cycle.
+func (w *Watcher) start(interval time.Duration, spec string, wait func() time.Duration) error {
+	// Make sure the Watcher is not already running.
+	w.mu.Lock()
+	if w.running {
+		w.mu.Unlock()
+		return ErrWatcherRunning
+	}
+	w.running = true
+	w.interval = interval
+	w.schedule = spec
+	w.scans, w.lastScan, w.totalScan = 0, 0, 0
+	w.scanned = false
+	manual, trigger := w.manualTicks, w.trigger
+
+	// With SetAdaptivePolling, the interval doubles after every cycle
+	// that finds no changes, up to pollMax, and drops back to pollMin
+	// after one that does.
+	pollMin, pollMax := w.pollMin, w.pollMax
+	adaptive := pollMin > 0 && spec == "" && !manual
+	w.pollCurrent = interval
+	if manual {
+		w.pollCurrent = 0
+	}
+	if adaptive {
+		w.pollCurrent = pollMin
+		wait = func() time.Duration {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			return w.pollCurrent
+		}
+	}
+	w.mu.Unlock()
+
+	// Forget the paths' events from any earlier run.
+	w.flapMu.Lock()
+	w.flaps = make(map[string]*flapState)
+	w.flapMu.Unlock()
+	w.hotMu.Lock()
+	w.hot = make(map[string]uint64)
+	w.hotMu.Unlock()
+
+	// Start sending events to the webhook.
+	w.spawn(w.runWebhook)
+
+	// Unblock w.Wait().
+	w.wg.Done()
+	close(w.started)
+
+	// Send the watched files as they are before the first scan.
+	for _, e := range w.initialEvents() {
+		w.sendEvent(e)
+	}
+
+	// ticked is closed once the cycle requested by Tick has finished.
+	var ticked chan struct{}
+
+	// triggered is set when the current cycle was started by trigger.
+	var triggered bool
+
+	// debounced holds the directories with changes that haven't settled
+	// yet with SetDirDebounce.
+	debounced := make(map[string]*debounce)
+
+	// pending holds the events held back by SetDebounce, by path.
+	pending := make(map[string]*pendingEvent)
+
+	// next waits until the next cycle should start, either for the
+	// duration returned by wait or for a call to Tick in manual mode, or
+	// until a value is received on trigger. It returns false if the
+	// watcher is closed while waiting.
+	next := func() bool {
+		if ticked != nil {
+			close(ticked)
+			ticked = nil
+		}
+		triggered = false
+
+		// A nil timer never fires, so in manual mode only Tick and
+		// trigger start a cycle.
+		var timer <-chan time.Time
+		if !manual {
+			timer = time.After(wait())
+		}
+		for {
+			select {
+			case <-w.close:
+				return false
+			case ticked = <-w.ticks:
+				return true
+			case <-timer:
+				return true
+			case _, ok := <-trigger:
+				if !ok {
+					// A closed trigger would always be ready,
+					// so stop receiving from it.
+					trigger = nil
+					continue
+				}
+				triggered = true
+				return true
+			}
+		}
+	}
+
+	if spec != "" || manual {
+		if !next() {
+			w.shutdown()
+			return nil
+		}
 	}
-	w.running = true
-	w.mu.Unlock()
-
-	// Unblock w.Wait().
-	w.wg.Done()
 
 	for {
+		// Don't scan for any changes while the watcher is suspended
+		// or paused by a sentinel file.
+		w.mu.Lock()
+		suspended, sentinel := w.suspended, w.sentinel
+		w.mu.Unlock()
+		if !suspended && sentinel != "" {
+			_, err := os.Stat(sentinel)
+			suspended = err == nil
+		}
+		if suspended {
+			if !next() {
+				w.shutdown()
+				return nil
+			}
+			continue
+		}
+
+		// The events of a cycle requested with Tick are manual.
+		source := SourceScan
+		switch {
+		case ticked != nil:
+			source = SourceManual
+		case triggered:
+			source = SourceTrigger
+		}
+		send := func(e Event) {
+			e.Source = source
+			w.sendEvent(e)
+		}
+
 		// done lets the inner polling cycle loop know when the
-		// current cycle's method has finished executing.
-		done := make(chan struct{})
+		// current cycle's method has finished executing. It's buffered
+		// so the polling goroutine can exit after its cycle is canceled.
+		done := make(chan struct{}, 1)
 
 		// Any events that are found are first piped to evt before
 		// being sent to the main Event channel.
 		evt := make(chan Event)
 
+		// Warn about any roots that are running out of inodes.
+		w.checkInodes()
+
 		// Retrieve the file list for all watched file's and dirs.
+		scanStart := time.Now()
 		fileList := w.retrieveFileList()
+		w.mu.Lock()
+		w.scans++
+		w.lastScan = time.Since(scanStart)
+		w.totalScan += w.lastScan
+		w.mu.Unlock()
+		if fileList == nil {
+			// The scan timed out, so try again next cycle.
+			if !next() {
+				w.shutdown()
+				return nil
+			}
+			continue
+		}
+		w.recordScan(fileList)
+
+		w.mu.Lock()
+		var priorities map[string]int
+		if len(w.priorities) > 0 {
+			priorities = make(map[string]int)
+			for root, priority := range w.priorities {
+				priorities[root] = priority
+			}
+		}
+		// Filter the cycle's events without holding w.mu, since roots
+		// can be added and removed while it runs. Take the priorities,
+		// filters and options before polling, since pollEvents holds
+		// w.mu while it waits for the loop below to receive an event.
+		filter := w.opFilters()
+		summary := w.summary
+		dirDebounce, edgeMode := w.dirDebounce, w.edgeMode
+		debounceWindow := w.debounce
+		w.mu.Unlock()
 
 		// cancel can be used to cancel the current event polling function.
 		cancel := make(chan struct{})
 
 		// Look for events.
-		go func() {
-			w.pollEvents(fileList, evt, cancel)
+		w.spawn(func() {
+			send := sendTo(evt, cancel)
+			w.pollEvents(fileList, send)
+			w.pollChildCounts(fileList, send)
+			w.pollTotalSizes(fileList, send)
+			w.pollLocks(fileList, send, w.sendError)
 			done <- struct{}{}
-		}()
+		})
 
 		// numEvents holds the number of events for the current cycle.
 		numEvents := 0
 
+		// paths holds the changed paths for the cycle's Summary event.
+		var paths []string
+
+		// queued holds the cycle's events while root priorities are
+		// set, to send them in order of priority once it's finished.
+		var queued []Event
+
+		// leading holds the debounced directories that first changed
+		// this cycle, to report on the leading edge.
+		var leading []string
+
+		// active is set once the cycle finds any events.
+		active := false
+
 	inner:
 		for {
 			select {
 			case <-w.close:
 				close(cancel)
-				close(w.Closed)
+				<-done // Wait for the polling goroutine to exit.
+				w.shutdown()
 				return nil
 			case event := <-evt:
-				if len(w.ops) > 0 { // Filter Ops.
-					_, found := w.ops[event.Op]
+				if !w.opAllowed(filter, event) { // Filter Ops.
+					continue
+				}
+				active = true
+				if summary {
+					if event.Op == Rename || event.Op == Move {
+						paths = append(paths, event.OldPath)
+					}
+					paths = append(paths, event.Path)
+					continue
+				}
+				if dirDebounce > 0 {
+					dir := filepath.Dir(event.Path)
+					if event.Op == Write && event.IsDir() {
+						dir = event.Path
+					}
+					d, found := debounced[dir]
 					if !found {
-						continue
+						d = &debounce{}
+						debounced[dir] = d
+						if edgeMode&Leading != 0 {
+							leading = append(leading, dir)
+						}
 					}
+					d.changed = time.Now()
+					// The first change was already reported if
+					// it was on the leading edge.
+					d.pending = found || edgeMode&Leading == 0
+					continue
+				}
+				if debounceWindow > 0 {
+					coalesce(pending, event, time.Now().Add(debounceWindow))
+					continue
+				}
+				if priorities != nil {
+					queued = append(queued, event)
+					continue
 				}
 				numEvents++
 				if w.maxEvents > 0 && numEvents > w.maxEvents {
 					close(cancel)
 					break inner
 				}
-				w.Event <- event
+				send(event)
 			case <-done: // Current cycle is finished.
 				break inner
 			}
 		}
 
+		// Send the queued events, highest priority root first.
+		sort.Stable(byRootPriority{queued, priorities})
+		for _, event := range queued {
+			numEvents++
+			if w.maxEvents > 0 && numEvents > w.maxEvents {
+				break
+			}
+			send(event)
+		}
+
+		// Send all of the cycle's changes as a single event.
+		if len(paths) > 0 {
+			sort.Strings(paths)
+			send(Event{
+				Op:       Summary,
+				Path:     "-",
+				FileInfo: &fileInfo{name: "summary", modTime: time.Now()},
+				Paths:    paths,
+			})
+		}
+
+		// Send a single event for each directory that has just started
+		// changing or has settled, depending on the edge mode.
+		w.mu.Lock()
+		var dirEvents []Event
+		dirEvent := func(dir string, changed time.Time) Event {
+			info := fileList[dir]
+			if info == nil {
+				// The directory was removed.
+				info = &fileInfo{name: filepath.Base(dir), modTime: changed, dir: true}
+			}
+			return w.newEvent(Write, dir, dir, info)
+		}
+		for _, dir := range leading {
+			dirEvents = append(dirEvents, dirEvent(dir, debounced[dir].changed))
+		}
+		for dir, d := range debounced {
+			if time.Since(d.changed) < dirDebounce {
+				continue
+			}
+			delete(debounced, dir)
+			if d.pending && edgeMode&Trailing != 0 {
+				dirEvents = append(dirEvents, dirEvent(dir, d.changed))
+			}
+		}
+		w.mu.Unlock()
+		for _, e := range dirEvents {
+			send(e)
+		}
+
+		// Send the debounced events that haven't changed for the window.
+		var settledPaths []string
+		for path, p := range pending {
+			if time.Now().After(p.deadline) {
+				settledPaths = append(settledPaths, path)
+			}
+		}
+		sort.Strings(settledPaths)
+		for _, path := range settledPaths {
+			send(pending[path].event)
+			delete(pending, path)
+		}
+
 		// Update the file's list.
 		w.mu.Lock()
-		w.files = fileList
+		oldCount := len(w.files)
+		w.replaceFiles(fileList)
+		w.since = time.Time{} // Only the first cycle reports older changes.
+		onChange := w.onWatchSetChange
+		changed := watchSetChanged(oldCount, len(fileList), w.watchSetThreshold)
+		if adaptive {
+			switch {
+			case active:
+				w.pollCurrent = pollMin
+			case w.pollCurrent*2 > pollMax:
+				w.pollCurrent = pollMax
+			default:
+				w.pollCurrent *= 2
+			}
+		}
 		w.mu.Unlock()
 
-		// Sleep and then continue to the next loop iteration.
-		time.Sleep(d)
+		// Notify the watch set change callback about large changes.
+		if onChange != nil && changed {
+			if err := callWatchSetChange(onChange, oldCount, len(fileList)); err != nil {
+				select {
+				case <-w.close:
+					w.shutdown()
+					return nil
+				case w.warnings() <- &WatcherError{Warning, "", err}:
+				}
+			}
+		}
+
+		// Wait and then continue to the next loop iteration.
+		if !next() {
+			w.shutdown()
+			return nil
+		}
+	}
+}
+
+// newEvent creates an Event for path and fills in the watched root
+// that path belongs to. w.mu must be held when calling newEvent.
+func (w *Watcher) newEvent(op Op, path, oldPath string, info os.FileInfo) Event {
+	e := Event{Op: op, Path: path, OldPath: oldPath, FileInfo: info}
+	if w.inodeInfo && info != nil {
+		e.Ino, e.Dev, _ = inodeOf(info)
+	}
+	e.Root = w.rootOf(path)
+	e.Context = w.contexts[e.Root]
+	e.Group = w.groups[e.Root]
+	if e.Root != "" && e.Root != path {
+		rel, err := filepath.Rel(e.Root, path)
+		if err == nil {
+			e.Depth = strings.Count(rel, string(filepath.Separator)) + 1
+		}
+	}
+	return e
+}
+
+// rootOf returns the watched file or directory that path belongs to.
+// If path belongs to more than one, the deepest one is returned.
+func (w *Watcher) rootOf(path string) string {
+	var root string
+	for name := range w.names {
+		if len(name) <= len(root) {
+			continue
+		}
+		prefix := name
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		if path == name || strings.HasPrefix(path, prefix) {
+			root = name
+		}
+	}
+	return root
+}
+
+// sendTo returns a function for the poll functions to send events on evt
+// with, which returns false once cancel is closed.
+func sendTo(evt chan<- Event, cancel <-chan struct{}) func(Event) bool {
+	return func(e Event) bool {
+		select {
+		case <-cancel:
+			return false
+		case evt <- e:
+			return true
+		}
 	}
 }
 
-func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
-	cancel chan struct{}) {
+func (w *Watcher) pollEvents(files map[string]os.FileInfo, send func(Event) bool) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -618,33 +3513,148 @@ func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
 	creates := make(map[string]os.FileInfo)
 	removes := make(map[string]os.FileInfo)
 
+	// Store created overlay whiteout files to report them as removes.
+	whiteouts := make(map[string]os.FileInfo)
+
+	// flushHeld sends the event for path held back in held, so it's always
+	// sent before any other events for the same file.
+	flushHeld := func(held map[string]*pendingEvent, path string) bool {
+		pending, found := held[path]
+		if !found {
+			return true
+		}
+		delete(held, path)
+		return send(pending.event)
+	}
+
+	// flush sends any held back create and rename events for path.
+	flush := func(path string) bool {
+		return flushHeld(w.ephemeral, path) && flushHeld(w.renames, path)
+	}
+
 	// Check for removed files.
+	scanned := 0
 	for path, info := range w.files {
+		w.yield(&scanned)
 		if _, found := files[path]; !found {
+			if w.overlay && isWhiteout(path) {
+				continue
+			}
 			removes[path] = info
 		}
 	}
 
 	// Check for created files, writes and chmods.
 	for path, info := range files {
+		w.yield(&scanned)
 		oldInfo, found := w.files[path]
+		if w.overlay && isWhiteout(path) {
+			if !found {
+				whiteouts[path] = info
+			}
+			continue
+		}
 		if !found {
 			// A file was created.
 			creates[path] = info
 			continue
 		}
-		if oldInfo.ModTime() != info.ModTime() {
-			select {
-			case <-cancel:
+		written := (w.significant&FieldModTime != 0 && oldInfo.ModTime() != info.ModTime()) ||
+			(w.significant&FieldSize != 0 && oldInfo.Size() != info.Size())
+		if w.noDirWrites && info.IsDir() {
+			written = false
+		}
+		chmodded := w.significant&FieldMode != 0 && oldInfo.Mode() != info.Mode()
+		if stable, arriving := w.arrivals[path]; arriving {
+			// Only report the file once it has stopped changing.
+			stable++
+			if written || chmodded {
+				stable = 0
+			}
+			w.arrivals[path] = stable
+			if stable < w.arrivalCycles {
+				continue
+			}
+			delete(w.arrivals, path)
+			e := w.newEvent(Create, path, "", info)
+			e.DuplicateOf = w.duplicateOf(e, files)
+			if !send(e) {
 				return
-			case evt <- Event{Write, path, path, info}:
 			}
+			continue
 		}
-		if oldInfo.Mode() != info.Mode() {
-			select {
-			case <-cancel:
+		if written || chmodded {
+			if !flush(path) {
+				return
+			}
+		}
+		if written {
+			e := w.newEvent(Write, path, path, info)
+			e.OldFileInfo = oldInfo
+			if !send(e) {
+				return
+			}
+		}
+		if chmodded {
+			e := w.newEvent(Chmod, path, path, info)
+			e.OldFileInfo = oldInfo
+			if !send(e) {
+				return
+			}
+		}
+		if w.linkCounts && !info.IsDir() {
+			oldLinks, ok1 := linkCount(oldInfo)
+			links, ok2 := linkCount(info)
+			if ok1 && ok2 && oldLinks != links {
+				if !send(w.newEvent(LinkCount, path, path, info)) {
+					return
+				}
+			}
+		}
+	}
+
+	// A created whiteout file means the file it shadows was removed.
+	for path, info := range whiteouts {
+		target, ok := whiteoutTarget(path)
+		if !ok {
+			continue
+		}
+		if _, found := removes[target]; found {
+			continue
+		}
+		if oldInfo, found := w.files[target]; found {
+			info = oldInfo
+		}
+		removes[target] = info
+	}
+
+	// sendCreate sends the Create event for the created file path and
+	// removes it from creates. It returns false if the cycle is canceled.
+	sendCreate := func(path string) bool {
+		info := creates[path]
+		delete(creates, path)
+		if w.arrivalCycles > 0 && !info.IsDir() {
+			w.arrivals[path] = 0
+			return true
+		}
+		e := w.newEvent(Create, path, "", info)
+		e.DuplicateOf = w.duplicateOf(e, files)
+		if w.ephemeralLifetime > 0 {
+			w.ephemeral[path] = &pendingEvent{
+				event:    e,
+				deadline: time.Now().Add(w.ephemeralLifetime),
+			}
+			return true
+		}
+		return send(e)
+	}
+
+	// Send the directories that files are renamed or moved into first with
+	// SetMirrorSafeOrdering.
+	if w.mirrorSafe {
+		for _, dir := range mirrorDirs(removes, creates) {
+			if !sendCreate(dir) {
 				return
-			case evt <- Event{Chmod, path, path, info}:
 			}
 		}
 	}
@@ -653,43 +3663,197 @@ func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
 	for path1, info1 := range removes {
 		for path2, info2 := range creates {
 			if sameFile(info1, info2) {
-				e := Event{
-					Op:       Move,
-					Path:     path2,
-					OldPath:  path1,
-					FileInfo: info1,
-				}
+				e := w.newEvent(Move, path2, path1, info1)
 				// If they are from the same directory, it's a rename
 				// instead of a move event.
 				if filepath.Dir(path1) == filepath.Dir(path2) {
 					e.Op = Rename
 				}
+				e.DuplicateOf = w.duplicateOf(e, files)
 
 				delete(removes, path1)
 				delete(creates, path2)
 
-				select {
-				case <-cancel:
+				if _, arriving := w.arrivals[path1]; arriving {
+					// The file is still arriving at its new path.
+					delete(w.arrivals, path1)
+					w.arrivals[path2] = 0
+					break
+				}
+
+				if !flushHeld(w.ephemeral, path1) {
+					return
+				}
+
+				if _, found := w.renames[path1]; found || w.renameWindow > 0 {
+					w.holdRename(e)
+					break
+				}
+
+				if !send(e) {
 					return
-				case evt <- e:
 				}
+
+				// The removed file can only have moved to one of the
+				// created files, even if the others are hard links to it.
+				break
 			}
 		}
 	}
 
 	// Send all the remaining create and remove events.
-	for path, info := range creates {
-		select {
-		case <-cancel:
+	for _, path := range w.orderPaths(creates, false) {
+		if !sendCreate(path) {
 			return
-		case evt <- Event{Create, path, "", info}:
 		}
 	}
-	for path, info := range removes {
-		select {
-		case <-cancel:
+	for _, path := range w.orderPaths(removes, true) {
+		info := removes[path]
+		if _, found := w.ephemeral[path]; found {
+			// The file was removed before its create was sent.
+			delete(w.ephemeral, path)
+			continue
+		}
+		if _, arriving := w.arrivals[path]; arriving {
+			// The file was removed before it was ready.
+			delete(w.arrivals, path)
+			continue
+		}
+		if !flushHeld(w.renames, path) {
+			return
+		}
+		if !send(w.newEvent(Remove, path, path, info)) {
+			return
+		}
+	}
+
+	w.pruneFingerprints(files)
+
+	// Send the held back creates that weren't removed in time, and the
+	// renames that weren't renamed again in time.
+	now := time.Now()
+	for _, path := range w.orderPaths(heldFiles(w.ephemeral), false) {
+		if now.Before(w.ephemeral[path].deadline) && w.ephemeralLifetime > 0 {
+			continue
+		}
+		if !flushHeld(w.ephemeral, path) {
+			return
+		}
+	}
+	for path, pending := range w.renames {
+		if now.Before(pending.deadline) && w.renameWindow > 0 {
+			continue
+		}
+		if !flushHeld(w.renames, path) {
+			return
+		}
+	}
+}
+
+// heldFiles returns the files of the events in held.
+func heldFiles(held map[string]*pendingEvent) map[string]os.FileInfo {
+	files := make(map[string]os.FileInfo, len(held))
+	for path, pending := range held {
+		files[path] = pending.event.FileInfo
+	}
+	return files
+}
+
+// orderPaths returns the paths in files in the order that their events
+// should be sent. With hierarchical ordering, parents are ordered before their
+// children, or after them if childFirst is true. The caller must hold w.mu.
+func (w *Watcher) orderPaths(files map[string]os.FileInfo, childFirst bool) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	if w.hierarchical {
+		if childFirst {
+			sort.Sort(sort.Reverse(byDepth(paths)))
+		} else {
+			sort.Sort(byDepth(paths))
+		}
+	}
+	return paths
+}
+
+// byDepth sorts paths by the number of directories in them, and then by
+// name.
+type byDepth []string
+
+func (p byDepth) Len() int      { return len(p) }
+func (p byDepth) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byDepth) Less(i, j int) bool {
+	di := strings.Count(p[i], string(filepath.Separator))
+	dj := strings.Count(p[j], string(filepath.Separator))
+	if di != dj {
+		return di < dj
+	}
+	return p[i] < p[j]
+}
+
+// holdRename holds back the rename or move event e, joining it with a held
+// back event for the file's old path if there is one. The caller must hold
+// w.mu.
+func (w *Watcher) holdRename(e Event) {
+	if pending, found := w.renames[e.OldPath]; found {
+		delete(w.renames, e.OldPath)
+		e.OldPath = pending.event.OldPath
+		if e.OldPath == e.Path {
+			// The file was renamed back to where it started.
+			return
+		}
+		e.Op = Move
+		if filepath.Dir(e.OldPath) == filepath.Dir(e.Path) {
+			e.Op = Rename
+		}
+	}
+	w.renames[e.Path] = &pendingEvent{
+		event:    e,
+		deadline: time.Now().Add(w.renameWindow),
+	}
+}
+
+func (w *Watcher) pollChildCounts(files map[string]os.FileInfo, send func(Event) bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.childCounts) == 0 {
+		return
+	}
+
+	// Count the children of each of the directories.
+	counts := make(map[string]int)
+	for path := range files {
+		if _, found := w.childCounts[filepath.Dir(path)]; found {
+			counts[filepath.Dir(path)]++
+		}
+	}
+
+	for path, cc := range w.childCounts {
+		info, found := files[path]
+		if !found {
+			continue
+		}
+
+		above := counts[path] > cc.threshold
+		if above == cc.above {
+			continue
+		}
+		cc.above = above
+
+		e := w.newEvent(ChildCountBelow, path, "", info)
+		switch {
+		case cc.emptiness && above:
+			e.Op = Filled
+		case cc.emptiness:
+			e.Op = Emptied
+		case above:
+			e.Op = ChildCountAbove
+		}
+
+		if !send(e) {
 			return
-		case evt <- Event{Remove, path, path, info}:
 		}
 	}
 }
@@ -699,17 +3863,174 @@ func (w *Watcher) Wait() {
 	w.wg.Wait()
 }
 
+// spawn runs f in a new goroutine that's tracked by workers and
+// goroutineCount.
+func (w *Watcher) spawn(f func()) {
+	atomic.AddInt64(&w.goroutines, 1)
+	w.workers.Add(1)
+	go func() {
+		defer w.workers.Done()
+		defer atomic.AddInt64(&w.goroutines, -1)
+		f()
+	}()
+}
+
+// goroutineCount returns the number of goroutines started by the watcher
+// that are still running. It's used by tests to check for goroutine leaks.
+func (w *Watcher) goroutineCount() int {
+	return int(atomic.LoadInt64(&w.goroutines))
+}
+
+// shutdown stops all of the watcher's background goroutines, waits for them
+// to exit and then signals that the watcher is closed.
+func (w *Watcher) shutdown() {
+	close(w.stop)
+	w.workers.Wait()
+	close(w.Closed)
+	close(w.finished)
+}
+
+// OpCount returns the number of events with the op type op that have been
+// sent on the Event channel. It's safe to call while the watcher is running
+// and doesn't contend with the watching process.
+func (w *Watcher) OpCount(op Op) uint64 {
+	count, found := w.counts[op]
+	if !found {
+		return 0
+	}
+	return atomic.LoadUint64(count)
+}
+
+// CreateCount returns the number of Create events that have been sent.
+func (w *Watcher) CreateCount() uint64 { return w.OpCount(Create) }
+
+// WriteCount returns the number of Write events that have been sent.
+func (w *Watcher) WriteCount() uint64 { return w.OpCount(Write) }
+
+// RemoveCount returns the number of Remove events that have been sent.
+func (w *Watcher) RemoveCount() uint64 { return w.OpCount(Remove) }
+
+// RenameCount returns the number of Rename events that have been sent.
+func (w *Watcher) RenameCount() uint64 { return w.OpCount(Rename) }
+
+// ChmodCount returns the number of Chmod events that have been sent.
+func (w *Watcher) ChmodCount() uint64 { return w.OpCount(Chmod) }
+
+// MoveCount returns the number of Move events that have been sent.
+func (w *Watcher) MoveCount() uint64 { return w.OpCount(Move) }
+
+// PathCount is the number of events that have been sent for a path.
+type PathCount struct {
+	Path  string
+	Count uint64
+}
+
+// Stats describes how long a watcher's scans take and how much it's
+// watching, such as to tell when scans are getting close to the polling
+// interval.
+type Stats struct {
+	LastScan    time.Duration // duration of the last scan.
+	AverageScan time.Duration // average duration of the scans since Start.
+	Scans       int           // number of scans since Start.
+	Files       int           // number of files currently watched.
+	Events      uint64        // number of events sent on the Event channel.
+	Interval    time.Duration // current polling interval, with Start.
+}
+
+// Stats returns the watcher's current Stats.
+func (w *Watcher) Stats() Stats {
+	w.mu.Lock()
+	stats := Stats{
+		LastScan: w.lastScan,
+		Scans:    w.scans,
+		Files:    len(w.files),
+		Interval: w.pollCurrent,
+	}
+	if w.scans > 0 {
+		stats.AverageScan = w.totalScan / time.Duration(w.scans)
+	}
+	w.mu.Unlock()
+
+	for op := range w.counts {
+		stats.Events += w.OpCount(op)
+	}
+	return stats
+}
+
+// maxHotPaths is the most paths that HotPaths keeps event counts for.
+const maxHotPaths = 1000
+
+// countHot counts an event for path for HotPaths. Once maxHotPaths paths are
+// counted, the path with the fewest events is forgotten to make room for a
+// new one. The caller must hold w.hotMu.
+func (w *Watcher) countHot(path string) {
+	if _, found := w.hot[path]; !found && len(w.hot) >= maxHotPaths {
+		var coldest string
+		var fewest uint64
+		for p, count := range w.hot {
+			if coldest == "" || count < fewest {
+				coldest, fewest = p, count
+			}
+		}
+		delete(w.hot, coldest)
+	}
+	w.hot[path]++
+}
+
+// HotPaths returns the n paths with the most events sent on the Event
+// channel since the watcher was started, most first, such as to find a
+// directory that's flooding the event stream. Paths with the same count are
+// sorted by path. If n is 0 or less, every counted path is returned. Counts
+// are kept for at most 1000 paths, forgetting the path with the fewest
+// events to make room for a new one. The paths in a Summary event's Paths
+// are each counted, while triggered events aren't counted.
+func (w *Watcher) HotPaths(n int) []PathCount {
+	w.hotMu.Lock()
+	counts := make([]PathCount, 0, len(w.hot))
+	for path, count := range w.hot {
+		counts = append(counts, PathCount{Path: path, Count: count})
+	}
+	w.hotMu.Unlock()
+
+	sort.Sort(byCount(counts))
+	if n > 0 && n < len(counts) {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// byCount sorts a slice of PathCount by count, most first, then by path.
+type byCount []PathCount
+
+func (c byCount) Len() int      { return len(c) }
+func (c byCount) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCount) Less(i, j int) bool {
+	if c[i].Count != c[j].Count {
+		return c[i].Count > c[j].Count
+	}
+	return c[i].Path < c[j].Path
+}
+
+// Done returns a channel that's closed once the watcher has been closed and
+// all of its goroutines have exited, apart from any filesystem calls that
+// were abandoned by SetScanTimeout.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.finished
+}
+
 // Close stops a Watcher and unlocks its mutex, then sends a close signal.
-func (w *Watcher) Close() {
+// If the watcher isn't running, Close returns ErrWatcherNotRunning.
+func (w *Watcher) Close() error {
 	w.mu.Lock()
 	if !w.running {
 		w.mu.Unlock()
-		return
+		return ErrWatcherNotRunning
 	}
 	w.running = false
-	w.files = make(map[string]os.FileInfo)
+	w.replaceFiles(make(map[string]os.FileInfo))
 	w.names = make(map[string]bool)
 	w.mu.Unlock()
 	// Send a close signal to the Start method.
 	w.close <- struct{}{}
+	return nil
 }
@@ -1,10 +1,24 @@
 package watcher
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -64,6 +78,40 @@ func setup(t testing.TB) (string, func()) {
 	}
 }
 
+// startWatcher starts w's watching process with the duration d in a new
+// goroutine. Since t.Fatal can't be called from that goroutine, an error
+// from Start is reported with t.Error instead.
+func startWatcher(t testing.TB, w *Watcher, d time.Duration) {
+	go func() {
+		if err := w.Start(d); err != nil {
+			t.Error(err)
+		}
+	}()
+}
+
+// tickEvents runs one cycle of w, which must be started with manual ticks,
+// and returns the events that it sent. An error sent by the cycle fails the
+// test.
+func tickEvents(t testing.TB, w *Watcher) []Event {
+	ticked := make(chan error)
+	go func() { ticked <- w.Tick() }()
+
+	var events []Event
+	for {
+		select {
+		case event := <-w.Event:
+			events = append(events, event)
+		case err := <-w.Error:
+			t.Fatal(err)
+		case err := <-ticked:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return events
+		}
+	}
+}
+
 func TestEventString(t *testing.T) {
 	e := &Event{Op: Create, Path: "/fake/path"}
 
@@ -498,7 +546,7 @@ func TestListFiles(t *testing.T) {
 	}
 
 	// Try to call list on a file that's not a directory.
-	fileList, err := w.list(fname)
+	fileList, err := w.list(w.backend, fname)
 	if err != nil {
 		t.Error("expected err to be nil")
 	}
@@ -507,6 +555,58 @@ func TestListFiles(t *testing.T) {
 	}
 }
 
+func TestSetForcedFullScanEvery(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	deep := filepath.Join(testDir, "a", "b", "c")
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(deep, "existing.txt")
+	if err := ioutil.WriteFile(existing, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.SetDirModTimeScanning(true)
+	w.SetForcedFullScanEvery(3)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(deep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := filepath.Join(deep, "created.txt")
+	if err := ioutil.WriteFile(created, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(existing, []byte("changed"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Put the directory's mod time back, like a filesystem that doesn't
+	// update directory mod times.
+	if err := os.Chtimes(deep, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the third scan is a full scan, which finds the changes.
+	for scan := 1; scan <= 3; scan++ {
+		fileList := w.retrieveFileList()
+		_, found := fileList[created]
+		written := fileList[existing].Size() != 0
+		if full := scan == 3; found != full || written != full {
+			t.Errorf("scan %d: expected the changes to only be found by the full scan, found the create: %t, the write: %t",
+				scan, found, written)
+		}
+		w.files = fileList
+	}
+}
+
 func TestTriggerEvent(t *testing.T) {
 	w := New()
 
@@ -902,6 +1002,108 @@ func BenchmarkListFiles(b *testing.B) {
 	}
 }
 
+func BenchmarkListFilesScanTimeout(b *testing.B) {
+	testDir, teardown := setup(b)
+	defer teardown()
+
+	w := New()
+	w.SetScanTimeout(time.Minute)
+	err := w.AddRecursive(testDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		fileList := w.retrieveFileList()
+		if fileList == nil {
+			b.Fatal("expected file list to not be empty")
+		}
+	}
+}
+
+func BenchmarkDirModTimeScanning(b *testing.B) {
+	for _, fast := range []bool{false, true} {
+		name := "Full"
+		if fast {
+			name = "DirModTime"
+		}
+		b.Run(name, func(b *testing.B) {
+			testDir, teardown := setup(b)
+			defer teardown()
+
+			// 100 directories with 50 files each.
+			for i := 0; i < 100; i++ {
+				dir := filepath.Join(testDir, fmt.Sprintf("dir_%d", i))
+				if err := os.Mkdir(dir, 0755); err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < 50; j++ {
+					file := filepath.Join(dir, fmt.Sprintf("file_%d.txt", j))
+					if err := ioutil.WriteFile(file, []byte{}, 0755); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+
+			w := New()
+			w.SetDirModTimeScanning(fast)
+			if err := w.AddRecursive(testDir); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.files = w.retrieveFileList()
+			}
+		})
+	}
+}
+
+func BenchmarkListFilesReadDirPlus(b *testing.B) {
+	for _, enabled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("ReadDirPlus=%t", enabled), func(b *testing.B) {
+			backend := newPlusMemBackend(10, 10)
+
+			w := New()
+			w.SetBackend(backend, "/remote")
+			w.SetReadDirPlus(enabled)
+			if err := w.AddRecursive("/remote"); err != nil {
+				b.Fatal(err)
+			}
+
+			backend.trips = 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				fileList := w.retrieveFileList()
+				if fileList == nil {
+					b.Fatal("expected file list to not be empty")
+				}
+			}
+			b.StopTimer()
+			b.Logf("%d round trips per scan", backend.trips/b.N)
+		})
+	}
+}
+
+func BenchmarkListFilesPresenceOnly(b *testing.B) {
+	testDir, teardown := setup(b)
+	defer teardown()
+
+	w := New()
+	w.SetPresenceOnly(true)
+	err := w.AddRecursive(testDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		fileList := w.retrieveFileList()
+		if fileList == nil {
+			b.Fatal("expected file list to not be empty")
+		}
+	}
+}
+
 func TestClose(t *testing.T) {
 	testDir, teardown := setup(t)
 	defer teardown()
@@ -921,7 +1123,9 @@ func TestClose(t *testing.T) {
 	}
 
 	// Call close on the watcher even though it's not running.
-	w.Close()
+	if err := w.Close(); err != ErrWatcherNotRunning {
+		t.Fatalf("expected ErrWatcherNotRunning error, got %v", err)
+	}
 
 	wf = w.WatchedFiles()
 	fileList = w.retrieveFileList()
@@ -940,7 +1144,9 @@ func TestClose(t *testing.T) {
 		<-w.close
 	}()
 
-	w.Close()
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected error to be nil, got %s", err)
+	}
 
 	wf = w.WatchedFiles()
 
@@ -949,6 +1155,10 @@ func TestClose(t *testing.T) {
 		t.Fatalf("expected len of wf to be 0, got %d", len(wf))
 	}
 
+	// Closing an already closed watcher is a no-op.
+	if err := w.Close(); err != ErrWatcherNotRunning {
+		t.Fatalf("expected ErrWatcherNotRunning error, got %v", err)
+	}
 }
 
 func TestWatchedFiles(t *testing.T) {
@@ -1001,7 +1211,18 @@ func TestOpsString(t *testing.T) {
 		{Rename, "RENAME"},
 		{Chmod, "CHMOD"},
 		{Move, "MOVE"},
-		{Op(10), "???"},
+		{Summary, "SUMMARY"},
+		{ChildCountAbove, "CHILD_COUNT_ABOVE"},
+		{ChildCountBelow, "CHILD_COUNT_BELOW"},
+		{LinkCount, "LINK_COUNT"},
+		{Filled, "FILLED"},
+		{Emptied, "EMPTIED"},
+		{Flapping, "FLAPPING"},
+		{TotalSizeAbove, "TOTAL_SIZE_ABOVE"},
+		{TotalSizeBelow, "TOTAL_SIZE_BELOW"},
+		{Locked, "LOCKED"},
+		{Unlocked, "UNLOCKED"},
+		{Op(17), "???"},
 	}
 
 	for _, tc := range testCases {
@@ -1010,3 +1231,6486 @@ func TestOpsString(t *testing.T) {
 		}
 	}
 }
+
+func TestInodeMonitoring(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	// Mock the filesystem so it reports it's almost out of inodes.
+	defer func(f func(string) (uint64, error)) { freeInodes = f }(freeInodes)
+	freeInodes = func(path string) (uint64, error) {
+		return 10, nil
+	}
+
+	w := New()
+	if err := w.SetInodeMonitoring(100); err == ErrInodeMonitoringUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	select {
+	case err := <-w.Error:
+		werr, ok := err.(*WatcherError)
+		if !ok || werr.Err != ErrLowInodes {
+			t.Errorf("expected ErrLowInodes error, got %v", err)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no low inodes error")
+	}
+}
+
+func TestSummaryEvents(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetSummaryEvents(true)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{"newfile_1.txt", "newfile_2.txt", "newfile_3.txt"}
+	for _, f := range files {
+		filePath := filepath.Join(testDir, f)
+		if err := ioutil.WriteFile(filePath, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Summary {
+			t.Fatalf("expected event to be Summary, got %s", event.Op)
+		}
+		paths := make(map[string]bool)
+		for _, path := range event.Paths {
+			paths[path] = true
+		}
+		for _, f := range files {
+			if !paths[filepath.Join(testDir, f)] {
+				t.Errorf("expected summary to contain %s", f)
+			}
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no summary event")
+	}
+
+	// Make sure no individual events follow the summary.
+	select {
+	case event := <-w.Event:
+		t.Fatalf("expected no more events, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestWatchChildCount(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(ChildCountAbove, ChildCountBelow)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// testDir starts out with 6 children.
+	if err := w.WatchChildCount(testDir, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	files := []string{"newfile_1.txt", "newfile_2.txt"}
+	for _, f := range files {
+		filePath := filepath.Join(testDir, f)
+		if err := ioutil.WriteFile(filePath, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Op != ChildCountAbove {
+			t.Errorf("expected event to be ChildCountAbove, got %s", event.Op)
+		}
+		if event.Path != testDir {
+			t.Errorf("expected event.Path to be %s, got %s", testDir, event.Path)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no child count event")
+	}
+
+	for _, f := range files {
+		if err := os.Remove(filepath.Join(testDir, f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Op != ChildCountBelow {
+			t.Errorf("expected event to be ChildCountBelow, got %s", event.Op)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no child count event")
+	}
+}
+
+func TestWatcherErrorSeverity(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	fileTxt := filepath.Join(testDir, "file.txt")
+	errRead := errors.New("error: can't read file")
+
+	w := New()
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail to read a single file from now on.
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		if fullPath == fileTxt {
+			return errRead
+		}
+		return nil
+	})
+
+	// The failed listings cause Remove events, so drain them.
+	go func() {
+		for {
+			select {
+			case <-w.Event:
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	select {
+	case err := <-w.Error:
+		werr, ok := err.(*WatcherError)
+		if !ok {
+			t.Fatalf("expected a *WatcherError, got %T", err)
+		}
+		if werr.Severity != Warning {
+			t.Errorf("expected severity to be Warning, got %s", werr.Severity)
+		}
+		if werr.Err != errRead {
+			t.Errorf("expected cause to be %v, got %v", errRead, werr.Err)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no read error")
+	}
+
+	// Now delete the watched root.
+	if err := os.RemoveAll(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-w.Error:
+		werr, ok := err.(*WatcherError)
+		if !ok {
+			t.Fatalf("expected a *WatcherError, got %T", err)
+		}
+		if werr.Severity != Fatal {
+			t.Errorf("expected severity to be Fatal, got %s", werr.Severity)
+		}
+		if werr.Err != ErrWatchedFileDeleted {
+			t.Errorf("expected cause to be ErrWatchedFileDeleted, got %v", werr.Err)
+		}
+		if !Is(err, ErrWatchedFileDeleted) {
+			t.Error("expected Is to report ErrWatchedFileDeleted")
+		}
+		if Is(err, ErrWatcherRunning) {
+			t.Error("expected Is to only report the wrapped error")
+		}
+		if werr.Path != testDir {
+			t.Errorf("expected path to be %s, got %s", testDir, werr.Path)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no root deleted error")
+	}
+}
+
+func TestSuspendResume(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Write)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Suspend()
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	fileTxt := filepath.Join(testDir, "file.txt")
+	if err := ioutil.WriteFile(fileTxt, []byte("file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Fatalf("expected no events while suspended, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+
+	w.Resume()
+
+	select {
+	case event := <-w.Event:
+		if event.Path != fileTxt {
+			t.Errorf("expected event.Path to be %s, got %s", fileTxt, event.Path)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no write event after resuming")
+	}
+}
+
+func TestResumeQuiet(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Suspend()
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	fileTxt := filepath.Join(testDir, "file.txt")
+	if err := ioutil.WriteFile(fileTxt, []byte("file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	newFile := filepath.Join(testDir, "newfile.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w.ResumeQuiet()
+
+	select {
+	case event := <-w.Event:
+		t.Fatalf("expected no events after resuming quietly, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestResync(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// Make bulk changes and resync instead of reporting them.
+	if err := ioutil.WriteFile(filepath.Join(testDir, "file.txt"), []byte("bulk"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(testDir, "testDirTwo", "file_recursive.txt")); err != nil {
+		t.Fatal(err)
+	}
+	newFile := filepath.Join(testDir, "newfile.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Resync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := w.WatchedFiles()[newFile]; !found {
+		t.Errorf("expected %s to be watched after resyncing", newFile)
+	}
+	if events := tickEvents(t, w); len(events) != 0 {
+		t.Errorf("expected no events after resyncing, got %v", events)
+	}
+
+	// The next change is found relative to the resynced files.
+	if err := os.Remove(newFile); err != nil {
+		t.Fatal(err)
+	}
+	events := tickEvents(t, w)
+	var removed bool
+	for _, event := range events {
+		if event.Op == Remove && event.Path == newFile {
+			removed = true
+		}
+	}
+	if !removed {
+		t.Errorf("expected a Remove event for %s, got %v", newFile, events)
+	}
+}
+
+func TestOverlayAwareness(t *testing.T) {
+	// Whiteout files are only used by overlay filesystems on linux.
+	if runtime.GOOS != "linux" {
+		t.Skip("overlay filesystems are only supported on linux")
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetOverlayAwareness(true)
+	w.FilterOps(Create, Remove)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate an upper layer deleting file.txt from a lower layer.
+	whiteout := filepath.Join(testDir, ".wh.file.txt")
+	if err := ioutil.WriteFile(whiteout, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Remove {
+			t.Errorf("expected event to be Remove, got %s", event.Op)
+		}
+		fileTxt := filepath.Join(testDir, "file.txt")
+		if event.Path != fileTxt {
+			t.Errorf("expected event.Path to be %s, got %s", fileTxt, event.Path)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no remove event")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Fatalf("expected no more events, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestIgnoreDoubleStar(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	deepDir := filepath.Join(testDir, "a", "b", "node_modules", "c")
+	if err := os.MkdirAll(deepDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	deepFile := filepath.Join(deepDir, "d.js")
+	if err := ioutil.WriteFile(deepFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+
+	if err := w.IgnoreDoubleStar("[bad"); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+
+	if err := w.IgnoreDoubleStar("**/node_modules/**"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := w.files[deepFile]; found {
+		t.Errorf("expected to not find %s", deepFile)
+	}
+	nodeModules := filepath.Join(testDir, "a", "b", "node_modules")
+	if _, found := w.files[nodeModules]; found {
+		t.Errorf("expected to not find %s", nodeModules)
+	}
+	dirB := filepath.Join(testDir, "a", "b")
+	if _, found := w.files[dirB]; !found {
+		t.Errorf("expected to find %s", dirB)
+	}
+}
+
+func TestIgnoreGlob(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	buildDir := filepath.Join(testDir, "build")
+	if err := os.MkdirAll(filepath.Join(buildDir, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		filepath.Join(buildDir, "app"),
+		filepath.Join(buildDir, "out", "app.o"),
+		filepath.Join(testDir, "testDirTwo", "scratch.tmp"),
+	} {
+		if err := ioutil.WriteFile(name, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+
+	if err := w.IgnoreGlob("[bad"); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.IgnoreGlob("**/*.tmp", "build/*"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		filepath.Join(buildDir, "app"),
+		filepath.Join(buildDir, "out"),
+		filepath.Join(buildDir, "out", "app.o"),
+		filepath.Join(testDir, "testDirTwo", "scratch.tmp"),
+	} {
+		if _, found := w.files[name]; found {
+			t.Errorf("expected to not find %s", name)
+		}
+	}
+	for _, name := range []string{
+		buildDir,
+		filepath.Join(testDir, "testDirTwo", "file_recursive.txt"),
+	} {
+		if _, found := w.files[name]; !found {
+			t.Errorf("expected to find %s", name)
+		}
+	}
+
+	// New files that match are skipped when listing.
+	newFile := filepath.Join(testDir, "new.tmp")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	w.mu.Lock()
+	list, err := w.walk(w.backend, testDir, nil)
+	w.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := list[newFile]; found {
+		t.Errorf("expected to not list %s", newFile)
+	}
+	if _, found := list[buildDir]; !found {
+		t.Errorf("expected to list %s", buildDir)
+	}
+}
+
+func TestIgnoreManyPaths(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	testDir, err := filepath.Abs(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genDir := filepath.Join(testDir, "gen")
+	if err := os.Mkdir(genDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var kept, ignored []string
+	for i := 0; i < 200; i++ {
+		name := filepath.Join(genDir, fmt.Sprintf("file_%d.txt", i))
+		if err := ioutil.WriteFile(name, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			ignored = append(ignored, name)
+		} else {
+			kept = append(kept, name)
+		}
+	}
+
+	w := New()
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ignore half of the generated files and a directory, among many
+	// paths that don't exist.
+	paths := append([]string{filepath.Join(testDir, "testDirTwo")}, ignored...)
+	for i := 0; i < 50000; i++ {
+		paths = append(paths, filepath.Join(testDir, "missing", fmt.Sprintf("file_%d.txt", i)))
+	}
+	if err := w.IgnoreManyPaths(paths); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every ignored path is found, and no kept one is.
+	for _, path := range paths {
+		if !w.ignoredMany.contains(path) {
+			t.Fatalf("expected %s to be ignored", path)
+		}
+	}
+	for _, path := range kept {
+		if w.ignoredMany.contains(path) {
+			t.Errorf("expected %s to not be ignored", path)
+		}
+	}
+
+	check := func() {
+		for _, name := range append([]string{
+			filepath.Join(testDir, "testDirTwo"),
+			filepath.Join(testDir, "testDirTwo", "file_recursive.txt"),
+		}, ignored...) {
+			if _, found := w.files[name]; found {
+				t.Errorf("expected to not find %s", name)
+			}
+		}
+		for _, name := range append([]string{genDir}, kept...) {
+			if _, found := w.files[name]; !found {
+				t.Errorf("expected to find %s", name)
+			}
+		}
+	}
+	check()
+
+	// The ignored paths are also skipped when listing.
+	if err := w.Resync(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestIgnoreManyPathsConcurrently(t *testing.T) {
+	var sets [][]string
+	for i := 0; i < 20; i++ {
+		var set []string
+		for j := 0; j < 1000; j++ {
+			set = append(set, filepath.Join(string(filepath.Separator)+"ignored",
+				fmt.Sprintf("set_%d", i), fmt.Sprintf("file_%d.txt", j)))
+		}
+		sets = append(sets, set)
+	}
+
+	w := New()
+
+	// None of the paths are lost when sets are added at the same time.
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, set := range sets {
+		wg.Add(1)
+		go func(set []string) {
+			defer wg.Done()
+			<-start
+			if err := w.IgnoreManyPaths(set); err != nil {
+				t.Error(err)
+			}
+		}(set)
+	}
+	close(start)
+	wg.Wait()
+
+	for _, set := range sets {
+		for _, path := range set {
+			if !w.ignoredMany.contains(path) {
+				t.Fatalf("expected %s to be ignored", path)
+			}
+		}
+	}
+}
+
+func TestAddIgnoreFile(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	for _, dir := range []string{"build", "sub", filepath.Join("docs", "a", "b")} {
+		if err := os.MkdirAll(filepath.Join(testDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]bool{
+		"a.log":                                 true,
+		"keep.log":                              false,
+		filepath.Join("build", "x"):             true,
+		filepath.Join("sub", "build"):           false,
+		"top.txt":                               true,
+		filepath.Join("sub", "top.txt"):         false,
+		filepath.Join("docs", "a", "b", "c.md"): true,
+		filepath.Join("docs", "readme.txt"):     false,
+	}
+	for name := range files {
+		if err := ioutil.WriteFile(filepath.Join(testDir, name), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ignoreFile := filepath.Join(testDir, ".gitignore")
+	rules := "# Build output.\n\n*.log\n!keep.log\nbuild/\n/top.txt\ndocs/**/*.md\n"
+	if err := ioutil.WriteFile(ignoreFile, []byte(rules), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+
+	if err := w.AddIgnoreFile(filepath.Join(testDir, "missing")); err == nil {
+		t.Error("expected an error for a missing ignore file")
+	}
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddIgnoreFile(ignoreFile); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ignored := range files {
+		path, err := filepath.Abs(filepath.Join(testDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, found := w.files[path]; found == ignored {
+			t.Errorf("expected %s to be ignored: %t", name, ignored)
+		}
+	}
+
+	// The ignore file is read again when it changes.
+	if err := ioutil.WriteFile(ignoreFile, []byte("build/\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	list := w.retrieveFileList()
+	aLog, err := filepath.Abs(filepath.Join(testDir, "a.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := list[aLog]; !found {
+		t.Errorf("expected to list %s after the ignore file changed", aLog)
+	}
+}
+
+func TestDone(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	w.Wait()
+
+	select {
+	case <-w.Done():
+		t.Fatal("expected Done to block while the watcher is running")
+	default:
+	}
+
+	w.Close()
+
+	select {
+	case <-w.Done():
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("expected Done to be closed after Close")
+	}
+}
+
+func TestEventDepth(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Write)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	fileRecursive := filepath.Join(testDir, "testDirTwo", "file_recursive.txt")
+	if err := ioutil.WriteFile(fileRecursive, []byte("file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	for {
+		select {
+		case event := <-w.Event:
+			if event.Path != fileRecursive {
+				continue // The parent directory's write.
+			}
+			if event.Root != testDir {
+				t.Errorf("expected event.Root to be %s, got %s", testDir, event.Root)
+			}
+			if event.Depth != 2 {
+				t.Errorf("expected event.Depth to be 2, got %d", event.Depth)
+			}
+			return
+		case <-time.After(time.Millisecond * 250):
+			t.Fatal("received no write event")
+		}
+	}
+}
+
+func TestOnWatchSetChange(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetWatchSetChangeThreshold(50)
+
+	type counts struct{ old, new int }
+	changes := make(chan counts, 1)
+	w.OnWatchSetChange(func(oldCount, newCount int) {
+		changes <- counts{oldCount, newCount}
+	})
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drain the events for the new files.
+	go func() {
+		for {
+			select {
+			case <-w.Event:
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+
+	// Grow the watch set from 7 to 17 files.
+	for i := 0; i < 10; i++ {
+		filePath := filepath.Join(testDir, fmt.Sprintf("newfile_%d.txt", i))
+		if err := ioutil.WriteFile(filePath, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	select {
+	case c := <-changes:
+		if c.old != 7 || c.new != 17 {
+			t.Errorf("expected counts to be 7 and 17, got %d and %d", c.old, c.new)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("watch set change function was not called")
+	}
+}
+
+func TestAddFromReader(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	fileTxt := filepath.Join(testDir, "file.txt")
+	dirTwo := filepath.Join(testDir, "testDirTwo")
+	missing := filepath.Join(testDir, "missing.txt")
+
+	list := strings.Join([]string{
+		"# Files to watch.",
+		fileTxt,
+		"",
+		missing,
+		dirTwo,
+	}, "\n")
+
+	w := New()
+
+	err := w.AddFromReader(strings.NewReader(list))
+	if err == nil {
+		t.Fatal("expected an error for the missing path")
+	}
+	if !strings.Contains(err.Error(), missing) {
+		t.Errorf("expected error to name %s, got %s", missing, err)
+	}
+
+	for _, name := range []string{fileTxt, dirTwo} {
+		if _, found := w.names[name]; !found {
+			t.Errorf("expected w.names to contain %s", name)
+		}
+	}
+	if _, found := w.names[missing]; found {
+		t.Errorf("expected w.names to not contain %s", missing)
+	}
+	if len(w.names) != 2 {
+		t.Errorf("expected len(w.names) to be 2, got %d", len(w.names))
+	}
+}
+
+func TestContentMatchHook(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	script := filepath.Join(testDir, "script")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho hi\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	notScript := filepath.Join(testDir, "not_script")
+	if err := ioutil.WriteFile(notScript, []byte("echo hi\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.AddFilterHook(ContentMatchHook(func(firstBytes []byte) bool {
+		return bytes.HasPrefix(firstBytes, []byte("#!"))
+	}))
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := w.files[script]; !found {
+		t.Errorf("expected to find %s", script)
+	}
+	if _, found := w.files[notScript]; found {
+		t.Errorf("expected to not find %s", notScript)
+	}
+	dirTwo := filepath.Join(testDir, "testDirTwo")
+	if _, found := w.files[dirTwo]; !found {
+		t.Errorf("expected to find %s directory", dirTwo)
+	}
+}
+
+func TestExtensionHook(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	names := []string{"main.go", "go.mod", "README.MD", "Upper.GO", "notes.txt"}
+	for _, name := range names {
+		path := filepath.Join(testDir, "testDirTwo", name)
+		if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.AddFilterHook(ExtensionHook(".go", "mod"))
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"main.go", "go.mod", "Upper.GO"} {
+		path := filepath.Join(testDir, "testDirTwo", name)
+		if _, found := w.files[path]; !found {
+			t.Errorf("expected to find %s", path)
+		}
+	}
+	for _, name := range []string{"README.MD", "notes.txt", "file_recursive.txt"} {
+		path := filepath.Join(testDir, "testDirTwo", name)
+		if _, found := w.files[path]; found {
+			t.Errorf("expected to not find %s", path)
+		}
+	}
+	if _, found := w.files[filepath.Join(testDir, "file.txt")]; found {
+		t.Errorf("expected to not find %s", filepath.Join(testDir, "file.txt"))
+	}
+	dirTwo := filepath.Join(testDir, "testDirTwo")
+	if _, found := w.files[dirTwo]; !found {
+		t.Errorf("expected to find %s directory", dirTwo)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	type payload struct {
+		Op   string `json:"op"`
+		Path string `json:"path"`
+		Name string `json:"name"`
+	}
+	payloads := make(chan payload, 2)
+
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt to make sure the event is retried.
+		attempts++
+		if attempts == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			t.Errorf("expected method to be POST, got %s", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected content type to be application/json, got %s", ct)
+		}
+
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		payloads <- p
+	}))
+	defer ts.Close()
+
+	w := New()
+	w.SetWebhook(ts.URL, ts.Client())
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	go func() {
+		w.TriggerEvent(Create, nil)
+		w.TriggerEvent(Remove, nil)
+	}()
+
+	for _, op := range []Op{Create, Remove} {
+		<-w.Event
+
+		select {
+		case p := <-payloads:
+			if p.Op != op.String() {
+				t.Errorf("expected op to be %s, got %s", op, p.Op)
+			}
+			if p.Path != "-" {
+				t.Errorf("expected path to be -, got %s", p.Path)
+			}
+			if p.Name != "triggered event" {
+				t.Errorf("expected name to be triggered event, got %s", p.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("webhook received no event")
+		}
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	// The webhook holds on to the first event until it's released, so
+	// the rest of the events are queued behind it.
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+
+	w := New()
+	w.SetWebhook(ts.URL, ts.Client())
+
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	const events = webhookQueueSize + 50
+	go func() {
+		for i := 0; i < events; i++ {
+			w.TriggerEvent(Create, nil)
+		}
+	}()
+	for i := 0; i < events; i++ {
+		<-w.Event
+	}
+	close(release)
+
+	select {
+	case err := <-w.Error:
+		werr, ok := err.(*WatcherError)
+		if !ok || werr.Severity != Warning || werr.Err != ErrWebhookQueueFull {
+			t.Errorf("expected an ErrWebhookQueueFull warning, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("received no warning for the dropped events")
+	}
+}
+
+func TestPauseWhileExists(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	sentinel := filepath.Join(testDir, ".importing")
+	if err := ioutil.WriteFile(sentinel, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.FilterOps(Write)
+
+	if err := w.PauseWhileExists(sentinel); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	fileTxt := filepath.Join(testDir, "file.txt")
+	if err := ioutil.WriteFile(fileTxt, []byte("file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Fatalf("expected no events while paused, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+
+	if err := os.Remove(sentinel); err != nil {
+		t.Fatal(err)
+	}
+
+	received := false
+	for !received {
+		select {
+		case event := <-w.Event:
+			received = event.Path == fileTxt
+		case <-time.After(time.Millisecond * 250):
+			t.Fatal("received no write event after removing the sentinel")
+		}
+	}
+
+	// Drain the write event for testDir so that Close doesn't block.
+	go func() {
+		for {
+			select {
+			case <-w.Event:
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+}
+
+func TestOpCounts(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	observed := make(map[Op]uint64)
+
+	// receive counts events until there are none for a whole cycle.
+	receive := func() {
+		for {
+			select {
+			case event := <-w.Event:
+				observed[event.Op]++
+			case <-time.After(time.Millisecond * 250):
+				return
+			}
+		}
+	}
+
+	newFile := filepath.Join(testDir, "newfile.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	receive()
+
+	if err := ioutil.WriteFile(newFile, []byte("file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	receive()
+
+	if err := os.Remove(newFile); err != nil {
+		t.Fatal(err)
+	}
+	receive()
+
+	if observed[Create] == 0 || observed[Write] == 0 || observed[Remove] == 0 {
+		t.Fatalf("expected create, write and remove events, got %v", observed)
+	}
+
+	counts := map[Op]uint64{
+		Create: w.CreateCount(),
+		Write:  w.WriteCount(),
+		Remove: w.RemoveCount(),
+		Rename: w.RenameCount(),
+		Chmod:  w.ChmodCount(),
+		Move:   w.MoveCount(),
+	}
+	for op, count := range counts {
+		if count != observed[op] {
+			t.Errorf("expected %s count to be %d, got %d", op, observed[op], count)
+		}
+	}
+}
+
+func TestAddRecursiveLenient(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	dirTwo := filepath.Join(testDir, "testDirTwo")
+	errUnreadable := errors.New("error: permission denied")
+
+	w := New()
+
+	// Make testDirTwo unreadable.
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		if fullPath == dirTwo {
+			return errUnreadable
+		}
+		return nil
+	})
+
+	// AddRecursive fails on the first error.
+	if err := w.AddRecursive(testDir); err == nil {
+		t.Fatal("expected AddRecursive to fail")
+	}
+
+	added, errs := w.AddRecursiveLenient(testDir)
+	if added != 6 {
+		t.Errorf("expected 6 files to be added, got %d", added)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %d", len(errs))
+	}
+	werr, ok := errs[0].(*WatcherError)
+	if !ok {
+		t.Fatalf("expected a *WatcherError, got %T", errs[0])
+	}
+	if werr.Path != dirTwo || werr.Err != errUnreadable {
+		t.Errorf("expected error for %s, got %v for %s", dirTwo, werr.Err, werr.Path)
+	}
+
+	if _, found := w.files[dirTwo]; found {
+		t.Errorf("expected to not find %s", dirTwo)
+	}
+	fileTxt := filepath.Join(testDir, "file.txt")
+	if _, found := w.files[fileTxt]; !found {
+		t.Errorf("expected to find %s", fileTxt)
+	}
+
+	// Subsequent scans skip the unreadable directory too.
+	fileList := w.retrieveFileList()
+	if len(fileList) != 6 {
+		t.Errorf("expected len(fileList) to be 6, got %d", len(fileList))
+	}
+}
+
+func TestBrokenSymlinkPolicy(t *testing.T) {
+	// Symlinks need special privileges under windows.
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	testCases := []struct {
+		policy     BrokenSymlinkPolicy
+		linkRemove bool
+	}{
+		{KeepWatching, false},
+		{ReportRemove, true},
+	}
+
+	for _, tc := range testCases {
+		testDir, teardown := setup(t)
+
+		target := filepath.Join(testDir, "file.txt")
+		link := filepath.Join(testDir, "link.txt")
+		if err := os.Symlink(target, link); err != nil {
+			teardown()
+			t.Fatal(err)
+		}
+
+		w := New()
+		w.SetBrokenSymlinkPolicy(tc.policy)
+		w.FilterOps(Remove)
+
+		if err := w.Add(testDir); err != nil {
+			teardown()
+			t.Fatal(err)
+		}
+
+		startWatcher(t, w, time.Millisecond*100)
+
+		// Break the link.
+		if err := os.Remove(target); err != nil {
+			t.Fatal(err)
+		}
+
+		removed := make(map[string]bool)
+	loop:
+		for {
+			select {
+			case event := <-w.Event:
+				removed[event.Path] = true
+			case <-time.After(time.Millisecond * 250):
+				break loop
+			}
+		}
+
+		if !removed[target] {
+			t.Errorf("expected a remove event for the link's target")
+		}
+		if removed[link] != tc.linkRemove {
+			t.Errorf("expected link removed to be %t with policy %d, got %t",
+				tc.linkRemove, tc.policy, removed[link])
+		}
+
+		w.Close()
+		teardown()
+	}
+}
+
+func TestNoGoroutineLeaks(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*10)
+	w.Wait()
+
+	if w.goroutineCount() == 0 {
+		t.Error("expected the watcher to be running goroutines")
+	}
+
+	// Let a few cycles run before closing.
+	time.Sleep(time.Millisecond * 50)
+	w.Close()
+
+	select {
+	case <-w.Done():
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("expected Done to be closed after Close")
+	}
+
+	if n := w.goroutineCount(); n != 0 {
+		t.Errorf("expected no goroutines after Close, got %d", n)
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2020, time.January, 6, 10, 7, 30, 0, time.UTC) // A monday.
+
+	testCases := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * * *", time.Date(2020, time.January, 6, 10, 7, 31, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, time.January, 6, 10, 15, 0, 0, time.UTC)},
+		{"0 9-17 * * 1-5", time.Date(2020, time.January, 6, 11, 0, 0, 0, time.UTC)},
+		{"30 8 * * 0", time.Date(2020, time.January, 12, 8, 30, 0, 0, time.UTC)},
+		{"0 0 1 3 *", time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		sched, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %s", tc.spec, err)
+			continue
+		}
+		if next := sched.next(from); !next.Equal(tc.expected) {
+			t.Errorf("%q: expected next to be %s, got %s", tc.spec, tc.expected, next)
+		}
+	}
+
+	// The hour and minute fields are matched on the wall clock, even in
+	// zones whose offset isn't a whole number of hours.
+	ist := time.FixedZone("IST", 5*60*60+30*60)
+	from = time.Date(2020, time.January, 6, 10, 7, 30, 0, ist)
+	zoneCases := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"0 0 9 * * *", time.Date(2020, time.January, 7, 9, 0, 0, 0, ist)},
+		{"*/15 * * * *", time.Date(2020, time.January, 6, 10, 15, 0, 0, ist)},
+		{"0 9-17 * * 1-5", time.Date(2020, time.January, 6, 11, 0, 0, 0, ist)},
+	}
+	for _, tc := range zoneCases {
+		sched, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %s", tc.spec, err)
+			continue
+		}
+		if next := sched.next(from); !next.Equal(tc.expected) {
+			t.Errorf("%q in %s: expected next to be %s, got %s", tc.spec, ist, tc.expected, next)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "0 0 30 2 *"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestStartSchedule(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.StartSchedule("bad spec"); err == nil {
+		t.Fatal("expected an error for an invalid schedule")
+	}
+
+	// Scan at the start of every second.
+	go func() {
+		if err := w.StartSchedule("* * * * * *"); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer w.Close()
+
+	for i := 0; i < 2; i++ {
+		newFile := filepath.Join(testDir, fmt.Sprintf("newfile_%d.txt", i))
+		if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case event := <-w.Event:
+			if event.Path != newFile {
+				t.Errorf("expected event.Path to be %s, got %s", newFile, event.Path)
+			}
+			// Scans happen on the second.
+			if ms := time.Now().Nanosecond() / int(time.Millisecond); ms > 250 {
+				t.Errorf("expected the scan to happen at the start of a second, got %dms", ms)
+			}
+		case <-time.After(time.Millisecond * 1500):
+			t.Fatal("received no create event")
+		}
+	}
+}
+
+func TestRenameChainCoalescing(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	fileA := filepath.Join(testDir, "file.txt")
+	fileB := filepath.Join(testDir, "file_b.txt")
+	fileC := filepath.Join(testDir, "file_c.txt")
+
+	w := New()
+	w.FilterOps(Rename)
+	w.SetRenameChainCoalescing(time.Millisecond * 500)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// Rename the file twice, letting a cycle see each of the renames.
+	if err := os.Rename(fileA, fileB); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	if err := os.Rename(fileB, fileC); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Rename {
+			t.Errorf("expected event to be Rename, got %s", event.Op)
+		}
+		if event.OldPath != fileA {
+			t.Errorf("expected event.OldPath to be %s, got %s", fileA, event.OldPath)
+		}
+		if event.Path != fileC {
+			t.Errorf("expected event.Path to be %s, got %s", fileC, event.Path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("received no rename event")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected a single rename event, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+// memBackend is an in-memory Backend, standing in for a remote filesystem.
+type memBackend struct {
+	mu    sync.Mutex
+	files map[string]*fileInfo
+}
+
+func (b *memBackend) write(path string, dir bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	mode := os.FileMode(0644)
+	if dir {
+		mode = os.ModeDir | 0755
+	}
+	b.files[path] = &fileInfo{
+		name:    filepath.Base(path),
+		mode:    mode,
+		modTime: time.Now(),
+		dir:     dir,
+	}
+}
+
+func (b *memBackend) chmod(path string, perm os.FileMode) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	info := b.files[path]
+	info.mode = info.mode&^os.ModePerm | perm
+}
+
+func (b *memBackend) remove(path string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.files, path)
+}
+
+func (b *memBackend) Stat(path string) (os.FileInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	info, found := b.files[path]
+	if !found {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	copied := *info
+	return &copied, nil
+}
+
+func (b *memBackend) Lstat(path string) (os.FileInfo, error) {
+	return b.Stat(path)
+}
+
+func (b *memBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if info, found := b.files[path]; found && info.mode&0400 == 0 {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrPermission}
+	}
+	var infos []os.FileInfo
+	for p, info := range b.files {
+		if filepath.Dir(p) == path && p != path {
+			copied := *info
+			infos = append(infos, &copied)
+		}
+	}
+	return infos, nil
+}
+
+// plusMemBackend is a memBackend that implements ReadDirPlusBackend and
+// counts its round trips, charging a ReadDir one round trip for the listing
+// and one for each entry's attributes, like NFS without READDIRPLUS.
+type plusMemBackend struct {
+	*memBackend
+	trips     int
+	plusCalls int
+}
+
+func newPlusMemBackend(dirs, filesPerDir int) *plusMemBackend {
+	backend := &plusMemBackend{memBackend: &memBackend{files: make(map[string]*fileInfo)}}
+	backend.write("/remote", true)
+	for i := 0; i < dirs; i++ {
+		dir := fmt.Sprintf("/remote/dir_%d", i)
+		backend.write(dir, true)
+		for j := 0; j < filesPerDir; j++ {
+			backend.write(fmt.Sprintf("%s/file_%d.txt", dir, j), false)
+		}
+	}
+	return backend
+}
+
+func (b *plusMemBackend) Stat(path string) (os.FileInfo, error) {
+	b.trips++
+	return b.memBackend.Stat(path)
+}
+
+func (b *plusMemBackend) Lstat(path string) (os.FileInfo, error) {
+	b.trips++
+	return b.memBackend.Lstat(path)
+}
+
+func (b *plusMemBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	infos, err := b.memBackend.ReadDir(path)
+	b.trips += 1 + len(infos)
+	return infos, err
+}
+
+func (b *plusMemBackend) ReadDirPlus(root string) (map[string]os.FileInfo, error) {
+	b.trips++
+	b.plusCalls++
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	infos := make(map[string]os.FileInfo)
+	for path, info := range b.files {
+		if path == root || strings.HasPrefix(path, root+"/") {
+			copied := *info
+			infos[path] = &copied
+		}
+	}
+	if len(infos) == 0 {
+		return nil, &os.PathError{Op: "readdirplus", Path: root, Err: os.ErrNotExist}
+	}
+	return infos, nil
+}
+
+func TestSetReadDirPlus(t *testing.T) {
+	backend := newPlusMemBackend(3, 3)
+
+	w := New()
+	w.SetBackend(backend, "/remote")
+
+	plus := New()
+	plus.SetBackend(backend, "/remote")
+	plus.SetReadDirPlus(true)
+
+	for _, w := range []*Watcher{w, plus} {
+		if err := w.AddRecursive("/remote"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backend.plusCalls != 1 {
+		t.Fatalf("expected 1 call to ReadDirPlus, got %d", backend.plusCalls)
+	}
+
+	if watched, plusWatched := w.WatchedFiles(), plus.WatchedFiles(); len(watched) != len(plusWatched) {
+		t.Errorf("expected %d files to be watched with ReadDirPlus, got %d",
+			len(watched), len(plusWatched))
+	}
+
+	backend.write("/remote/dir_0/new.txt", false)
+	backend.write("/remote/dir_3", true)
+	backend.remove("/remote/dir_1/file_0.txt")
+	backend.chmod("/remote/dir_2/file_1.txt", 0600)
+
+	describe := func(events []Event, errs []error) []string {
+		if len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		var s []string
+		for _, e := range events {
+			s = append(s, e.Op.String()+" "+e.Path)
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	backend.trips = 0
+	events := describe(w.Changes())
+	trips := backend.trips
+
+	backend.trips = 0
+	plusEvents := describe(plus.Changes())
+	plusTrips := backend.trips
+
+	if len(events) == 0 {
+		t.Fatal("expected changes to be found")
+	}
+	if !reflect.DeepEqual(events, plusEvents) {
+		t.Errorf("expected the same events with ReadDirPlus, got\n%v\nand\n%v", events, plusEvents)
+	}
+	if plusTrips != 1 || plusTrips >= trips {
+		t.Errorf("expected 1 round trip with ReadDirPlus and more without, got %d and %d",
+			plusTrips, trips)
+	}
+
+	// A tree that ReadDirPlus can't list is listed directory by directory.
+	backend.remove("/remote")
+	if _, err := plus.listRecursive("/remote"); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error listing a removed root, got %v", err)
+	}
+}
+
+func TestSetBackend(t *testing.T) {
+	backend := &memBackend{files: make(map[string]*fileInfo)}
+	backend.write("/remote", true)
+	backend.write("/remote/dir", true)
+	backend.write("/remote/dir/file.txt", false)
+
+	w := New()
+	w.SetBackend(backend, "/remote")
+
+	// Relative paths are joined to the backend's root.
+	if err := w.AddRecursive("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := w.WatchedFiles()["/remote/dir/file.txt"]; !found {
+		t.Fatalf("expected /remote/dir/file.txt to be watched, got %v", w.WatchedFiles())
+	}
+
+	w.FilterOps(Create, Write, Remove)
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	testCases := []struct {
+		change func()
+		op     Op
+		path   string
+	}{
+		{func() { backend.write("/remote/dir/new.txt", false) }, Create, "/remote/dir/new.txt"},
+		{func() { backend.write("/remote/dir/file.txt", false) }, Write, "/remote/dir/file.txt"},
+		{func() { backend.remove("/remote/dir/new.txt") }, Remove, "/remote/dir/new.txt"},
+	}
+
+	for _, tc := range testCases {
+		tc.change()
+
+		select {
+		case event := <-w.Event:
+			if event.Op != tc.op {
+				t.Errorf("expected event to be %s, got %s", tc.op, event.Op)
+			}
+			if event.Path != tc.path {
+				t.Errorf("expected event.Path to be %s, got %s", tc.path, event.Path)
+			}
+		case <-time.After(time.Millisecond * 250):
+			t.Fatalf("received no %s event", tc.op)
+		}
+	}
+}
+
+// bareErrBackend is a memBackend that returns os.ErrNotExist itself for
+// missing files, rather than wrapping it in an *os.PathError.
+type bareErrBackend struct {
+	*memBackend
+}
+
+func (b *bareErrBackend) Stat(path string) (os.FileInfo, error) {
+	info, err := b.memBackend.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	}
+	return info, err
+}
+
+func (b *bareErrBackend) Lstat(path string) (os.FileInfo, error) {
+	return b.Stat(path)
+}
+
+func TestBackendBareNotExistError(t *testing.T) {
+	backend := &bareErrBackend{&memBackend{files: make(map[string]*fileInfo)}}
+	backend.write("/remote", true)
+	backend.write("/remote/file.txt", false)
+	backend.write("/single.txt", false)
+
+	w := New()
+	w.SetBackend(backend, "/")
+
+	if err := w.AddRecursive("/remote"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add("/single.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the roots mustn't panic, even though the errors don't
+	// say which path is missing.
+	backend.remove("/remote/file.txt")
+	backend.remove("/remote")
+	backend.remove("/single.txt")
+
+	removed := make(map[string]bool)
+	events, _ := w.Changes()
+	for _, event := range events {
+		if event.Op == Remove {
+			removed[event.Path] = true
+		}
+	}
+	for _, path := range []string{"/remote", "/remote/file.txt", "/single.txt"} {
+		if !removed[path] {
+			t.Errorf("expected a Remove event for %s, got %v", path, removed)
+		}
+	}
+
+	// The watcher's lock is still usable afterwards.
+	if events, _ := w.Changes(); len(events) != 0 {
+		t.Errorf("expected no more events, got %v", events)
+	}
+}
+
+func TestSetTriggerDefaults(t *testing.T) {
+	w := New()
+	w.SetTriggerDefaults("heartbeat", os.ModeNamedPipe|0644)
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	go w.TriggerEvent(Write, nil)
+
+	select {
+	case event := <-w.Event:
+		if event.Name() != "heartbeat" {
+			t.Errorf("expected event file name to be heartbeat, got %s", event.Name())
+		}
+		if event.Mode() != os.ModeNamedPipe|0644 {
+			t.Errorf("expected event file mode to be %s, got %s",
+				os.ModeNamedPipe|0644, event.Mode())
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no event from Event channel")
+	}
+}
+
+func TestHierarchicalOrdering(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetHierarchicalOrdering(true)
+	w.FilterOps(Create, Remove)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	tree := filepath.Join(testDir, "a")
+	paths := []string{
+		tree,
+		filepath.Join(tree, "b"),
+		filepath.Join(tree, "b", "c"),
+		filepath.Join(tree, "b", "c", "file.txt"),
+		filepath.Join(tree, "b", "file.txt"),
+	}
+
+	// receive returns the paths of the events for op, in order.
+	receive := func(op Op) []string {
+		var received []string
+		for len(received) < len(paths) {
+			select {
+			case event := <-w.Event:
+				if event.Op != op {
+					t.Fatalf("expected event to be %s, got %s", op, event.Op)
+				}
+				received = append(received, event.Path)
+			case <-time.After(time.Millisecond * 500):
+				t.Fatalf("received %d of %d %s events", len(received), len(paths), op)
+			}
+		}
+		return received
+	}
+
+	// indexOf returns the position of path in received.
+	indexOf := func(received []string, path string) int {
+		for i, p := range received {
+			if p == path {
+				return i
+			}
+		}
+		t.Fatalf("received no event for %s", path)
+		return -1
+	}
+
+	// Create the whole tree in one cycle.
+	if err := os.MkdirAll(filepath.Join(tree, "b", "c"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join("b", "c", "file.txt"), filepath.Join("b", "file.txt")} {
+		if err := ioutil.WriteFile(filepath.Join(tree, name), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created := receive(Create)
+	for _, path := range paths[1:] {
+		if parent := filepath.Dir(path); indexOf(created, parent) > indexOf(created, path) {
+			t.Errorf("expected Create for %s before %s, got %v", parent, path, created)
+		}
+	}
+
+	// Remove the whole tree in one cycle.
+	if err := os.RemoveAll(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := receive(Remove)
+	for _, path := range paths[1:] {
+		if parent := filepath.Dir(path); indexOf(removed, parent) < indexOf(removed, path) {
+			t.Errorf("expected Remove for %s after %s, got %v", parent, path, removed)
+		}
+	}
+}
+
+func TestSetSince(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	since := time.Now().Add(-time.Hour)
+	oldTime := since.Add(-time.Hour)
+	newTime := since.Add(time.Minute)
+
+	// Make every file in testDir old, apart from the new ones.
+	newFiles := map[string]bool{
+		filepath.Join(testDir, "file.txt"):                         true,
+		filepath.Join(testDir, "testDirTwo", "file_recursive.txt"): true,
+	}
+	err := filepath.Walk(testDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if newFiles[path] {
+			return os.Chtimes(path, newTime, newTime)
+		}
+		return os.Chtimes(path, oldTime, oldTime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.SetSince(since)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	for len(newFiles) > 0 {
+		select {
+		case event := <-w.Event:
+			if event.Op != Create {
+				t.Errorf("expected event to be Create, got %s", event.Op)
+			}
+			if !newFiles[event.Path] {
+				t.Errorf("unexpected event for old file %s", event.Path)
+			}
+			delete(newFiles, event.Path)
+		case <-time.After(time.Millisecond * 250):
+			t.Fatalf("received no events for %v", newFiles)
+		}
+	}
+
+	// Later cycles behave normally.
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected no more events, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.IgnoreHiddenFiles(true)
+	w.FilterOps(Create, Remove)
+	w.SetMaxEvents(5)
+	w.SetHierarchicalOrdering(true)
+	w.SetRenameChainCoalescing(time.Second)
+	w.SetDirModTimeScanning(true)
+	w.SetForcedFullScanEvery(10)
+	w.SetYieldEvery(50)
+	w.SetSignificantFields(FieldSize | FieldModTime)
+	w.FilterOwner(os.Getuid(), -1)
+	w.SetTriggerDefaults("heartbeat", 0644)
+
+	if err := w.Ignore(filepath.Join(testDir, "file_1.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.IgnoreDoubleStar("**/*.log"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddRecursive(filepath.Join(testDir, "testDirTwo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddWithOps(filepath.Join(testDir, "file.txt"), Write); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WatchChildCount(testDir, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SuspendRoot(filepath.Join(testDir, "testDirTwo")); err != nil {
+		t.Fatal(err)
+	}
+	w.Suspend()
+
+	startWatcher(t, w, time.Millisecond*100)
+	w.Wait()
+
+	data, err := w.MarshalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close clears the watched files, so check them first.
+	cfg, watched := w.Config(), w.WatchedFiles()
+	w.Close()
+
+	if len(cfg.Roots) != 3 {
+		t.Fatalf("expected 3 roots, got %v", cfg.Roots)
+	}
+	if len(cfg.RootOps) != 1 || len(cfg.SuspendedRoots) != 1 || !cfg.Suspended {
+		t.Errorf("expected a root with ops and suspended roots, got %v, %v and %t",
+			cfg.RootOps, cfg.SuspendedRoots, cfg.Suspended)
+	}
+	if cfg.Interval != time.Millisecond*100 {
+		t.Errorf("expected interval to be 100ms, got %s", cfg.Interval)
+	}
+
+	loaded, err := LoadConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loadedCfg := loaded.Config(); !reflect.DeepEqual(cfg, loadedCfg) {
+		t.Errorf("expected loaded config to be\n%+v\ngot\n%+v", cfg, loadedCfg)
+	}
+	if loadedWatched := loaded.WatchedFiles(); len(watched) != len(loadedWatched) {
+		t.Errorf("expected loaded watcher to watch %d files, got %d",
+			len(watched), len(loadedWatched))
+	}
+
+	if _, err := LoadConfig([]byte(`{"ops":["BOGUS"]}`)); err == nil {
+		t.Error("expected an error for an unknown op")
+	}
+}
+
+func TestLoadPartialConfig(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	// A config with only roots, like one saved before the other options
+	// existed.
+	data := []byte(fmt.Sprintf(`{"roots":[{"path":%q}]}`, testDir))
+
+	w, err := LoadConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Options missing from the config should keep their defaults.
+	cfg, defaults := w.Config(), New().Config()
+	defaults.Roots = cfg.Roots
+	if !reflect.DeepEqual(cfg, defaults) {
+		t.Errorf("expected loaded config to be\n%+v\ngot\n%+v", defaults, cfg)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// Writes are still detected and files aren't filtered by owner.
+	file := filepath.Join(testDir, "file.txt")
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Write || event.Path != file {
+			t.Errorf("expected a write event for %s, got %v", file, event)
+		}
+	case err := <-w.Error:
+		t.Fatal(err)
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("received no write event")
+	}
+}
+
+func TestWalkErrorWarning(t *testing.T) {
+	backend := &memBackend{files: make(map[string]*fileInfo)}
+	backend.write("/remote", true)
+	backend.write("/remote/file.txt", false)
+	backend.write("/remote/zz.txt", false)
+
+	w := New()
+	w.SetBackend(backend, "/remote")
+	w.SetWarningsChannel(true)
+
+	if err := w.AddRecursive("/remote"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory that can't be read shouldn't stop the rest of the
+	// directory from being scanned.
+	backend.write("/remote/locked", true)
+	backend.chmod("/remote/locked", 0)
+	backend.write("/remote/new.txt", false)
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer func() {
+		// The warning is sent every scan, so keep receiving until the
+		// watcher has closed.
+		closed := make(chan struct{})
+		go func() {
+			w.Close()
+			close(closed)
+		}()
+		for {
+			select {
+			case <-w.Event:
+			case <-w.Warnings:
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	var warned, created bool
+	for !warned || !created {
+		select {
+		case err := <-w.Warnings:
+			werr, ok := err.(*WatcherError)
+			if !ok || werr.Severity != Warning {
+				t.Fatalf("expected a warning, got %v", err)
+			}
+			walkErr, ok := werr.Err.(*WalkError)
+			if !ok || walkErr.Path != "/remote/locked" || !os.IsPermission(walkErr.Err) {
+				t.Fatalf("expected a permission WalkError for /remote/locked, got %v", werr.Err)
+			}
+			warned = true
+		case event := <-w.Event:
+			if event.Op != Create || event.Path != "/remote/new.txt" {
+				t.Fatalf("expected only a create event for /remote/new.txt, got %v", event)
+			}
+			created = true
+		case err := <-w.Error:
+			t.Fatalf("expected no errors on the Error channel, got %v", err)
+		case <-time.After(time.Millisecond * 500):
+			t.Fatal("received no warning and create event")
+		}
+	}
+}
+
+// flakyBackend is a memBackend that fails to list directories for a set
+// number of calls.
+type flakyBackend struct {
+	*memBackend
+	fails map[string]int
+}
+
+func (b *flakyBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	b.mu.Lock()
+	fails := b.fails[path]
+	if fails > 0 {
+		b.fails[path]--
+	}
+	b.mu.Unlock()
+	if fails > 0 {
+		return nil, fmt.Errorf("%s: transient error", path)
+	}
+	return b.memBackend.ReadDir(path)
+}
+
+func (b *flakyBackend) fail(path string, n int) {
+	b.mu.Lock()
+	b.fails[path] = n
+	b.mu.Unlock()
+}
+
+func TestSetStatFailureThreshold(t *testing.T) {
+	backend := &flakyBackend{
+		memBackend: &memBackend{files: make(map[string]*fileInfo)},
+		fails:      make(map[string]int),
+	}
+	backend.write("/remote", true)
+	backend.write("/remote/file.txt", false)
+	backend.write("/remote/dir", true)
+	backend.write("/remote/dir/a.txt", false)
+
+	w := New()
+	w.SetBackend(backend, "/remote")
+	w.SetManualTicks(true)
+	w.SetStatFailureThreshold(3)
+
+	if err := w.AddRecursive("/remote"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	tick := func() map[string]Op {
+		ticked := make(chan error)
+		go func() { ticked <- w.Tick() }()
+
+		ops := make(map[string]Op)
+		for {
+			select {
+			case event := <-w.Event:
+				ops[event.Path] = event.Op
+			case err := <-w.Error:
+				t.Fatalf("expected no errors, got %v", err)
+			case err := <-ticked:
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ops
+			}
+		}
+	}
+
+	// Failures for fewer cycles than the threshold are retried silently.
+	backend.fail("/remote/dir", 2)
+	for i := 0; i < 3; i++ {
+		if ops := tick(); len(ops) != 0 {
+			t.Fatalf("expected no events on cycle %d, got %v", i+1, ops)
+		}
+	}
+
+	// Once the threshold is reached, the directory is removed.
+	backend.fail("/remote/dir", 3)
+	for i := 0; i < 2; i++ {
+		if ops := tick(); len(ops) != 0 {
+			t.Fatalf("expected no events on cycle %d, got %v", i+1, ops)
+		}
+	}
+	expected := map[string]Op{"/remote/dir": Remove, "/remote/dir/a.txt": Remove}
+	if ops := tick(); !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected events %v, got %v", expected, ops)
+	}
+
+	// It's created again once it can be listed.
+	expected = map[string]Op{"/remote/dir": Create, "/remote/dir/a.txt": Create}
+	if ops := tick(); !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected events %v, got %v", expected, ops)
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.IgnoreHiddenFiles(true)
+	w.SetMaxEvents(3)
+
+	if err := w.Ignore(filepath.Join(testDir, "file_1.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := w.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New()
+	if err := restored.ImportState(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, restoredCfg := w.Config(), restored.Config(); !reflect.DeepEqual(cfg, restoredCfg) {
+		t.Errorf("expected restored config to be\n%+v\ngot\n%+v", cfg, restoredCfg)
+	}
+
+	watched, restoredWatched := w.WatchedFiles(), restored.WatchedFiles()
+	if len(watched) != len(restoredWatched) {
+		t.Errorf("expected restored watcher to watch %d files, got %d",
+			len(watched), len(restoredWatched))
+	}
+	for path := range watched {
+		if _, found := restoredWatched[path]; !found {
+			t.Errorf("expected restored watcher to watch %s", path)
+		}
+	}
+	if _, found := restoredWatched[filepath.Join(testDir, "file_1.txt")]; found {
+		t.Error("expected restored watcher to still ignore file_1.txt")
+	}
+
+	startWatcher(t, restored, time.Millisecond*100)
+	defer restored.Close()
+
+	restored.Wait()
+
+	if err := restored.ImportState(data); err != ErrWatcherRunning {
+		t.Errorf("expected ErrWatcherRunning importing into a running watcher, got %v", err)
+	}
+}
+
+func TestUnreadableDir(t *testing.T) {
+	// Use an in-memory backend, since permissions don't stop root from
+	// reading a directory.
+	backend := &memBackend{files: make(map[string]*fileInfo)}
+	backend.write("/remote", true)
+	backend.write("/remote/dir", true)
+	backend.write("/remote/dir/file_1.txt", false)
+	backend.write("/remote/dir/file_2.txt", false)
+	backend.write("/remote/file.txt", false)
+
+	w := New()
+	w.SetBackend(backend, "/remote")
+
+	if err := w.AddRecursive("/remote"); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	backend.chmod("/remote/dir", 0)
+
+	select {
+	case err := <-w.Error:
+		werr, ok := err.(*WatcherError)
+		if !ok || werr.Err != ErrDirUnreadable || werr.Severity != Warning {
+			t.Fatalf("expected an ErrDirUnreadable warning, got %v", err)
+		}
+		if werr.Path != "/remote/dir" {
+			t.Errorf("expected warning for /remote/dir, got %s", werr.Path)
+		}
+	case event := <-w.Event:
+		t.Fatalf("expected no events for an unreadable directory, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no warning for the unreadable directory")
+	}
+
+	// The warning is only sent once, and the directory's contents are kept.
+	select {
+	case err := <-w.Error:
+		t.Fatalf("expected a single warning, got %v", err)
+	case event := <-w.Event:
+		t.Fatalf("expected no events for an unreadable directory, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+
+	if _, found := w.WatchedFiles()["/remote/dir/file_1.txt"]; !found {
+		t.Error("expected the unreadable directory's files to still be watched")
+	}
+
+	// Changes inside of the directory are reported once it's readable again.
+	backend.remove("/remote/dir/file_2.txt")
+	backend.chmod("/remote/dir", 0755)
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Remove || event.Path != "/remote/dir/file_2.txt" {
+			t.Errorf("expected a Remove event for /remote/dir/file_2.txt, got %s", event)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no remove event")
+	}
+}
+
+func TestFilterOwner(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	// Files starting with other_ are owned by another user.
+	defer func(f func(os.FileInfo) (int, int, bool)) { fileOwner = f }(fileOwner)
+	fileOwner = func(info os.FileInfo) (int, int, bool) {
+		if strings.HasPrefix(info.Name(), "other_") {
+			return 2000, 2000, true
+		}
+		return 1000, 1000, true
+	}
+
+	w := New()
+	w.FilterOwner(1000, -1)
+	w.FilterOps(Create)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	otherFile := filepath.Join(testDir, "other_file.txt")
+	ownFile := filepath.Join(testDir, "testDirTwo", "own_file.txt")
+	for _, path := range []string{otherFile, ownFile} {
+		if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Path != ownFile {
+			t.Errorf("expected event.Path to be %s, got %s", ownFile, event.Path)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no create event")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected no event for a file owned by another user, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+
+	if _, found := w.WatchedFiles()[otherFile]; found {
+		t.Errorf("expected %s not to be watched", otherFile)
+	}
+}
+
+func TestManualTicks(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+	w.FilterOps(Create, Remove, Rename)
+
+	if err := w.Tick(); err != ErrWatcherNotRunning {
+		t.Errorf("expected error to be ErrWatcherNotRunning, got %v", err)
+	}
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// tick runs a cycle and returns the events that it sent.
+	tick := func() []Event {
+		ticked := make(chan error)
+		go func() { ticked <- w.Tick() }()
+
+		var events []Event
+		for {
+			select {
+			case event := <-w.Event:
+				events = append(events, event)
+			case err := <-ticked:
+				if err != nil {
+					t.Fatal(err)
+				}
+				return events
+			}
+		}
+	}
+
+	newFile := filepath.Join(testDir, "newfile.txt")
+	renamedFile := filepath.Join(testDir, "renamed.txt")
+
+	testCases := []struct {
+		change func() error
+		op     Op
+		path   string
+	}{
+		{func() error { return ioutil.WriteFile(newFile, []byte{}, 0755) }, Create, newFile},
+		{func() error { return os.Rename(newFile, renamedFile) }, Rename, renamedFile},
+		{func() error { return os.Remove(renamedFile) }, Remove, renamedFile},
+	}
+
+	for _, tc := range testCases {
+		if err := tc.change(); err != nil {
+			t.Fatal(err)
+		}
+
+		events := tick()
+		if len(events) != 1 {
+			t.Fatalf("expected 1 %s event, got %v", tc.op, events)
+		}
+		if events[0].Op != tc.op || events[0].Path != tc.path {
+			t.Errorf("expected a %s event for %s, got %s", tc.op, tc.path, events[0])
+		}
+
+		// Nothing happens without a change.
+		if events := tick(); len(events) != 0 {
+			t.Errorf("expected no events, got %v", events)
+		}
+	}
+
+	if err := New().Tick(); err != ErrNotManualTicks {
+		t.Errorf("expected error to be ErrNotManualTicks, got %v", err)
+	}
+}
+
+func TestLinkCountEvents(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("link counts are not supported on windows")
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	// Keep the second link to file.txt outside of the watched directory.
+	otherDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherDir)
+
+	fileTxt := filepath.Join(testDir, "file.txt")
+	otherLink := filepath.Join(otherDir, "link.txt")
+	if err := os.Link(fileTxt, otherLink); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.SetLinkCountEvents(true)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// Remove the other name for file.txt, dropping its link count from 2 to 1.
+	if err := os.Remove(otherLink); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Op != LinkCount {
+			t.Fatalf("expected event to be LinkCount, got %s", event.Op)
+		}
+		if event.Path != fileTxt {
+			t.Errorf("expected event.Path to be %s, got %s", fileTxt, event.Path)
+		}
+		if links, _ := linkCount(event.FileInfo); links != 1 {
+			t.Errorf("expected a link count of 1, got %d", links)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no link count event")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected no more events, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestSetYieldEvery(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	for i := 0; i < 100; i++ {
+		path := filepath.Join(testDir, fmt.Sprintf("yield_%03d.txt", i))
+		if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With a single P, another goroutine only runs during the scan if the
+	// scan yields to it.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	w := New()
+	w.SetYieldEvery(10)
+
+	consumer := make(chan struct{})
+	scanned := 0
+	progressed := false
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		if scanned++; scanned == 50 {
+			select {
+			case <-consumer:
+				progressed = true
+			default:
+			}
+		}
+		return nil
+	})
+
+	go close(consumer)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if !progressed {
+		t.Error("expected the consumer goroutine to run during the scan")
+	}
+}
+
+func TestEventFingerprints(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	original := filepath.Join(testDir, "testDirTwo", "file_recursive.txt")
+	if err := ioutil.WriteFile(original, []byte("some contents"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.SetEventFingerprints(true)
+	w.FilterOps(Create)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// Copy the file to a new name, and create a file of the same size with
+	// different contents.
+	duplicate := filepath.Join(testDir, "copy.txt")
+	different := filepath.Join(testDir, "different.txt")
+	if err := ioutil.WriteFile(duplicate, []byte("some contents"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(different, []byte("other content"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-w.Event:
+			switch event.Path {
+			case duplicate:
+				if event.DuplicateOf != original {
+					t.Errorf("expected event.DuplicateOf to be %s, got %q",
+						original, event.DuplicateOf)
+				}
+			case different:
+				if event.DuplicateOf != "" {
+					t.Errorf("expected no DuplicateOf, got %s", event.DuplicateOf)
+				}
+			default:
+				t.Errorf("unexpected event %s", event)
+			}
+		case <-time.After(time.Millisecond * 250):
+			t.Fatal("received no create event")
+		}
+	}
+}
+
+func TestHookPanic(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	panicFile := filepath.Join(testDir, "panic.txt")
+
+	w := New()
+	w.FilterOps(Create)
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		if fullPath == panicFile {
+			panic("bad hook")
+		}
+		return nil
+	})
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	if err := ioutil.WriteFile(panicFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-w.Error:
+		werr, ok := err.(*WatcherError)
+		if !ok {
+			t.Fatalf("expected a *WatcherError, got %T", err)
+		}
+		perr, ok := werr.Err.(*HookPanicError)
+		if !ok {
+			t.Fatalf("expected a *HookPanicError, got %T", werr.Err)
+		}
+		if perr.Unwrap() != ErrHookPanic {
+			t.Errorf("expected the error to wrap ErrHookPanic")
+		}
+		if perr.Value != "bad hook" || len(perr.Stack) == 0 {
+			t.Errorf("expected the panic value and stack, got %v", perr.Value)
+		}
+		if werr.Path != panicFile {
+			t.Errorf("expected the error's path to be %s, got %s", panicFile, werr.Path)
+		}
+	case event := <-w.Event:
+		t.Fatalf("expected the panicking file to be skipped, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no error for the panicking hook")
+	}
+
+	// Drain the errors from the following cycles.
+	go func() {
+		for {
+			select {
+			case <-w.Error:
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+
+	// The watcher keeps watching.
+	newFile := filepath.Join(testDir, "newfile.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Path != newFile {
+			t.Errorf("expected event.Path to be %s, got %s", newFile, event.Path)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no create event")
+	}
+}
+
+func TestDirDebounce(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	testDirTwo := filepath.Join(testDir, "testDirTwo")
+
+	w := New()
+	w.SetDirDebounce(time.Millisecond * 300)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// Change several files in testDirTwo across a few cycles.
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(testDirTwo, fmt.Sprintf("file_%d.txt", i))
+		if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if err := os.Remove(filepath.Join(testDirTwo, "file_recursive.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Write {
+			t.Errorf("expected event to be Write, got %s", event.Op)
+		}
+		if event.Path != testDirTwo {
+			t.Errorf("expected event.Path to be %s, got %s", testDirTwo, event.Path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("received no directory event")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected a single directory event, got %s", event)
+	case <-time.After(time.Millisecond * 500):
+	}
+}
+
+func TestSetSignificantFields(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	fileTxt := filepath.Join(testDir, "file.txt")
+
+	w := New()
+	w.SetSignificantFields(FieldSize)
+	w.FilterOps(Write)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// Only change the mod time.
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(fileTxt, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Fatalf("expected no event for a mod time change, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+
+	// Change the size.
+	if err := ioutil.WriteFile(fileTxt, []byte("hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Path != fileTxt {
+			t.Errorf("expected event.Path to be %s, got %s", fileTxt, event.Path)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no write event for a size change")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	fileTxt := filepath.Join(testDir, "file.txt")
+	otherFile := filepath.Join(testDir, "file_1.txt")
+
+	w := New()
+	w.FilterOps(Write)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Refresh(filepath.Join(testDir, "missing.txt")); err != ErrNotWatched {
+		t.Errorf("expected error to be ErrNotWatched, got %v", err)
+	}
+
+	// Write to both files, but refresh only one of them.
+	for _, path := range []string{fileTxt, otherFile} {
+		if err := ioutil.WriteFile(path, []byte("hello"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Refresh(fileTxt); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	select {
+	case event := <-w.Event:
+		if event.Path != otherFile {
+			t.Errorf("expected event.Path to be %s, got %s", otherFile, event.Path)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no write event")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected no event for the refreshed file, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestAddWithOps(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	testDirTwo := filepath.Join(testDir, "testDirTwo")
+
+	w := New()
+
+	// testDirTwo only reports removes, while testDir reports everything.
+	if err := w.AddWithOps(testDirTwo, Remove); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	removed := filepath.Join(testDirTwo, "file_recursive.txt")
+	created := filepath.Join(testDir, "newfile.txt")
+	if err := ioutil.WriteFile(filepath.Join(testDirTwo, "ignored.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(created, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	var sawRemove, sawCreate bool
+	for {
+		select {
+		case event := <-w.Event:
+			if event.Root == testDirTwo && event.Op != Remove {
+				t.Errorf("expected only Remove events for %s, got %s", testDirTwo, event)
+			}
+			sawRemove = sawRemove || (event.Op == Remove && event.Path == removed)
+			sawCreate = sawCreate || (event.Op == Create && event.Path == created)
+			continue
+		case <-time.After(time.Millisecond * 250):
+		}
+		break
+	}
+
+	if !sawRemove {
+		t.Errorf("received no remove event for %s", removed)
+	}
+	if !sawCreate {
+		t.Errorf("received no create event for %s", created)
+	}
+}
+
+func TestAddWithOpsWhileRunning(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only stop reading events once the watcher is closed, or Close can
+	// block on a cycle that's sending one.
+	stop := make(chan struct{})
+	defer close(stop)
+
+	startWatcher(t, w, time.Millisecond)
+	defer w.Close()
+
+	w.Wait()
+
+	// Keep events coming for testDir, so that they're filtered while
+	// the roots are added and removed.
+	go func() {
+		touched := filepath.Join(testDir, "file.txt")
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-w.Event:
+			case <-time.After(time.Millisecond):
+				ioutil.WriteFile(touched, []byte(strings.Repeat("a", i%8)), 0755)
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		dir := filepath.Join(testDir, fmt.Sprintf("dir_%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddWithOps(dir, Remove); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		if err := w.Remove(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSetInodeInfo(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inode info is not supported on windows")
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetInodeInfo(true)
+	w.FilterOps(Create)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	newFile := filepath.Join(testDir, "newfile.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(newFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino, dev, _ := inodeOf(info)
+
+	select {
+	case event := <-w.Event:
+		if event.Ino != ino || event.Dev != dev {
+			t.Errorf("expected inode %d on device %d, got inode %d on device %d",
+				ino, dev, event.Ino, event.Dev)
+		}
+		if event.Ino == 0 {
+			t.Error("expected a non-zero inode")
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no create event")
+	}
+}
+
+func TestSnapshotTar(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	if err := ioutil.WriteFile(filepath.Join(testDir, "file.txt"), []byte("hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.IgnoreHiddenFiles(true)
+
+	if err := w.Ignore(filepath.Join(testDir, "file_3.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := w.SnapshotTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Base(testDir)
+	expected := []string{
+		base + "/file.txt",
+		base + "/file_1.txt",
+		base + "/file_2.txt",
+		base + "/testDirTwo/file_recursive.txt",
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+
+		if hdr.Name == base+"/file.txt" {
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(contents) != "hello" {
+				t.Errorf("expected file.txt to contain hello, got %q", contents)
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected entries %v, got %v", expected, names)
+	}
+}
+
+func TestSuppressEphemeral(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetSuppressEphemeral(time.Millisecond * 500)
+	w.FilterOps(Create, Remove)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	tempFile := filepath.Join(testDir, "temp.txt")
+	keptFile := filepath.Join(testDir, "kept.txt")
+	for _, path := range []string{tempFile, keptFile} {
+		if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Let a cycle see the temp file before removing it.
+	time.Sleep(time.Millisecond * 200)
+	if err := os.Remove(tempFile); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Create || event.Path != keptFile {
+			t.Errorf("expected only a Create event for %s, got %s", keptFile, event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("received no create event for the kept file")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected no events for the temp file, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestEventAge(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// Move in a file that was last modified an hour ago from testDirTwo,
+	// which isn't watched.
+	oldFile := filepath.Join(testDir, "testDirTwo", "file_recursive.txt")
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(oldFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(oldFile, filepath.Join(testDir, "newfile.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Age < time.Hour || event.Age > time.Hour+time.Second {
+			t.Errorf("expected event.Age to be about 1h, got %s", event.Age)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no create event")
+	}
+}
+
+func TestAddGlobSet(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	templates := filepath.Join(testDir, "templates")
+	if err := os.Mkdir(templates, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+
+	err := w.AddGlobSet(
+		filepath.Join(testDir, "**", "*.go"),
+		filepath.Join(templates, "**", "*.html"),
+		filepath.Join(testDir, "templates", "*.html"), // Overlaps the last pattern.
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.WatchedFiles()) != 0 {
+		t.Errorf("expected no files to be watched, got %v", w.WatchedFiles())
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	goFile := filepath.Join(testDir, "testDirTwo", "main.go")
+	htmlFile := filepath.Join(templates, "index.html")
+	for _, path := range []string{goFile, htmlFile, filepath.Join(testDir, "other.txt")} {
+		if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]bool{goFile: true, htmlFile: true}
+	for len(expected) > 0 {
+		select {
+		case event := <-w.Event:
+			if event.Op != Create || !expected[event.Path] {
+				t.Fatalf("unexpected event %s", event)
+			}
+			delete(expected, event.Path)
+		case <-time.After(time.Millisecond * 250):
+			t.Fatalf("received no create events for %v", expected)
+		}
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected no more events, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestTriggerEventContext(t *testing.T) {
+	w := New()
+
+	// The watcher hasn't started.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := w.TriggerEventContext(ctx, Create, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected error to be context.DeadlineExceeded, got %v", err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	// Nothing is receiving events.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := w.TriggerEventContext(ctx, Create, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected error to be context.DeadlineExceeded, got %v", err)
+	}
+
+	go func() {
+		event := <-w.Event
+		if event.Name() != "triggered event" {
+			t.Errorf("expected event file name to be triggered event, got %s", event.Name())
+		}
+	}()
+
+	if err := w.TriggerEventContext(context.Background(), Create, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddArchive(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	archive := filepath.Join(testDir, "out.zip")
+
+	// writeZip atomically replaces the archive with one containing entries,
+	// which are written with the given mod time.
+	writeZip := func(modTime time.Time, entries ...string) {
+		tmp := filepath.Join(testDir, "testDirTwo", "out.zip.tmp")
+		f, err := os.Create(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(f)
+		for _, name := range entries {
+			hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+			hdr.SetModTime(modTime)
+			ew, err := zw.CreateHeader(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ew.Write([]byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, archive); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeZip(modTime, "a.txt", "docs/b.txt")
+
+	w := New()
+
+	if err := w.AddArchive(filepath.Join(testDir, "missing.zip")); err == nil {
+		t.Error("expected an error adding a missing archive")
+	}
+	if err := w.AddArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	entryA := filepath.Join(archive, "a.txt")
+	entryB := filepath.Join(archive, "docs", "b.txt")
+	entryC := filepath.Join(archive, "c.txt")
+	for _, path := range []string{entryA, entryB} {
+		if _, found := w.WatchedFiles()[path]; !found {
+			t.Errorf("expected %s to be watched", path)
+		}
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	writeZip(modTime.Add(time.Hour), "a.txt", "c.txt")
+
+	expected := map[string]Op{entryA: Write, entryB: Remove, entryC: Create}
+	for len(expected) > 0 {
+		select {
+		case event := <-w.Event:
+			if op, found := expected[event.Path]; !found || op != event.Op {
+				t.Fatalf("unexpected event %s", event)
+			}
+			delete(expected, event.Path)
+		case <-time.After(time.Millisecond * 250):
+			t.Fatalf("received no events for %v", expected)
+		}
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected no more events, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+// slowBackend is a memBackend whose ReadDir hangs until hang is closed.
+type slowBackend struct {
+	*memBackend
+	hang chan struct{}
+}
+
+func (b *slowBackend) ReadDir(path string) ([]os.FileInfo, error) {
+	<-b.hang
+	return b.memBackend.ReadDir(path)
+}
+
+func TestSetScanTimeout(t *testing.T) {
+	mem := &memBackend{files: make(map[string]*fileInfo)}
+	mem.write("/remote", true)
+	mem.write("/remote/file.txt", false)
+
+	w := New()
+	w.SetBackend(mem, "/remote")
+	if err := w.AddRecursive("/remote"); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &slowBackend{memBackend: mem, hang: make(chan struct{})}
+	w.SetBackend(backend, "/remote")
+	w.SetScanTimeout(time.Millisecond * 50)
+
+	timeouts := make(chan error, 10)
+	go func() {
+		for {
+			select {
+			case err := <-w.Error:
+				select {
+				case timeouts <- err:
+				default:
+				}
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+
+	startWatcher(t, w, time.Millisecond*10)
+	defer w.Close()
+
+	w.Wait()
+
+	// Every scan times out while the backend hangs.
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-timeouts:
+			if err.(*WatcherError).Err != ErrScanTimeout {
+				t.Fatalf("expected error to be ErrScanTimeout, got %v", err)
+			}
+		case <-time.After(time.Millisecond * 250):
+			t.Fatal("received no scan timeout")
+		}
+	}
+
+	// The watcher keeps scanning once the backend responds again.
+	close(backend.hang)
+	mem.write("/remote/new.txt", false)
+
+	for {
+		select {
+		case event := <-w.Event:
+			if event.Path != "/remote/new.txt" {
+				continue
+			}
+			if event.Op != Create {
+				t.Errorf("expected event to be Create, got %s", event.Op)
+			}
+			return
+		case <-time.After(time.Millisecond * 250):
+			t.Fatal("received no create event")
+		}
+	}
+}
+
+func TestScanBackendIsLocalToScan(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetScanTimeout(time.Minute)
+	w.SetDirFDCaching(true)
+
+	// The watcher's backend isn't replaced while a scan is running, since
+	// w.mu is released part way through scans and another scan or an
+	// Add could otherwise pick up the scan's backend.
+	var during []Backend
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		during = append(during, w.backend)
+		return nil
+	})
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	during = nil
+
+	if _, errs := w.Changes(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	if len(during) == 0 {
+		t.Fatal("expected the filter hook to be called during the scan")
+	}
+	for _, backend := range during {
+		if _, ok := backend.(osBackend); !ok {
+			t.Fatalf("expected the watcher's backend to stay osBackend during a scan, got %T", backend)
+		}
+	}
+	if _, ok := w.backend.(osBackend); !ok {
+		t.Errorf("expected the watcher's backend to be osBackend after a scan, got %T", w.backend)
+	}
+}
+
+func TestHotPaths(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Write)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	if hot := w.HotPaths(1); len(hot) != 0 {
+		t.Errorf("expected no hot paths, got %v", hot)
+	}
+
+	noisy := filepath.Join(testDir, "file_1.txt")
+	quiet := filepath.Join(testDir, "file_2.txt")
+	modTime := time.Now()
+
+	for _, path := range []string{noisy, quiet, noisy, noisy} {
+		modTime = modTime.Add(time.Hour)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case event := <-w.Event:
+			if event.Path != path {
+				t.Fatalf("expected a write event for %s, got %s", path, event)
+			}
+		case <-time.After(time.Millisecond * 250):
+			t.Fatalf("received no write event for %s", path)
+		}
+	}
+
+	expected := []PathCount{{noisy, 3}, {quiet, 1}}
+	if hot := w.HotPaths(0); !reflect.DeepEqual(hot, expected) {
+		t.Errorf("expected hot paths to be %v, got %v", expected, hot)
+	}
+	if hot := w.HotPaths(1); !reflect.DeepEqual(hot, expected[:1]) {
+		t.Errorf("expected hot paths to be %v, got %v", expected[:1], hot)
+	}
+}
+
+func TestHotPathsLimit(t *testing.T) {
+	w := New()
+
+	w.hotMu.Lock()
+	for i := 0; i < maxHotPaths; i++ {
+		w.countHot(fmt.Sprintf("/tmp/file_%d.txt", i))
+		if i > 0 {
+			w.countHot(fmt.Sprintf("/tmp/file_%d.txt", i))
+		}
+	}
+	// The path with the fewest events makes room for the new one.
+	w.countHot("/tmp/new.txt")
+	w.hotMu.Unlock()
+
+	hot := w.HotPaths(0)
+	if len(hot) != maxHotPaths {
+		t.Fatalf("expected %d hot paths, got %d", maxHotPaths, len(hot))
+	}
+	for _, pc := range hot {
+		if pc.Path == "/tmp/file_0.txt" {
+			t.Errorf("expected /tmp/file_0.txt to be forgotten")
+		}
+	}
+	if last := hot[len(hot)-1]; last.Path != "/tmp/new.txt" || last.Count != 1 {
+		t.Errorf("expected the last hot path to be /tmp/new.txt, got %v", last)
+	}
+}
+
+func TestSetEdgeMode(t *testing.T) {
+	testCases := []struct {
+		mode EdgeMode
+		// early and late are the number of events expected while the
+		// directory is changing and after it has settled.
+		early, late int
+	}{
+		{Leading, 1, 0},
+		{Trailing, 0, 1},
+		{Both, 1, 1},
+	}
+
+	for _, tc := range testCases {
+		func() {
+			testDir, teardown := setup(t)
+			defer teardown()
+
+			testDirTwo := filepath.Join(testDir, "testDirTwo")
+
+			w := New()
+			w.SetDirDebounce(time.Millisecond * 400)
+			w.SetEdgeMode(tc.mode)
+
+			if err := w.AddRecursive(testDir); err != nil {
+				t.Fatal(err)
+			}
+
+			startWatcher(t, w, time.Millisecond*50)
+			defer w.Close()
+
+			w.Wait()
+
+			// Keep changing testDirTwo for 300ms in the background.
+			start := time.Now()
+			lastChange := start.Add(time.Millisecond * 300)
+			go func() {
+				for i := 0; i < 3; i++ {
+					path := filepath.Join(testDirTwo, fmt.Sprintf("file_%d.txt", i))
+					if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+						t.Error(err)
+					}
+					time.Sleep(time.Millisecond * 150)
+				}
+			}()
+
+			var early, late int
+			timeout := time.After(time.Millisecond * 1500)
+		loop:
+			for {
+				select {
+				case event := <-w.Event:
+					if event.Path != testDirTwo {
+						t.Errorf("mode %d: expected event.Path to be %s, got %s", tc.mode, testDirTwo, event.Path)
+					}
+					if time.Now().Before(lastChange) {
+						early++
+					} else {
+						late++
+					}
+				case <-timeout:
+					break loop
+				}
+			}
+
+			if early != tc.early || late != tc.late {
+				t.Errorf("mode %d: expected %d early and %d late events, got %d and %d",
+					tc.mode, tc.early, tc.late, early, late)
+			}
+		}()
+	}
+}
+
+func TestEventCaseOnlyRename(t *testing.T) {
+	// Case-insensitive filesystems are the default on Windows and macOS.
+	if runtime.GOOS != "linux" {
+		t.Skip("skipping case-only rename test on " + runtime.GOOS)
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	oldFile := filepath.Join(testDir, "File.txt")
+	newFile := filepath.Join(testDir, "file.txt")
+
+	// Make room for the case variant of file.txt.
+	if err := os.Rename(newFile, oldFile); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.FilterOps(Rename, Create, Remove)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	if err := os.Rename(oldFile, newFile); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Rename {
+			t.Fatalf("expected event to be Rename, got %s", event)
+		}
+		if event.Path != newFile {
+			t.Errorf("expected event.Path to be %s, got %s", newFile, event.Path)
+		}
+		if event.OldPath != oldFile {
+			t.Errorf("expected event.OldPath to be %s, got %s", oldFile, event.OldPath)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no rename event")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected a single rename event, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestChanges(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create, Remove)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if events, errs := w.Changes(); len(events) != 0 || len(errs) != 0 {
+		t.Errorf("expected no changes or errors, got %v and %v", events, errs)
+	}
+
+	newFile := filepath.Join(testDir, "new.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	removed := filepath.Join(testDir, "file_1.txt")
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	events, errs := w.Changes()
+	if len(events) != 2 || len(errs) != 0 {
+		t.Fatalf("expected 2 changes and no errors, got %v and %v", events, errs)
+	}
+	for _, event := range events {
+		switch {
+		case event.Op == Create && event.Path == newFile:
+		case event.Op == Remove && event.Path == removed:
+		default:
+			t.Errorf("unexpected event %s", event)
+		}
+	}
+
+	// The changes were only returned once.
+	if events, _ := w.Changes(); len(events) != 0 {
+		t.Errorf("expected no changes, got %v", events)
+	}
+}
+
+func TestChangesErrors(t *testing.T) {
+	// Use an in-memory backend, since permissions don't stop root from
+	// reading a directory.
+	backend := &memBackend{files: make(map[string]*fileInfo)}
+	backend.write("/remote", true)
+	backend.write("/remote/dir", true)
+	backend.write("/remote/dir/file.txt", false)
+
+	w := New()
+	w.SetBackend(backend, "/remote")
+
+	if err := w.AddRecursive("/remote"); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.chmod("/remote/dir", 0)
+
+	// Nothing receives from the Error channel, so Changes must return the
+	// warning rather than send it.
+	var events []Event
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		events, errs = w.Changes()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Changes blocked on an error")
+	}
+
+	if len(events) != 0 {
+		t.Errorf("expected no events for an unreadable directory, got %v", events)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	werr, ok := errs[0].(*WatcherError)
+	if !ok || werr.Err != ErrDirUnreadable || werr.Path != "/remote/dir" {
+		t.Errorf("expected an ErrDirUnreadable warning for /remote/dir, got %v", errs[0])
+	}
+}
+
+func TestIgnoreBinary(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	textFile := filepath.Join(testDir, "text.txt")
+	nullFile := filepath.Join(testDir, "image.png")
+	latin1File := filepath.Join(testDir, "latin1.txt")
+
+	files := map[string][]byte{
+		textFile:   []byte("héllo, wörld\n"),
+		nullFile:   {0x89, 'P', 'N', 'G', 0x00, 0x00},
+		latin1File: {'h', 0xe9, 'l', 'l', 'o'},
+	}
+	for path, data := range files {
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.IgnoreBinary()
+	w.FilterOps(Create, Remove)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	watched := w.WatchedFiles()
+	if _, found := watched[textFile]; !found {
+		t.Errorf("expected %s to be watched", textFile)
+	}
+	for _, path := range []string{nullFile, latin1File} {
+		if _, found := watched[path]; found {
+			t.Errorf("expected %s to be ignored", path)
+		}
+	}
+
+	// A file is checked again once it changes.
+	if err := ioutil.WriteFile(textFile, []byte{0x00}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(textFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	events, _ := w.Changes()
+	if len(events) != 1 || events[0].Op != Remove || events[0].Path != textFile {
+		t.Errorf("expected a single remove event for %s, got %v", textFile, events)
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	testCases := []struct {
+		data      []byte
+		truncated bool
+		binary    bool
+	}{
+		{[]byte(""), false, false},
+		{[]byte("plain text"), false, false},
+		{[]byte("wörld"), false, false},
+		{[]byte("null\x00byte"), false, true},
+		{[]byte("invalid \xff utf-8"), false, true},
+		// A multibyte character cut off at the end of a truncated read.
+		{[]byte("w\xc3"), true, false},
+		{[]byte("w\xc3"), false, true},
+	}
+
+	for _, tc := range testCases {
+		if binary := isBinary(tc.data, tc.truncated); binary != tc.binary {
+			t.Errorf("expected isBinary(%q, %t) to be %t, got %t",
+				tc.data, tc.truncated, tc.binary, binary)
+		}
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	low := testDir
+	high := filepath.Join(testDir, "testDirTwo")
+
+	w := New()
+	w.SetManualTicks(true)
+	w.SetMaxEvents(3)
+	w.FilterOps(Create)
+
+	for _, root := range []string{low, high} {
+		if err := w.Add(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.SetPriority(high, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	for i := 0; i < 3; i++ {
+		for _, dir := range []string{low, high} {
+			path := filepath.Join(dir, fmt.Sprintf("new_%d.txt", i))
+			if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ticked := make(chan error)
+	go func() { ticked <- w.Tick() }()
+
+	var events []Event
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			events = append(events, event)
+		case err := <-ticked:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		}
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %v", events)
+	}
+	for _, event := range events {
+		if event.Root != high {
+			t.Errorf("expected only events for %s, got %s", high, event)
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create, Remove, Rename, Chmod)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	var recording bytes.Buffer
+	if err := w.StartRecording(&recording); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	changes := []func() error{
+		func() error {
+			return ioutil.WriteFile(filepath.Join(testDir, "new.txt"), []byte{}, 0755)
+		},
+		func() error {
+			return os.Rename(filepath.Join(testDir, "file_1.txt"), filepath.Join(testDir, "renamed.txt"))
+		},
+		func() error {
+			return os.Chmod(filepath.Join(testDir, "file_2.txt"), 0600)
+		},
+		func() error {
+			return os.Remove(filepath.Join(testDir, "file_3.txt"))
+		},
+	}
+
+	var recorded []string
+	for _, change := range changes {
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case event := <-w.Event:
+			recorded = append(recorded, event.String()+" "+event.OldPath)
+		case <-time.After(time.Millisecond * 250):
+			t.Fatal("received no event")
+		}
+	}
+
+	if err := w.StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer := New()
+	replayer.FilterOps(Create, Remove, Rename, Chmod)
+
+	// The events in the recording itself are in the order they're
+	// replayed in.
+	var inRecording []string
+	for _, line := range strings.Split(strings.TrimSpace(recording.String()), "\n") {
+		var rec struct {
+			Type  string `json:"type"`
+			Event struct {
+				Op   string `json:"op"`
+				Path string `json:"path"`
+			} `json:"event"`
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Type == "event" {
+			inRecording = append(inRecording, rec.Event.Op+" "+rec.Event.Path)
+		}
+	}
+
+	data := recording.Bytes()
+	events, err := replayer.Replay(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed, replayedOps []string
+	for event := range events {
+		replayed = append(replayed, event.String()+" "+event.OldPath)
+		replayedOps = append(replayedOps, event.Op.String()+" "+event.Path)
+	}
+
+	if !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("expected replayed events to be %v, got %v", recorded, replayed)
+	}
+	if !reflect.DeepEqual(replayedOps, inRecording) {
+		t.Errorf("expected replayed events to be %v, got %v", inRecording, replayedOps)
+	}
+
+	// The watcher is running until the replay is over, so it can't be
+	// started, and closing it ends the replay early.
+	replayer = New()
+	events, err = replayer.Replay(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := replayer.goroutineCount(); n != 1 {
+		t.Errorf("expected 1 goroutine replaying, got %d", n)
+	}
+	if err := replayer.Start(time.Hour); err != ErrWatcherRunning {
+		t.Errorf("expected ErrWatcherRunning starting a replaying watcher, got %v", err)
+	}
+	if _, err := replayer.Replay(bytes.NewReader(data)); err != ErrWatcherRunning {
+		t.Errorf("expected ErrWatcherRunning replaying twice at once, got %v", err)
+	}
+	if err := replayer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range events {
+	}
+	select {
+	case <-replayer.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the replaying watcher didn't close")
+	}
+	if n := replayer.goroutineCount(); n != 0 {
+		t.Errorf("expected no goroutines after closing, got %d", n)
+	}
+
+	// A running watcher's files can't be replaced.
+	running := New()
+	startWatcher(t, running, time.Hour)
+	defer running.Close()
+
+	running.Wait()
+
+	if _, err := running.Replay(bytes.NewReader(data)); err != ErrWatcherRunning {
+		t.Errorf("expected ErrWatcherRunning replaying into a running watcher, got %v", err)
+	}
+
+	if _, err := New().Replay(strings.NewReader(`{"type":"scan"}`)); err == nil {
+		t.Error("expected an error replaying a recording without a start record")
+	}
+}
+
+func TestSetArrivalCycles(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetArrivalCycles(2)
+	w.FilterOps(Create, Write, Remove)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*50)
+	defer w.Close()
+
+	w.Wait()
+
+	// A file that's removed while arriving produces no events.
+	tmpFile := filepath.Join(testDir, "import.tmp")
+	if err := ioutil.WriteFile(tmpFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Grow a file over several cycles.
+	newFile := filepath.Join(testDir, "import.csv")
+	modTime := time.Now()
+	var lastWrite time.Time
+	for i := 1; i <= 4; i++ {
+		if err := ioutil.WriteFile(newFile, bytes.Repeat([]byte("a"), i), 0755); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(newFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		lastWrite = time.Now()
+		if i == 2 {
+			if err := os.Remove(tmpFile); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(time.Millisecond * 75)
+	}
+
+	for {
+		select {
+		case event := <-w.Event:
+			if event.Path == testDir {
+				continue // The directory itself was written to.
+			}
+			if event.Op != Create || event.Path != newFile {
+				t.Fatalf("expected a single create event for %s, got %s", newFile, event)
+			}
+			if event.Size() != 4 {
+				t.Errorf("expected the create event's size to be 4, got %d", event.Size())
+			}
+			// The file must have been unchanged for 2 cycles.
+			if since := time.Since(lastWrite); since < time.Millisecond*100 {
+				t.Errorf("expected the file to be ready after 2 cycles, got it after %s", since)
+			}
+		case <-time.After(time.Millisecond * 500):
+			t.Fatal("received no create event")
+		}
+		break
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Path != testDir {
+			t.Errorf("expected no more events, got %s", event)
+		}
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestSetRootSelfEvents(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetRootSelfEvents(false)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	watched := w.WatchedFiles()
+	if _, found := watched[testDir]; found {
+		t.Errorf("expected %s not to be watched", testDir)
+	}
+	if _, found := watched[filepath.Join(testDir, "file.txt")]; !found {
+		t.Error("expected the directory's contents to be watched")
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// Creating a child changes the directory's modification time.
+	newFile := filepath.Join(testDir, "new.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Create || event.Path != newFile {
+			t.Errorf("expected a create event for %s, got %s", newFile, event)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no create event")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected no event for the directory, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+}
+
+func TestSetDirModTimeEvents(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	testDirTwo := filepath.Join(testDir, "testDirTwo")
+	change := func(name string, hours time.Duration) map[string]Op {
+		newFile := filepath.Join(testDirTwo, name)
+		if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the directory's modification time changes.
+		modTime := time.Now().Add(time.Hour * hours)
+		if err := os.Chtimes(testDirTwo, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		written := filepath.Join(testDir, "file.txt")
+		if err := os.Chtimes(written, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+
+		ops := make(map[string]Op)
+		events, _ := w.Changes()
+		for _, event := range events {
+			ops[event.Name()] = event.Op
+		}
+		return ops
+	}
+
+	// Directory writes are sent by default.
+	expected := map[string]Op{"new.txt": Create, "testDirTwo": Write, "file.txt": Write}
+	if ops := change("new.txt", 1); !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected events %v, got %v", expected, ops)
+	}
+
+	w.SetDirModTimeEvents(false)
+	if !w.Config().NoDirModTimeEvents {
+		t.Error("expected the config to have directory writes disabled")
+	}
+
+	expected = map[string]Op{"new_2.txt": Create, "file.txt": Write}
+	if ops := change("new_2.txt", 2); !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected events %v, got %v", expected, ops)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	target := New()
+	if err := target.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the files before adding them to the source watcher.
+	newFile := filepath.Join(testDir, "testDirTwo", "new.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	removed := filepath.Join(testDir, "file_1.txt")
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	written := filepath.Join(testDir, "file_2.txt")
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(written, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	testDirTwo := filepath.Join(testDir, "testDirTwo")
+	if err := os.Chtimes(testDirTwo, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(testDir, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	source := New()
+	if err := source.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The events that turn the source's files into the target's files.
+	expected := []string{
+		"CREATE " + removed,
+		"WRITE " + testDir,
+		"WRITE " + written,
+		"WRITE " + testDirTwo,
+		"REMOVE " + newFile,
+	}
+
+	var got []string
+	for _, event := range target.Diff(source) {
+		got = append(got, event.Op.String()+" "+event.Path)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected diff to be %v, got %v", expected, got)
+	}
+
+	if events := target.Diff(target); len(events) != 0 {
+		t.Errorf("expected no diff with itself, got %v", events)
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	tok := w.SnapshotToken()
+
+	// Tokens hold no state, so any number of clients can hold them.
+	var clients []Token
+	for i := 0; i < 20; i++ {
+		clients = append(clients, w.SnapshotToken())
+	}
+
+	testDirTwo := filepath.Join(testDir, "testDirTwo")
+	newFile := filepath.Join(testDirTwo, "new.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	removed := filepath.Join(testDir, "file_1.txt")
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	written := filepath.Join(testDir, "file_2.txt")
+	modTime := time.Now().Add(time.Hour)
+	for _, path := range []string{written, testDirTwo, testDir} {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Scan for the changes.
+	if _, errs := w.Changes(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	expected := []string{
+		"CREATE " + newFile,
+		"WRITE " + testDir,
+		"WRITE " + written,
+		"WRITE " + testDirTwo,
+		"REMOVE " + removed,
+	}
+
+	events, next, err := w.ChangesSince(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, event := range events {
+		got = append(got, event.Op.String()+" "+event.Path)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected changes to be %v, got %v", expected, got)
+	}
+
+	for _, client := range clients {
+		events, _, err := w.ChangesSince(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != len(expected) {
+			t.Errorf("expected %d changes for every client, got %v", len(expected), events)
+		}
+	}
+
+	if next == tok {
+		t.Errorf("expected a new token, got %s again", next)
+	}
+	if events, _, err := w.ChangesSince(next); err != nil || len(events) != 0 {
+		t.Errorf("expected no changes since the new token, got %v, %v", events, err)
+	}
+	if _, _, err := w.ChangesSince(New().SnapshotToken()); err != ErrUnknownToken {
+		t.Errorf("expected ErrUnknownToken for another watcher's token, got %v", err)
+	}
+
+	// A token is unknown once more changes have been made since it than
+	// the change log keeps.
+	w.mu.Lock()
+	for i := 0; i < 2*maxChangeLog; i++ {
+		w.logChange(newFile, nil)
+	}
+	w.mu.Unlock()
+	if _, _, err := w.ChangesSince(next); err != ErrUnknownToken {
+		t.Errorf("expected ErrUnknownToken for a token older than the log, got %v", err)
+	}
+	if _, _, err := w.ChangesSince(w.SnapshotToken()); err != nil {
+		t.Errorf("expected the current token to be known, got %v", err)
+	}
+}
+
+func TestWriteWithUnrelatedCreateAndRemove(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// Make an unrelated create and remove in the same cycle as a write.
+	newFile := filepath.Join(testDir, "new.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	removed := filepath.Join(testDir, "file_1.txt")
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	written := filepath.Join(testDir, "file_2.txt")
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(written, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	ticked := make(chan error)
+	go func() { ticked <- w.Tick() }()
+
+	events := make(map[string]Op)
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			events[event.Path] = event.Op
+		case err := <-ticked:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		}
+	}
+
+	expected := map[string]Op{
+		testDir: Write,
+		newFile: Create,
+		removed: Remove,
+		written: Write,
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
+
+func TestSetMemoryBudget(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	// Find the cost of watching testDir without its subdirectories.
+	unlimited := New()
+	if err := unlimited.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+	budget := filesCost(unlimited.WatchedFiles())
+
+	w := New()
+	w.SetMemoryBudget(budget)
+	w.FilterOps(Create)
+
+	// Adding testDir recursively exceeds the budget.
+	if err := w.AddRecursive(testDir); err != ErrMemoryBudget {
+		t.Errorf("expected error to be ErrMemoryBudget, got %v", err)
+	}
+	if len(w.WatchedFiles()) != 0 {
+		t.Errorf("expected no files to be watched, got %v", w.WatchedFiles())
+	}
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// A new file doesn't fit in the budget.
+	if err := ioutil.WriteFile(filepath.Join(testDir, "new.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-w.Error:
+		if err.(*WatcherError).Err != ErrMemoryBudget {
+			t.Errorf("expected error to be ErrMemoryBudget, got %v", err)
+		}
+	case event := <-w.Event:
+		t.Fatalf("expected no events, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no memory budget warning")
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Errorf("expected no events, got %s", event)
+	case <-time.After(time.Millisecond * 250):
+	}
+
+	if cost := filesCost(w.WatchedFiles()); cost > budget {
+		t.Errorf("expected the watched files to cost at most %d, got %d", budget, cost)
+	}
+}
+
+func TestMemoryBudgetKeepsWatchedFiles(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	watched := w.WatchedFiles()
+
+	newDir := filepath.Join(testDir, "newdir")
+	newFile := filepath.Join(newDir, "new.txt")
+	if err := os.Mkdir(newDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func() (map[string]os.FileInfo, []error) {
+		var errs []error
+		fileList := w.scanFiles(func(err error) { errs = append(errs, err) })
+		return fileList, errs
+	}
+
+	// There's only room for the new directory, so its file is left out.
+	w.SetMemoryBudget(filesCost(watched) + fileCost(newDir))
+	fileList, errs := scan()
+	if len(errs) != 1 || errs[0].(*WatcherError).Err != ErrMemoryBudget {
+		t.Errorf("expected one ErrMemoryBudget warning, got %v", errs)
+	}
+	if _, found := fileList[newDir]; !found {
+		t.Errorf("expected %s to be kept", newDir)
+	}
+	if _, found := fileList[newFile]; found {
+		t.Errorf("expected %s to be left out", newFile)
+	}
+
+	// The watched files alone exceed the budget, but none of them are left
+	// out, since that would make them look deleted.
+	w.SetMemoryBudget(filesCost(watched) / 2)
+	fileList, _ = scan()
+	for path := range watched {
+		if _, found := fileList[path]; !found {
+			t.Errorf("expected watched file %s to be kept", path)
+		}
+	}
+	if len(fileList) != len(watched) {
+		t.Errorf("expected only the %d watched files, got %d", len(watched), len(fileList))
+	}
+}
+
+func TestSetEventBufferSize(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.SetEventBufferSize(10); err != nil {
+		t.Fatal(err)
+	}
+	if cap(w.Event) != 10 {
+		t.Errorf("expected the Event channel's capacity to be 10, got %d", cap(w.Event))
+	}
+	w.FilterOps(Create)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	if err := w.SetEventBufferSize(1); err != ErrWatcherRunning {
+		t.Errorf("expected error to be ErrWatcherRunning, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(testDir, fmt.Sprintf("new_%d.txt", i))
+		if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The cycle finishes without any events being received.
+	time.Sleep(time.Millisecond * 250)
+	if len(w.Event) != 3 {
+		t.Fatalf("expected 3 buffered events, got %d", len(w.Event))
+	}
+	if _, found := w.WatchedFiles()[filepath.Join(testDir, "new_2.txt")]; !found {
+		t.Error("expected the new files to be watched")
+	}
+
+	for i := 0; i < 3; i++ {
+		if event := <-w.Event; event.Op != Create {
+			t.Errorf("expected event to be Create, got %s", event.Op)
+		}
+	}
+}
+
+func TestSetDebounce(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	written := filepath.Join(testDir, "file.txt")
+	created := filepath.Join(testDir, "new.txt")
+	removed := filepath.Join(testDir, "file_1.txt")
+	tmpFile := filepath.Join(testDir, "tmp.txt")
+
+	w := New()
+	w.SetDebounce(time.Millisecond * 300)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*50)
+	defer w.Close()
+
+	w.Wait()
+
+	modTime := time.Now()
+	for i := 1; i <= 3; i++ {
+		modTime = modTime.Add(time.Second)
+		// Write to a file several times.
+		if err := os.Chtimes(written, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		// Create a file and write to it.
+		if err := ioutil.WriteFile(created, bytes.Repeat([]byte("a"), i), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(created, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		switch i {
+		case 1:
+			// Write to a file and then remove it.
+			if err := os.Chtimes(removed, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+			// Create a file and then remove it.
+			if err := ioutil.WriteFile(tmpFile, []byte{}, 0755); err != nil {
+				t.Fatal(err)
+			}
+		case 2:
+			if err := os.Remove(removed); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(tmpFile); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(time.Millisecond * 75)
+	}
+
+	events := make(map[string][]Op)
+	timeout := time.After(time.Second)
+loop:
+	for {
+		select {
+		case event := <-w.Event:
+			if event.Path == testDir {
+				continue // The directory itself was written to.
+			}
+			events[event.Path] = append(events[event.Path], event.Op)
+			if event.Path == created && event.Size() != 3 {
+				t.Errorf("expected the create event's size to be 3, got %d", event.Size())
+			}
+		case <-timeout:
+			break loop
+		}
+	}
+
+	expected := map[string][]Op{
+		written: {Write},
+		created: {Create},
+		removed: {Remove},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	info := &fileInfo{name: "a.txt"}
+	deadline := time.Now()
+
+	testCases := []struct {
+		events   []Event
+		expected map[string]Op
+	}{
+		{
+			[]Event{{Op: Write, Path: "a"}, {Op: Write, Path: "a"}},
+			map[string]Op{"a": Write},
+		},
+		{
+			[]Event{{Op: Create, Path: "a"}, {Op: Write, Path: "a"}, {Op: Chmod, Path: "a"}},
+			map[string]Op{"a": Create},
+		},
+		{
+			[]Event{{Op: Write, Path: "a"}, {Op: Remove, Path: "a"}},
+			map[string]Op{"a": Remove},
+		},
+		{
+			[]Event{{Op: Create, Path: "a"}, {Op: Remove, Path: "a"}},
+			map[string]Op{},
+		},
+		{
+			[]Event{{Op: Create, Path: "a"}, {Op: Rename, Path: "b", OldPath: "a"}},
+			map[string]Op{"b": Create},
+		},
+		{
+			[]Event{{Op: Write, Path: "a"}, {Op: Rename, Path: "b", OldPath: "a"}},
+			map[string]Op{"b": Rename},
+		},
+	}
+
+	for i, tc := range testCases {
+		pending := make(map[string]*pendingEvent)
+		for _, e := range tc.events {
+			e.FileInfo = info
+			coalesce(pending, e, deadline)
+		}
+		got := make(map[string]Op)
+		for path, p := range pending {
+			got[path] = p.event.Op
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%d: expected %v, got %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestAddPathRewriteHook(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+	w.FilterOps(Create, Rename)
+
+	// Map testDir to /container, and then /container to /host.
+	w.AddPathRewriteHook(func(path string) string {
+		return "/container" + strings.TrimPrefix(path, testDir)
+	})
+	w.AddPathRewriteHook(func(path string) string {
+		return "/host" + strings.TrimPrefix(path, "/container")
+	})
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	if err := os.Rename(filepath.Join(testDir, "file_1.txt"), filepath.Join(testDir, "renamed.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the whole cycle, since the watched files are only updated
+	// once all of its events have been sent.
+	ticked := make(chan error)
+	go func() { ticked <- w.Tick() }()
+
+	var events []Event
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			events = append(events, event)
+		case err := <-ticked:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		}
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected a single rename event, got %v", events)
+	}
+	if events[0].Path != "/host/renamed.txt" {
+		t.Errorf("expected event.Path to be /host/renamed.txt, got %s", events[0].Path)
+	}
+	if events[0].OldPath != "/host/file_1.txt" {
+		t.Errorf("expected event.OldPath to be /host/file_1.txt, got %s", events[0].OldPath)
+	}
+
+	// The watcher still uses the original paths.
+	if _, found := w.WatchedFiles()[filepath.Join(testDir, "renamed.txt")]; !found {
+		t.Errorf("expected the original path to be watched, got %v", w.WatchedFiles())
+	}
+}
+
+func TestSetDirFDCaching(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("skipping directory fd caching test on " + runtime.GOOS)
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	root, err := filepath.Abs(filepath.Join(testDir, "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := root + ".moved"
+	for _, dir := range []string{"b", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a.txt", "b/x.txt", "c/y.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.SetManualTicks(true)
+	w.SetDirFDCaching(true)
+
+	// Rename root away part way through a scan, once root itself has been
+	// listed, and rename it back once its last file has been listed.
+	var renameErr error
+	renaming := false
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		if !renaming {
+			return nil
+		}
+		switch fullPath {
+		case filepath.Join(root, "a.txt"):
+			renameErr = os.Rename(root, moved)
+		case filepath.Join(root, "c", "y.txt"):
+			if err := os.Rename(moved, root); err != nil && renameErr == nil {
+				renameErr = err
+			}
+			renaming = false
+		}
+		return nil
+	})
+
+	if err := w.AddRecursive(root); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	w.mu.Lock()
+	renaming = true
+	w.mu.Unlock()
+
+	if events := tickEvents(t, w); len(events) != 0 {
+		t.Errorf("expected no events while root was renamed, got %v", events)
+	}
+	if renameErr != nil {
+		t.Fatal(renameErr)
+	}
+	if renaming {
+		t.Fatal("expected root to be renamed back during the scan")
+	}
+	if len(w.WatchedFiles()) != 6 {
+		t.Errorf("expected 6 watched files, got %v", w.WatchedFiles())
+	}
+
+	// The children are still tracked in the next scan.
+	newFile := filepath.Join(root, "c", "new.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	events := tickEvents(t, w)
+	var created bool
+	for _, event := range events {
+		if event.Op == Create && event.Path == newFile {
+			created = true
+		}
+	}
+	if !created {
+		t.Errorf("expected a create event for %s, got %v", newFile, events)
+	}
+}
+
+func TestSetUniqueOps(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+	w.SetUniqueOps(true)
+	w.FilterOps(Create)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// create creates the named files and returns the events from one cycle.
+	create := func(names ...string) []Event {
+		for _, name := range names {
+			err := ioutil.WriteFile(filepath.Join(testDir, name), []byte{}, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ticked := make(chan error)
+		go func() { ticked <- w.Tick() }()
+
+		var events []Event
+		for {
+			select {
+			case event := <-w.Event:
+				events = append(events, event)
+			case err := <-ticked:
+				if err != nil {
+					t.Fatal(err)
+				}
+				return events
+			}
+		}
+	}
+
+	if events := create("new_1.txt", "new_2.txt", "new_3.txt"); len(events) != 1 {
+		t.Errorf("expected 1 create event, got %v", events)
+	}
+	if events := create("new_4.txt"); len(events) != 0 {
+		t.Errorf("expected no events before the reset, got %v", events)
+	}
+
+	w.ResetUniqueOps()
+
+	if events := create("new_5.txt", "new_6.txt"); len(events) != 1 {
+		t.Errorf("expected 1 create event after the reset, got %v", events)
+	}
+
+	// An event that's never received doesn't count as sent.
+	w.ResetUniqueOps()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := w.TriggerEventContext(ctx, Create, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected error to be context.DeadlineExceeded, got %v", err)
+	}
+	if events := create("new_7.txt"); len(events) != 1 {
+		t.Errorf("expected 1 create event after a dropped event, got %v", events)
+	}
+}
+
+func TestSetFlapDetection(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+	w.SetFlapDetection(2, time.Minute, time.Minute)
+	w.FilterOps(Write)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// write appends to the named file and returns the events from one
+	// cycle.
+	write := func(name string) []Event {
+		f, err := os.OpenFile(filepath.Join(testDir, name), os.O_WRONLY|os.O_APPEND, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteString("x")
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ticked := make(chan error)
+		go func() { ticked <- w.Tick() }()
+
+		var events []Event
+		for {
+			select {
+			case event := <-w.Event:
+				events = append(events, event)
+			case err := <-ticked:
+				if err != nil {
+					t.Fatal(err)
+				}
+				return events
+			}
+		}
+	}
+
+	flapping := filepath.Join(testDir, "file_1.txt")
+	for i, expected := range []Op{Write, Write, Flapping} {
+		events := write("file_1.txt")
+		if len(events) != 1 || events[0].Op != expected || events[0].Path != flapping {
+			t.Fatalf("expected a %v event for write %d, got %v", expected, i+1, events)
+		}
+	}
+
+	// The flapping file's events are dropped during the cooldown, but
+	// other files' events aren't.
+	if events := write("file_1.txt"); len(events) != 0 {
+		t.Errorf("expected no events during the cooldown, got %v", events)
+	}
+	if events := write("file_2.txt"); len(events) != 1 || events[0].Op != Write {
+		t.Errorf("expected a write event for another file, got %v", events)
+	}
+}
+
+func TestFlapDetectionForgetsQuietPaths(t *testing.T) {
+	w := New()
+	w.SetFlapDetection(1, time.Millisecond*50, time.Millisecond*50)
+
+	event := func(path string) Event {
+		return Event{Op: Write, Path: path}
+	}
+
+	// Every path gets an entry, and one starts cooling down.
+	for i := 0; i < 10; i++ {
+		w.checkFlapping(event(fmt.Sprintf("/tmp/file_%d.txt", i)))
+	}
+	if e, _ := w.checkFlapping(event("/tmp/file_0.txt")); e.Op != Flapping {
+		t.Fatalf("expected a flapping event, got %v", e)
+	}
+	if len(w.flaps) != 10 {
+		t.Fatalf("expected 10 paths to be tracked, got %d", len(w.flaps))
+	}
+
+	// Once the window and cooldown have passed, only the newest path is
+	// still tracked.
+	time.Sleep(time.Millisecond * 60)
+	w.checkFlapping(event("/tmp/new.txt"))
+	if _, found := w.flaps["/tmp/new.txt"]; len(w.flaps) != 1 || !found {
+		t.Errorf("expected only /tmp/new.txt to be tracked, got %v", w.flaps)
+	}
+}
+
+func TestSetMirrorSafeOrdering(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+	w.SetMirrorSafeOrdering(true)
+	w.FilterOps(Create, Move)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	newDir := filepath.Join(testDir, "new", "nested")
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(newDir, "file_1.txt")
+	if err := os.Rename(filepath.Join(testDir, "file_1.txt"), moved); err != nil {
+		t.Fatal(err)
+	}
+
+	ticked := make(chan error)
+	go func() { ticked <- w.Tick() }()
+
+	var events []Event
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			events = append(events, event)
+		case err := <-ticked:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		}
+	}
+
+	expected := []struct {
+		op   Op
+		path string
+	}{
+		{Create, filepath.Join(testDir, "new")},
+		{Create, newDir},
+		{Move, moved},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %v", len(expected), events)
+	}
+	for i, e := range expected {
+		if events[i].Op != e.op || events[i].Path != e.path {
+			t.Errorf("expected event %d to be %v %s, got %v", i, e.op, e.path, events[i])
+		}
+	}
+}
+
+func TestSetInitialEvents(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetInitialEvents(true)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+	initial := len(w.WatchedFiles())
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	for i := 0; i < initial; i++ {
+		select {
+		case event := <-w.Event:
+			if event.Op != Create || event.Source != SourceInitial {
+				t.Errorf("expected an initial create event, got %v from %v", event, event.Source)
+			}
+		case <-time.After(time.Millisecond * 250):
+			t.Fatalf("received %d of %d initial events", i, initial)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(testDir, "file_1.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory's write and the file's removal come from a scan.
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-w.Event:
+			if event.Source != SourceScan {
+				t.Errorf("expected %v to come from a scan, got %v", event, event.Source)
+			}
+		case <-time.After(time.Millisecond * 250):
+			t.Fatal("received no scan events")
+		}
+	}
+}
+
+func TestSetTriggerChannel(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create)
+
+	trigger := make(chan struct{})
+	w.SetTriggerChannel(trigger)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start the watching process with an interval that won't pass during
+	// the test.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// trigger is unbuffered, so the first cycle has finished once the
+	// send is received, and any later cycle is a triggered one.
+	trigger <- struct{}{}
+
+	newFile := filepath.Join(testDir, "triggered.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The triggered cycle that's already running might find the new file
+	// before the watcher receives again.
+	go func() { trigger <- struct{}{} }()
+
+	select {
+	case event := <-w.Event:
+		if event.Path != newFile || event.Op != Create {
+			t.Errorf("expected a create event for %s, got %v", newFile, event)
+		}
+		if event.Source != SourceTrigger {
+			t.Errorf("expected %v to come from the trigger, got %v", event, event.Source)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no event after sending on the trigger channel")
+	}
+}
+
+func TestSetFollowSymlinks(t *testing.T) {
+	// Symlinks need special privileges under windows.
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	testDir, err := filepath.Abs(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherDir)
+
+	if err := ioutil.WriteFile(filepath.Join(otherDir, "inner.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// linked leads out of the tree, and both loop and self lead back into
+	// it, which would walk forever without cycle detection.
+	links := map[string]string{
+		filepath.Join(testDir, "linked"): otherDir,
+		filepath.Join(otherDir, "loop"):  testDir,
+		filepath.Join(testDir, "self"):   testDir,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inner := filepath.Join(testDir, "linked", "inner.txt")
+	for _, follow := range []bool{false, true} {
+		w := New()
+		w.SetFollowSymlinks(follow)
+
+		if err := w.AddRecursive(testDir); err != nil {
+			t.Fatal(err)
+		}
+
+		files := w.WatchedFiles()
+		if _, found := files[inner]; found != follow {
+			t.Errorf("expected %s to be watched to be %t with follow %t", inner, follow, follow)
+		}
+		for _, path := range []string{
+			filepath.Join(testDir, "linked"),
+			filepath.Join(testDir, "self"),
+		} {
+			if _, found := files[path]; !found {
+				t.Errorf("expected link %s to be watched with follow %t", path, follow)
+			}
+		}
+		for _, path := range []string{
+			filepath.Join(testDir, "linked", "loop", "file.txt"),
+			filepath.Join(testDir, "self", "file.txt"),
+		} {
+			if _, found := files[path]; found {
+				t.Errorf("expected %s not to be watched with follow %t", path, follow)
+			}
+		}
+	}
+}
+
+func TestRemoveLastKnownFileInfo(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	file := filepath.Join(testDir, "file_1.txt")
+	testDirTwo := filepath.Join(testDir, "testDirTwo")
+	recursive := filepath.Join(testDirTwo, "file_recursive.txt")
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i, path := range []string{file, recursive} {
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), 10*(i+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.FilterOps(Remove)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	expected := w.WatchedFiles()
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(testDirTwo); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	removed := make(map[string]bool)
+	for len(removed) < 3 {
+		select {
+		case event := <-w.Event:
+			info := expected[event.Path]
+			if info == nil {
+				t.Fatalf("unexpected event %v", event)
+			}
+			if event.Size() != info.Size() || event.Mode() != info.Mode() ||
+				!event.ModTime().Equal(info.ModTime()) {
+				t.Errorf("expected %s to be removed with size %d, mode %v and mod time %v, got %d, %v and %v",
+					event.Path, info.Size(), info.Mode(), info.ModTime(),
+					event.Size(), event.Mode(), event.ModTime())
+			}
+			removed[event.Path] = true
+		case <-time.After(time.Millisecond * 500):
+			t.Fatalf("received %d of 3 remove events", len(removed))
+		}
+	}
+
+	if !removed[file] || !removed[testDirTwo] || !removed[recursive] {
+		t.Errorf("expected removes for %s, %s and %s, got %v", file, testDirTwo, recursive, removed)
+	}
+	if expected[recursive].Size() != 20 {
+		t.Errorf("expected %s to have been 20 bytes, got %d", recursive, expected[recursive].Size())
+	}
+}
+
+func TestOldFileInfo(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	logFile := filepath.Join(testDir, "file.txt")
+	if err := ioutil.WriteFile(logFile, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.FilterOps(Create, Write)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(" world")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newFile := filepath.Join(testDir, "new.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var wrote, created bool
+	for !wrote || !created {
+		select {
+		case event := <-w.Event:
+			switch event.Path {
+			case logFile:
+				wrote = true
+				if event.OldFileInfo == nil {
+					t.Fatalf("expected %v to have the old file info", event)
+				}
+				if event.OldFileInfo.Size() != 5 || event.Size() != 11 {
+					t.Errorf("expected %s to grow from 5 to 11 bytes, got %d to %d",
+						logFile, event.OldFileInfo.Size(), event.Size())
+				}
+			case newFile:
+				created = true
+				if event.OldFileInfo != nil {
+					t.Errorf("expected no old file info for %v", event)
+				}
+			}
+		case <-time.After(time.Millisecond * 500):
+			t.Fatal("received no write and create events")
+		}
+	}
+}
+
+func TestMoveBetweenWatchedDirs(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	testDir, err := filepath.Abs(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirA := filepath.Join(testDir, "a")
+	dirB := filepath.Join(testDir, "b")
+	for _, dir := range []string{dirA, dirB} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{
+		filepath.Join(dirA, "moved.txt"),
+		filepath.Join(dirA, "removed.txt"),
+		filepath.Join(dirA, "linked.txt"),
+		filepath.Join(dirB, "renamed.txt"),
+	} {
+		if err := ioutil.WriteFile(name, []byte(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.SetManualTicks(true)
+	w.FilterOps(Create, Remove, Rename, Move)
+
+	for _, dir := range []string{dirA, dirB} {
+		if err := w.AddRecursive(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// Move a file between the directories and rename one within a
+	// directory, along with an unrelated create and remove. The new file is
+	// created before the other is removed so that its inode isn't reused.
+	if err := os.Rename(filepath.Join(dirA, "moved.txt"), filepath.Join(dirB, "moved.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dirB, "renamed.txt"), filepath.Join(dirB, "renamed_2.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirA, "created.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dirA, "removed.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for _, event := range tickEvents(t, w) {
+		got[event.Op.String()+" "+event.Path] = event.OldPath
+	}
+	expected := map[string]string{
+		"MOVE " + filepath.Join(dirB, "moved.txt"):       filepath.Join(dirA, "moved.txt"),
+		"RENAME " + filepath.Join(dirB, "renamed_2.txt"): filepath.Join(dirB, "renamed.txt"),
+		"CREATE " + filepath.Join(dirA, "created.txt"):   "",
+		"REMOVE " + filepath.Join(dirA, "removed.txt"):   filepath.Join(dirA, "removed.txt"),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected events %v, got %v", expected, got)
+	}
+
+	// A file that's moved and hard linked in the same cycle is only moved
+	// once, and the link is created.
+	linked := filepath.Join(dirB, "linked.txt")
+	if err := os.Rename(filepath.Join(dirA, "linked.txt"), linked); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(linked, filepath.Join(dirB, "linked_2.txt")); err != nil {
+		t.Skip("skipping hard link case:", err)
+	}
+
+	ops := make(map[Op]int)
+	for _, event := range tickEvents(t, w) {
+		ops[event.Op]++
+	}
+	if ops[Move] != 1 || ops[Create] != 1 || len(ops) != 2 {
+		t.Errorf("expected 1 move and 1 create event, got %v", ops)
+	}
+}
+
+func TestOnUnhandled(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	testDir, err := filepath.Abs(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirA := filepath.Join(testDir, "a")
+	dirB := filepath.Join(testDir, "b")
+	for _, dir := range []string{dirA, dirB} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirA, "moved.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.SetManualTicks(true)
+	w.FilterOps(Create, Move)
+
+	for _, dir := range []string{dirA, dirB} {
+		if err := w.AddRecursive(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created := make(chan Event, 10)
+	unhandled := make(chan Event, 10)
+	w.On(Create, func(e Event) { created <- e })
+	w.OnUnhandled(func(e Event) { unhandled <- e })
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	moved := filepath.Join(dirB, "moved.txt")
+	if err := os.Rename(filepath.Join(dirA, "moved.txt"), moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Tick(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-unhandled:
+		if event.Op != Move || event.Path != moved {
+			t.Errorf("expected unhandled Move event for %s, got %s", moved, event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("received no unhandled event")
+	}
+
+	// Events with a handler of their own don't reach the unhandled one.
+	if err := ioutil.WriteFile(filepath.Join(dirA, "created.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Tick(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-created:
+		if event.Op != Create || event.Name() != "created.txt" {
+			t.Errorf("expected Create event for created.txt, got %s", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("received no create event")
+	}
+	select {
+	case event := <-unhandled:
+		t.Errorf("expected no more unhandled events, got %s", event)
+	default:
+	}
+}
+
+func TestAddProcessFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("skipping process files test on " + runtime.GOOS)
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	// /proc links to the file's real path.
+	testDir, err := filepath.EvalSymlinks(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDir, err = filepath.Abs(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile := filepath.Join(testDir, "child.log")
+
+	// Start a child that keeps appending to logFile.
+	cmd := exec.Command("sh", "-c",
+		`exec 3>>"$1"; while true; do echo x >&3; sleep 0.05; done`, "sh", logFile)
+	if err := cmd.Start(); err != nil {
+		t.Skip("skipping process files test:", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	w := New()
+
+	if err := w.AddProcessFiles(cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer func() {
+		// The child keeps writing, so keep receiving until the watcher
+		// has closed.
+		closed := make(chan struct{})
+		go func() {
+			w.Close()
+			close(closed)
+		}()
+		for {
+			select {
+			case <-w.Event:
+			case <-w.Error:
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	w.Wait()
+
+	timeout := time.After(time.Second * 2)
+	for {
+		select {
+		case event := <-w.Event:
+			if event.Op != Write || event.Path != logFile {
+				t.Fatalf("expected a write event for %s, got %v", logFile, event)
+			}
+			return
+		case err := <-w.Error:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("received no write event")
+		}
+	}
+}
+
+func TestSetRotatingJournal(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	journalDir := filepath.Join(testDir, "journal")
+
+	w := New()
+
+	if err := w.SetRotatingJournal(journalDir, 0, 3); err == nil {
+		t.Error("expected an error for a max size of 0")
+	}
+
+	// Each event takes close to 200 bytes, so a file only fits one.
+	if err := w.SetRotatingJournal(journalDir, 300, 3); err != nil {
+		t.Fatal(err)
+	}
+	defer w.SetRotatingJournal("", 0, 0)
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			w.TriggerEvent(Create, nil)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		<-w.Event
+	}
+
+	infos, err := ioutil.ReadDir(journalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+		if info.Size() > 300 {
+			t.Errorf("expected %s to be at most 300 bytes, got %d", info.Name(), info.Size())
+		}
+	}
+	expected := []string{"events.1.ndjson", "events.2.ndjson", "events.ndjson"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected journal files %v, got %v", expected, names)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(journalDir, "events.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event struct {
+		Op string `json:"op"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Op != "CREATE" {
+		t.Errorf("expected a CREATE event in the journal, got %s", data)
+	}
+}
+
+func TestRotatingJournalErrorUnread(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	journalDir := filepath.Join(testDir, "journal")
+
+	w := New()
+
+	// Each event takes close to 200 bytes, so every write after the first
+	// rolls the journal over.
+	if err := w.SetRotatingJournal(journalDir, 300, 3); err != nil {
+		t.Fatal(err)
+	}
+	defer w.SetRotatingJournal("", 0, 0)
+
+	startWatcher(t, w, time.Millisecond*100)
+
+	w.Wait()
+
+	// Rolling over fails once the journal directory is gone.
+	if err := os.RemoveAll(journalDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Error channel is never read, but events keep being sent.
+	go func() {
+		for i := 0; i < 5; i++ {
+			w.TriggerEvent(Create, nil)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		select {
+		case <-w.Event:
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of 5 events", i)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.Closed:
+	case <-time.After(time.Second):
+		t.Fatal("the watcher didn't close")
+	}
+}
+
+func TestAddEventFilterWhileRunning(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only stop reading events once the watcher is closed, or Close can
+	// block on a cycle that's sending one.
+	stop := make(chan struct{})
+	defer close(stop)
+
+	startWatcher(t, w, time.Millisecond)
+	defer w.Close()
+
+	w.Wait()
+
+	// Keep events coming, so that they're filtered while the filters are
+	// added.
+	go func() {
+		touched := filepath.Join(testDir, "file.txt")
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-w.Event:
+			case <-time.After(time.Millisecond):
+				ioutil.WriteFile(touched, []byte(strings.Repeat("a", i%8)), 0755)
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		w.AddEventFilter(func(e Event) bool { return true })
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAddEventFilter(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+
+	// Only send creates of .go files larger than 1KB.
+	w.AddEventFilter(func(e Event) bool {
+		return filepath.Ext(e.Path) == ".go" && e.Size() > 1024
+	})
+	w.AddEventFilter(func(e Event) bool {
+		return e.Op == Create
+	})
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	big := make([]byte, 2048)
+	bigGo := filepath.Join(testDir, "big.go")
+	for name, data := range map[string][]byte{
+		"small.go": []byte("package main"),
+		"big.go":   big,
+		"big.txt":  big,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(testDir, name), data, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := tickEvents(t, w)
+	if len(events) != 1 || events[0].Op != Create || events[0].Path != bigGo {
+		t.Errorf("expected a create event for %s, got %v", bigGo, events)
+	}
+
+	// Writes don't pass the second filter.
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(bigGo, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if events := tickEvents(t, w); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+}
+
+func TestWatchEmptiness(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	drop := filepath.Join(testDir, "drop")
+	if err := os.Mkdir(drop, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.SetManualTicks(true)
+	w.FilterOps(Filled, Emptied)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WatchEmptiness(drop); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// An empty directory doesn't send an event.
+	if events := tickEvents(t, w); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+
+	files := []string{filepath.Join(drop, "a.txt"), filepath.Join(drop, "b.txt")}
+	for _, name := range files {
+		if err := ioutil.WriteFile(name, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := tickEvents(t, w)
+	if len(events) != 1 || events[0].Op != Filled || !strings.HasSuffix(events[0].Path, "drop") {
+		t.Errorf("expected a single filled event for %s, got %v", drop, events)
+	}
+
+	// Only the transitions send events.
+	if err := os.Remove(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if events := tickEvents(t, w); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+
+	if err := os.Remove(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	events = tickEvents(t, w)
+	if len(events) != 1 || events[0].Op != Emptied || !strings.HasSuffix(events[0].Path, "drop") {
+		t.Errorf("expected a single emptied event for %s, got %v", drop, events)
+	}
+}
+
+func TestWatchTotalSize(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+	w.FilterOps(TotalSizeAbove, TotalSizeBelow)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WatchTotalSize(testDir, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// Add 40 bytes at a time, including in a subdirectory, until the
+	// total is over 100 bytes.
+	files := []string{
+		filepath.Join(testDir, "a.txt"),
+		filepath.Join(testDir, "testDirTwo", "b.txt"),
+		filepath.Join(testDir, "c.txt"),
+	}
+	for i, name := range files {
+		if err := ioutil.WriteFile(name, bytes.Repeat([]byte("x"), 40), 0755); err != nil {
+			t.Fatal(err)
+		}
+		events := tickEvents(t, w)
+		if i < 2 {
+			if len(events) != 0 {
+				t.Errorf("expected no events at %d bytes, got %v", 40*(i+1), events)
+			}
+			continue
+		}
+		if len(events) != 1 || events[0].Op != TotalSizeAbove || events[0].Path != testDir {
+			t.Errorf("expected a single total size above event for %s, got %v", testDir, events)
+		}
+	}
+
+	// Only the transitions send events.
+	if err := ioutil.WriteFile(filepath.Join(testDir, "d.txt"), []byte("x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if events := tickEvents(t, w); len(events) != 0 {
+		t.Errorf("expected no events while above, got %v", events)
+	}
+
+	for _, name := range files[1:] {
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := tickEvents(t, w)
+	if len(events) != 1 || events[0].Op != TotalSizeBelow || events[0].Path != testDir {
+		t.Errorf("expected a single total size below event for %s, got %v", testDir, events)
+	}
+}
+
+func TestAddWithContext(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	dirA := filepath.Join(testDir, "a")
+	dirB := filepath.Join(testDir, "b")
+	for _, dir := range []string{dirA, dirB} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.SetManualTicks(true)
+	w.FilterOps(Create)
+
+	if err := w.AddWithContext(dirA, "tenant-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddWithContext(dirB, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	for _, dir := range []string{dirA, dirB} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ticked := make(chan error)
+	go func() { ticked <- w.Tick() }()
+
+	contexts := make(map[string]interface{})
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			contexts[filepath.Base(filepath.Dir(event.Path))] = event.Context
+		case err := <-ticked:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		}
+	}
+
+	expected := map[string]interface{}{"a": "tenant-a", "b": 42}
+	if !reflect.DeepEqual(contexts, expected) {
+		t.Errorf("expected contexts %v, got %v", expected, contexts)
+	}
+}
+
+func TestAddGroup(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	dirs := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", filepath.Join("c", "sub")} {
+		dirs[name] = filepath.Join(testDir, name)
+		if err := os.Mkdir(dirs[name], 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.SetManualTicks(true)
+	w.FilterOps(Create)
+
+	if err := w.AddGroup("docs", dirs["a"], dirs["b"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddGroup("src", dirs["c"]); err != nil {
+		t.Fatal(err)
+	}
+	// A root inside another belongs to its own group.
+	if err := w.AddGroup("vendor", dirs[filepath.Join("c", "sub")]); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := w.Config()
+	if len(cfg.Groups) != 4 {
+		t.Errorf("expected 4 groups in the config, got %v", cfg.Groups)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	for _, dir := range dirs {
+		if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ticked := make(chan error)
+	go func() { ticked <- w.Tick() }()
+
+	groups := make(map[string]string)
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			rel, err := filepath.Rel(testDir, filepath.Dir(event.Path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups[rel] = event.Group
+		case err := <-ticked:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		}
+	}
+
+	expected := map[string]string{
+		"a":                       "docs",
+		"b":                       "docs",
+		"c":                       "src",
+		filepath.Join("c", "sub"): "vendor",
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected groups %v, got %v", expected, groups)
+	}
+}
+
+func TestAddRecursiveNewSubdirectories(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	testDir, err := filepath.Abs(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.FilterOps(Create)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	startWatcher(t, w, time.Millisecond*100)
+	defer w.Close()
+
+	w.Wait()
+
+	// Create nested directories after the watcher has started, with a file
+	// deep inside of them.
+	deepDir := filepath.Join(testDir, "new", "a", "b")
+	if err := os.MkdirAll(deepDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	deepFile := filepath.Join(deepDir, "deep.txt")
+	if err := ioutil.WriteFile(deepFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		filepath.Join(testDir, "new"):      true,
+		filepath.Join(testDir, "new", "a"): true,
+		deepDir:                            true,
+		deepFile:                           true,
+	}
+	created := make(map[string]bool)
+	for len(created) < len(expected) {
+		select {
+		case event := <-w.Event:
+			created[event.Path] = true
+		case <-time.After(time.Millisecond * 500):
+			t.Fatalf("expected create events for %v, got %v", expected, created)
+		}
+	}
+	if !reflect.DeepEqual(created, expected) {
+		t.Errorf("expected create events for %v, got %v", expected, created)
+	}
+}
+
+func TestStats(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetManualTicks(true)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if stats := w.Stats(); stats.Scans != 0 || stats.Files != len(w.WatchedFiles()) {
+		t.Errorf("expected no scans and %d files, got %+v", len(w.WatchedFiles()), stats)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	if err := ioutil.WriteFile(filepath.Join(testDir, "new.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		ticked := make(chan error)
+		go func() { ticked <- w.Tick() }()
+		for done := false; !done; {
+			select {
+			case <-w.Event:
+			case err := <-ticked:
+				if err != nil {
+					t.Fatal(err)
+				}
+				done = true
+			}
+		}
+	}
+
+	stats := w.Stats()
+	if stats.Scans != 2 {
+		t.Errorf("expected 2 scans, got %d", stats.Scans)
+	}
+	if stats.LastScan <= 0 || stats.AverageScan <= 0 {
+		t.Errorf("expected the scan durations to be set, got %+v", stats)
+	}
+	if stats.Files != len(w.WatchedFiles()) {
+		t.Errorf("expected %d files, got %d", len(w.WatchedFiles()), stats.Files)
+	}
+	// The new file's create and the directory's write.
+	if stats.Events != 2 {
+		t.Errorf("expected 2 events, got %d", stats.Events)
+	}
+}
+
+func TestSetAdaptivePolling(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.SetAdaptivePolling(0, time.Second); err != ErrDurationTooShort {
+		t.Errorf("expected ErrDurationTooShort for a min of 0, got %v", err)
+	}
+	if err := w.SetAdaptivePolling(time.Second, time.Millisecond); err == nil {
+		t.Error("expected an error for a max less than min")
+	}
+
+	const min, max = time.Millisecond * 50, time.Millisecond * 400
+	if err := w.SetAdaptivePolling(min, max); err != nil {
+		t.Fatal(err)
+	}
+	w.FilterOps(Create)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// waitForInterval waits for the polling interval to become d.
+	waitForInterval := func(d time.Duration, timeout time.Duration) {
+		deadline := time.Now().Add(timeout)
+		for w.Stats().Interval != d {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the interval to become %s, got %s", d, w.Stats().Interval)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The interval backs off while nothing changes.
+	waitForInterval(max, time.Second*2)
+
+	if err := ioutil.WriteFile(filepath.Join(testDir, "new.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-w.Event:
+	case <-time.After(max * 2):
+		t.Fatal("received no event")
+	}
+
+	// A cycle with events sets it back to min.
+	waitForInterval(min, min)
+}
+
+func TestSetQuietStart(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	deleted := filepath.Join(testDir, "deleted")
+	live := filepath.Join(testDir, "live")
+	for _, dir := range []string{deleted, live} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.SetManualTicks(true)
+	w.SetQuietStart(true)
+
+	for _, dir := range []string{deleted, live} {
+		if err := w.AddRecursive(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Delete one of the roots before the watcher starts.
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	tick := func() []error {
+		ticked := make(chan error)
+		go func() { ticked <- w.Tick() }()
+
+		var errs []error
+		for {
+			select {
+			case <-w.Event:
+			case err := <-w.Error:
+				errs = append(errs, err)
+			case err := <-ticked:
+				if err != nil {
+					t.Fatal(err)
+				}
+				return errs
+			}
+		}
+	}
+
+	if errs := tick(); len(errs) != 0 {
+		t.Errorf("expected no errors on the first cycle, got %v", errs)
+	}
+	for path := range w.WatchedFiles() {
+		if strings.HasSuffix(path, "deleted") {
+			t.Errorf("expected %s to be removed, got %v", deleted, w.WatchedFiles())
+		}
+	}
+
+	// Roots deleted while the watcher is running are still reported.
+	if err := os.Remove(live); err != nil {
+		t.Fatal(err)
+	}
+	errs := tick()
+	if len(errs) != 1 || errs[0].(*WatcherError).Err != ErrWatchedFileDeleted {
+		t.Errorf("expected an ErrWatchedFileDeleted error, got %v", errs)
+	}
+}
+
+func TestSetQuietStartChanges(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	deleted := filepath.Join(testDir, "deleted")
+	live := filepath.Join(testDir, "live")
+	for _, dir := range []string{deleted, live} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.SetQuietStart(true)
+
+	for _, dir := range []string{deleted, live} {
+		if err := w.AddRecursive(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errs := w.Changes(); len(errs) != 0 {
+		t.Errorf("expected no errors on the first scan, got %v", errs)
+	}
+
+	// Only the first scan is quiet, even without Start.
+	if err := os.Remove(live); err != nil {
+		t.Fatal(err)
+	}
+	_, errs := w.Changes()
+	if len(errs) != 1 || !Is(errs[0], ErrWatchedFileDeleted) {
+		t.Errorf("expected an ErrWatchedFileDeleted error, got %v", errs)
+	}
+}
+
+func TestSuspendRoot(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	testDir, err := filepath.Abs(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noisy := filepath.Join(testDir, "noisy")
+	quiet := filepath.Join(testDir, "quiet")
+	for _, dir := range []string{noisy, quiet} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "old.txt"), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := New()
+	w.SetManualTicks(true)
+
+	for _, dir := range []string{noisy, quiet} {
+		if err := w.AddRecursive(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.SuspendRoot(filepath.Join(testDir, "missing")); err != ErrNotWatched {
+		t.Errorf("expected ErrNotWatched, got %v", err)
+	}
+	if err := w.SuspendRoot(noisy); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	// tick returns the events for each root from one cycle.
+	tick := func() map[string][]Op {
+		ticked := make(chan error)
+		go func() { ticked <- w.Tick() }()
+
+		events := make(map[string][]Op)
+		for {
+			select {
+			case event := <-w.Event:
+				events[event.Root] = append(events[event.Root], event.Op)
+			case err := <-ticked:
+				if err != nil {
+					t.Fatal(err)
+				}
+				return events
+			}
+		}
+	}
+
+	// change creates a new file in both roots and removes their old files.
+	change := func(name string) {
+		for _, dir := range []string{noisy, quiet} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(filepath.Join(dir, "old.txt")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(filepath.Join(dir, name), filepath.Join(dir, "old.txt")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	change("new_1.txt")
+	events := tick()
+	if len(events[quiet]) == 0 || len(events[noisy]) != 0 {
+		t.Errorf("expected events for %s only, got %v", quiet, events)
+	}
+
+	// The suspended root's changes are reported once it's resumed.
+	if err := w.ResumeRoot(noisy); err != nil {
+		t.Fatal(err)
+	}
+	events = tick()
+	if len(events[noisy]) == 0 || len(events[quiet]) != 0 {
+		t.Errorf("expected events for %s only, got %v", noisy, events)
+	}
+
+	// Unless it's resumed quietly.
+	if err := w.SuspendRoot(noisy); err != nil {
+		t.Fatal(err)
+	}
+	change("new_2.txt")
+	if events := tick(); len(events[noisy]) != 0 {
+		t.Errorf("expected no events for %s, got %v", noisy, events)
+	}
+	if err := w.ResumeRootQuiet(noisy); err != nil {
+		t.Fatal(err)
+	}
+	if events := tick(); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+}
+
+func TestRemoveAddedTwice(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+
+	for i := 0; i < 2; i++ {
+		if err := w.Add(testDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Remove(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.names) != 0 {
+		t.Errorf("expected no names to be left, got %v", w.names)
+	}
+	if len(w.files) != 0 {
+		t.Errorf("expected no files to be left, got %v", w.files)
+	}
+}
+
+func TestSetPresenceOnly(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	testDir, err := filepath.Abs(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.SetManualTicks(true)
+	w.SetPresenceOnly(true)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duration is ignored.
+	startWatcher(t, w, time.Hour)
+	defer w.Close()
+
+	w.Wait()
+
+	created := filepath.Join(testDir, "testDirTwo", "new.txt")
+	if err := ioutil.WriteFile(created, []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	removed := filepath.Join(testDir, "file_1.txt")
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	// Writes aren't detected.
+	written := filepath.Join(testDir, "file_2.txt")
+	if err := ioutil.WriteFile(written, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ticked := make(chan error)
+	go func() { ticked <- w.Tick() }()
+
+	events := make(map[string]Op)
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			events[event.Path] = event.Op
+		case err := <-ticked:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		}
+	}
+
+	expected := map[string]Op{
+		created: Create,
+		removed: Remove,
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
@@ -0,0 +1,127 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// webhookQueueSize is the number of events that can wait to be sent to
+	// the webhook before new events are dropped.
+	webhookQueueSize = 100
+
+	// webhookAttempts is the number of times an event is sent to the
+	// webhook before giving up on it.
+	webhookAttempts = 3
+
+	// webhookBackoff is how long to wait before retrying a failed event.
+	// It's doubled after every failed attempt.
+	webhookBackoff = time.Millisecond * 100
+
+	// webhookDropInterval is the least time between warnings about events
+	// dropped from the full webhook queue.
+	webhookDropInterval = time.Second
+)
+
+// SetWebhook sets the watcher to POST every event it sends as JSON to url.
+// Events are sent from a separate goroutine so a slow or failing webhook
+// never blocks the watching process. Failed requests are retried with
+// backoff, and errors are sent on the Error channel as warnings. At most 100
+// events wait to be sent, and any more are dropped while the queue is full,
+// which is reported by a warning with ErrWebhookQueueFull at most once a
+// second. If client is nil, http.DefaultClient is used. An empty url removes
+// the webhook.
+func (w *Watcher) SetWebhook(url string, client *http.Client) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	w.mu.Lock()
+	w.webhookURL = url
+	w.webhookClient = client
+	w.mu.Unlock()
+}
+
+// runWebhook sends queued events to the webhook until the watcher closes.
+func (w *Watcher) runWebhook() {
+	// warned is when events dropped from the full queue were last
+	// reported.
+	var warned time.Time
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case e := <-w.webhook:
+			// Events are always queued, so skip them when there's
+			// no webhook set.
+			w.mu.Lock()
+			url, client := w.webhookURL, w.webhookClient
+			w.mu.Unlock()
+
+			if url == "" {
+				atomic.StoreUint64(&w.webhookDropped, 0)
+				continue
+			}
+
+			if atomic.LoadUint64(&w.webhookDropped) > 0 &&
+				time.Since(warned) >= webhookDropInterval {
+				atomic.StoreUint64(&w.webhookDropped, 0)
+				warned = time.Now()
+				select {
+				case <-w.stop:
+					return
+				case w.warnings() <- &WatcherError{Warning, "", ErrWebhookQueueFull}:
+				}
+			}
+
+			if err := w.postEvent(url, client, e); err != nil {
+				select {
+				case <-w.stop:
+					return
+				case w.warnings() <- &WatcherError{Warning, e.Path, err}:
+				}
+			}
+		}
+	}
+}
+
+// postEvent sends e to the webhook, retrying with backoff on failure.
+func (w *Watcher) postEvent(url string, client *http.Client, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = post(client, url, body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+
+		select {
+		case <-w.stop:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func post(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error: webhook responded with %s", resp.Status)
+	}
+	return nil
+}